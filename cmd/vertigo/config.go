@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"vertigo/internal/config"
+	"vertigo/internal/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runConfig runs the config subcommands. "config check" loads and validates a configuration file,
+// including the providers' credential files, without starting the server.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: vertigo config check [-config path]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("config", "vertigo.yaml", "path to the configuration file")
+	fs.Parse(args[1:])
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	manager, err := proxy.NewManager(cfg, nil, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration in %s:\n%v\n", *configPath, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s is valid\n", *configPath)
+	for _, p := range manager.Settings().Providers {
+		fmt.Printf("  provider %s (%s): %d keys\n", p.Name, p.Type, len(p.KeyManager.Keys()))
+	}
+	for _, warning := range cfg.Warnings() {
+		fmt.Printf("  warning: %s\n", warning)
+	}
+}
@@ -1,19 +1,38 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
+	"os"
+	"time"
 
+	"vertigo/internal/api"
+	"vertigo/internal/batch"
+	"vertigo/internal/cache"
 	"vertigo/internal/config"
 	"vertigo/internal/db"
+	"vertigo/internal/middleware"
 	"vertigo/internal/proxy"
 	"vertigo/internal/server"
 	"vertigo/internal/store"
+	"vertigo/internal/tracing"
 
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	// --- Subcommands ---
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		runUsage(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+
 	// --- Configuration ---
 	configPath := flag.String("config", "vertigo.yaml", "path to the configuration file")
 	flag.Parse()
@@ -25,25 +44,87 @@ func main() {
 	if err != nil {
 		logger.Fatalf("Failed to load configuration: %v", err)
 	}
+	for _, warning := range cfg.Warnings() {
+		logger.Warn(warning)
+	}
 
-	if len(cfg.Gemini.APIKeys) == 0 {
-		logger.Fatal("No API keys found in the configuration")
+	// --- Tracing ---
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		logger.Fatalf("Failed to initialize tracing: %v", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("Failed to flush traces: %v", err)
+		}
+	}()
 
 	// --- Database Initialization ---
-	database, err := db.InitDB("vertigo.db")
+	database, err := db.InitDB(cfg.Database.Path)
 	if err != nil {
 		logger.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.CloseDB(database)
 
 	// --- Dependencies ---
-	keyManager := proxy.NewKeyManager(cfg.Gemini.APIKeys)
 	convStore := store.NewConversationStore(database)
-	proxyManager := proxy.NewManager(keyManager, convStore, logger)
+	proxyManager, err := proxy.NewManager(cfg, convStore, logger)
+	if err != nil {
+		logger.Fatalf("Failed to configure upstream providers: %v", err)
+	}
+
+	responseCache, err := cache.New(cfg.Cache, database)
+	if err != nil {
+		logger.Fatalf("Failed to initialize response cache: %v", err)
+	}
+	proxyManager.ResponseCache = responseCache
+	proxyManager.SemanticCache = cache.NewSemantic(cfg.Cache.Semantic, database)
+
+	if cfg.Usage.Enabled {
+		usageStore := store.NewUsageStore(database)
+		for _, price := range cfg.Usage.Prices {
+			if err := usageStore.SetPrice(store.ModelPrice(price)); err != nil {
+				logger.Fatalf("Failed to load model prices: %v", err)
+			}
+		}
+		proxyManager.UsageStore = usageStore
+	}
+
+	if cfg.Admin.Enabled && cfg.Admin.Persist {
+		proxyManager.KeyStore = store.NewKeyStore(database)
+		if err := proxyManager.LoadKeyOverrides(); err != nil {
+			logger.Fatalf("Failed to load key changes: %v", err)
+		}
+	}
+
+	// Background work stops as soon as shutdown starts, rather than running while the server drains
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// --- Key Health Checks ---
+	go proxyManager.RunHealthChecks(background)
+
+	// --- Batches ---
+	if cfg.Batch.Enabled {
+		proxyManager.FileStore = store.NewFileStore(database)
+		proxyManager.BatchStore = store.NewBatchStore(database)
+		// Batch requests go through the chat completions handler like any other request, and are logged with it.
+		// A panic fails the request rather than taking down the server.
+		handler := middleware.Chain(http.HandlerFunc(api.NewOpenAIAPI(proxyManager, logger).ChatCompletionsHandler),
+			middleware.RequestID, middleware.Logger(logger), middleware.Recover(logger))
+		runner := batch.NewRunner(cfg.Batch, proxyManager.FileStore, proxyManager.BatchStore, handler, logger)
+		go runner.Run(background)
+	}
 
 	// --- HTTP Server ---
 	srv := server.New(cfg, proxyManager, logger)
+	srv.RegisterOnShutdown(stopBackground)
+
+	// --- Configuration Reload ---
+	reloader := &reloader{path: *configPath, current: cfg, manager: proxyManager, log: logger}
+	go config.Watch(background, *configPath, cfg.Reload, reloader.reload)
 
 	log.Printf("Server starting on %s:%d", cfg.Server.Host, cfg.Server.Port)
 	srv.Run()
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+
+	"vertigo/internal/config"
+	"vertigo/internal/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloader applies changes of the configuration file to the running proxy.
+type reloader struct {
+	path    string
+	current *config.Config
+	manager *proxy.Manager
+	log     *logrus.Logger
+}
+
+// reload loads and applies the configuration file. An invalid file is rejected as a whole and the
+// running configuration stays in effect.
+func (r *reloader) reload(trigger string) {
+	log := r.log.WithFields(logrus.Fields{"trigger": trigger, "path": r.path})
+
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		log.Errorf("Configuration reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	if err := r.manager.Reload(cfg); err != nil {
+		log.Errorf("Configuration reload failed, keeping the current configuration: %v", err)
+		return
+	}
+
+	// These sections are read once at startup
+	for name, changed := range map[string]bool{
+		"server":   !reflect.DeepEqual(cfg.Server, r.current.Server),
+		"usage":    !reflect.DeepEqual(cfg.Usage, r.current.Usage),
+		"tracing":  !reflect.DeepEqual(cfg.Tracing, r.current.Tracing),
+		"reload":   !reflect.DeepEqual(cfg.Reload, r.current.Reload),
+		"admin":    !reflect.DeepEqual(cfg.Admin, r.current.Admin),
+		"batch":    cfg.Batch != r.current.Batch,
+		"database": cfg.Database != r.current.Database,
+		"cache":    cacheBackendChanged(cfg.Cache, r.current.Cache),
+	} {
+		if changed {
+			log.WithField("section", name).Warn("Configuration change requires a restart to take effect")
+		}
+	}
+	for _, warning := range cfg.Warnings() {
+		log.Warn(warning)
+	}
+	r.current = cfg
+	log.Info("Configuration reloaded")
+}
+
+// cacheBackendChanged reports whether the cache settings differ in a way that needs the caches to be recreated.
+func cacheBackendChanged(a, b config.CacheConfig) bool {
+	return a.Enabled != b.Enabled || a.Backend != b.Backend || a.TTL != b.TTL || a.MaxEntries != b.MaxEntries ||
+		a.Semantic.Enabled != b.Semantic.Enabled || a.Semantic.Threshold != b.Semantic.Threshold || a.Semantic.TTL != b.Semantic.TTL ||
+		a.Semantic.MaxCandidates != b.Semantic.MaxCandidates
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/db"
+	"vertigo/internal/store"
+)
+
+// runUsage prints a usage and cost report from the database. The database is the one the server uses:
+// database.path from the configuration file, or VERTIGO_DATABASE_PATH, unless -db names another.
+func runUsage(args []string) {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	configPath := fs.String("config", "vertigo.yaml", "path to the configuration file")
+	dbPath := fs.String("db", "", "path to the SQLite database (default: database.path from the configuration)")
+	groupBy := fs.String("group-by", "day,model,client", "comma-separated grouping: day, model, client, hedge")
+	days := fs.Int("days", 30, "number of days to report on")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	if *dbPath == "" {
+		// Without an explicit -config, a missing default file leaves the environment and defaults
+		configSet := false
+		fs.Visit(func(f *flag.Flag) { configSet = configSet || f.Name == "config" })
+		databaseCfg, err := config.LoadDatabase(*configPath, configSet)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		*dbPath = databaseCfg.Path
+	}
+
+	database, err := db.InitDB(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB(database)
+
+	usageStore := store.NewUsageStore(database)
+	summaries, err := usageStore.Summary(strings.Split(*groupBy, ","), time.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		log.Fatalf("Failed to query usage: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(summaries)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DAY\tMODEL\tCLIENT\tHEDGE\tREQUESTS\tERRORS\tPROMPT\tCOMPLETION\tCACHED\tCOST (USD)")
+	var total store.UsageSummary
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.4f\n",
+			dashIfEmpty(s.Day), dashIfEmpty(s.Model), dashIfEmpty(s.Client), dashIfEmpty(s.Hedge),
+			s.Requests, s.Errors, s.PromptTokens, s.CompletionTokens, s.CachedTokens, s.Cost)
+		total.Requests += s.Requests
+		total.Errors += s.Errors
+		total.PromptTokens += s.PromptTokens
+		total.CompletionTokens += s.CompletionTokens
+		total.CachedTokens += s.CachedTokens
+		total.Cost += s.Cost
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t\t\t%d\t%d\t%d\t%d\t%d\t%.4f\n",
+		total.Requests, total.Errors, total.PromptTokens, total.CompletionTokens, total.CachedTokens, total.Cost)
+	tw.Flush()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"vertigo/internal/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdminAPI represents the key pool and circuit breaker administration handlers.
+type AdminAPI struct {
+	ProxyManager *proxy.Manager
+	Tokens       []string
+	Log          *logrus.Logger
+}
+
+// NewAdminAPI creates a new AdminAPI instance that accepts the given bearer tokens.
+func NewAdminAPI(proxyManager *proxy.Manager, tokens []string, logger *logrus.Logger) *AdminAPI {
+	return &AdminAPI{
+		ProxyManager: proxyManager,
+		Tokens:       tokens,
+		Log:          logger,
+	}
+}
+
+// Authenticate rejects requests that do not carry one of the admin tokens as a bearer token.
+func (api *AdminAPI) Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			for _, t := range api.Tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					next(w, r)
+					return
+				}
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, ErrorTypeAuthentication, "invalid_api_key", "Invalid admin token")
+	}
+}
+
+// KeysHandler handles requests to the /vertigo/v1/admin/keys endpoint.
+// GET lists every key with its health and usage, and POST adds a key ({"provider", "key"}).
+func (api *AdminAPI) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		keys := api.ProxyManager.KeyInfos()
+		if keys == nil {
+			keys = []proxy.KeyInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   keys,
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Provider string `json:"provider"`
+			Key      string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Provider == "" || strings.TrimSpace(req.Key) == "" {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid key, expected provider and key")
+			return
+		}
+		info, err := api.ProxyManager.AddKey(req.Provider, strings.TrimSpace(req.Key))
+		if err != nil {
+			api.writeKeyError(w, err)
+			return
+		}
+		api.Log.WithFields(logrus.Fields{"provider": info.Provider, "key_id": info.ID}).Info("Added key through the admin API")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+	}
+}
+
+// KeyHandler handles requests to the /vertigo/v1/admin/keys/{provider}/{id} endpoint. DELETE removes the key.
+func (api *AdminAPI) KeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+	provider, id := r.PathValue("provider"), r.PathValue("id")
+	if err := api.ProxyManager.RemoveKey(provider, id); err != nil {
+		api.writeKeyError(w, err)
+		return
+	}
+	api.Log.WithFields(logrus.Fields{"provider": provider, "key_id": id}).Info("Removed key through the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// KeyActionHandler handles requests to the /vertigo/v1/admin/keys/{provider}/{id}/{action} endpoint.
+// POST with the action disable or enable changes whether the key is used, and probe tests it with a cheap
+// upstream request (a models list, or a one-token completion for ?model=...).
+func (api *AdminAPI) KeyActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+	provider, id := r.PathValue("provider"), r.PathValue("id")
+
+	var result interface{}
+	var err error
+	switch action := r.PathValue("action"); action {
+	case "disable", "enable":
+		result, err = api.ProxyManager.SetKeyDisabled(provider, id, action == "disable")
+		if err == nil {
+			api.Log.WithFields(logrus.Fields{"provider": provider, "key_id": id, "action": action}).Info("Changed key through the admin API")
+		}
+	case "probe":
+		result, err = api.ProxyManager.ProbeKey(r.Context(), provider, id, r.URL.Query().Get("model"))
+	default:
+		writeError(w, http.StatusNotFound, ErrorTypeInvalidRequest, "", "Unknown key action")
+		return
+	}
+	if err != nil {
+		api.writeKeyError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// CircuitsHandler handles requests to the /vertigo/v1/admin/circuits endpoint.
+// GET lists the circuit breaker state of every model and provider with requests in flight or failures counted.
+func (api *AdminAPI) CircuitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   api.ProxyManager.CircuitStates(),
+	})
+}
+
+// writeKeyError maps the errors of the key administration methods to HTTP responses.
+func (api *AdminAPI) writeKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, proxy.ErrProviderNotFound), errors.Is(err, proxy.ErrKeyNotFound):
+		writeError(w, http.StatusNotFound, ErrorTypeInvalidRequest, "", err.Error())
+	case errors.Is(err, proxy.ErrKeyExists):
+		writeError(w, http.StatusConflict, ErrorTypeInvalidRequest, "", err.Error())
+	case errors.Is(err, proxy.ErrKeysNotEditable):
+		writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", err.Error())
+	default:
+		api.Log.Errorf("Key administration failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Key administration failed")
+	}
+}
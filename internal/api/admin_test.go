@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"vertigo/internal/config"
+	"vertigo/internal/db"
+	"vertigo/internal/proxy"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminToken = "admin-secret"
+	configKey  = "sk-config-key-0001"
+	addedKey   = "sk-added-key-0002"
+)
+
+// adminTest is a proxy manager that persists key changes, served by the admin API.
+type adminTest struct {
+	t        *testing.T
+	database *sql.DB
+	cfg      *config.Config
+	pm       *proxy.Manager
+	handler  http.Handler
+
+	mu   sync.Mutex
+	used []string // The keys upstream received requests with
+}
+
+func newAdminTest(t *testing.T) *adminTest {
+	t.Helper()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	at := &adminTest{t: t, database: database}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at.mu.Lock()
+		at.used = append(at.used, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		at.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"pong"}}]}`)
+	}))
+	t.Cleanup(upstream.Close)
+	at.cfg = &config.Config{Providers: []config.ProviderConfig{
+		{Name: "test", Type: "openai", BaseURL: upstream.URL, APIKeys: []string{configKey}},
+	}}
+	at.start()
+	return at
+}
+
+// start creates the proxy manager and admin API, as the server does on startup.
+func (at *adminTest) start() {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	pm, err := proxy.NewManager(at.cfg, store.NewConversationStore(at.database), logger)
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	pm.KeyStore = store.NewKeyStore(at.database)
+	if err := pm.LoadKeyOverrides(); err != nil {
+		at.t.Fatal(err)
+	}
+
+	admin := NewAdminAPI(pm, []string{adminToken}, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vertigo/v1/admin/keys", admin.Authenticate(admin.KeysHandler))
+	mux.HandleFunc("/vertigo/v1/admin/keys/{provider}/{id}", admin.Authenticate(admin.KeyHandler))
+	mux.HandleFunc("/vertigo/v1/admin/keys/{provider}/{id}/{action}", admin.Authenticate(admin.KeyActionHandler))
+	at.pm, at.handler = pm, mux
+}
+
+func (at *adminTest) do(method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	at.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// keys returns the keys of the pool by ID, as listed by the admin API.
+func (at *adminTest) keys() map[string]proxy.KeyInfo {
+	at.t.Helper()
+	rec := at.do(http.MethodGet, "/vertigo/v1/admin/keys", adminToken, "")
+	var list struct {
+		Data []proxy.KeyInfo `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		at.t.Fatalf("keys list %q: %v", rec.Body.String(), err)
+	}
+	keys := make(map[string]proxy.KeyInfo)
+	for _, info := range list.Data {
+		keys[info.ID] = info
+	}
+	return keys
+}
+
+// complete sends a completion through the proxy and returns the key upstream received it with.
+func (at *adminTest) complete() string {
+	at.t.Helper()
+	response, err := at.pm.ProcessRequest(context.Background(), []byte(`{"model":"m","messages":[{"role":"user","content":"ping"}]}`), http.Header{}, "", false)
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.used[len(at.used)-1]
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	at := newAdminTest(t)
+	for _, token := range []string{"", "wrong"} {
+		rec := at.do(http.MethodGet, "/vertigo/v1/admin/keys", token, "")
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %q: status %d, WWW-Authenticate %q; want 401 with a Bearer challenge",
+				token, rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+	// Changes are rejected as well, and leave the pool alone
+	rec := at.do(http.MethodPost, "/vertigo/v1/admin/keys", "wrong", `{"provider":"test","key":"`+addedKey+`"}`)
+	if rec.Code != http.StatusUnauthorized || len(at.keys()) != 1 {
+		t.Errorf("adding a key without the token: status %d, %d keys", rec.Code, len(at.keys()))
+	}
+	if rec := at.do(http.MethodGet, "/vertigo/v1/admin/keys", adminToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("status = %d with the admin token, want 200", rec.Code)
+	}
+}
+
+func TestAdminKeyOverrides(t *testing.T) {
+	at := newAdminTest(t)
+	configID, addedID := proxy.KeyID(configKey), proxy.KeyID(addedKey)
+
+	if rec := at.do(http.MethodPost, "/vertigo/v1/admin/keys", adminToken, `{"provider":"test","key":"`+addedKey+`"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("adding a key: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := at.do(http.MethodPost, "/vertigo/v1/admin/keys/test/"+configID+"/disable", adminToken, ""); rec.Code != http.StatusOK {
+		t.Fatalf("disabling a key: status %d, body %s", rec.Code, rec.Body)
+	}
+	// Only the added key is used while the configured one is disabled
+	for range 3 {
+		if key := at.complete(); key != addedKey {
+			t.Fatalf("upstream received a request with %s, want only %s", key, addedKey)
+		}
+	}
+
+	check := func(when string) {
+		t.Helper()
+		keys := at.keys()
+		if len(keys) != 2 || !keys[configID].Disabled || keys[addedID].Disabled {
+			t.Errorf("%s: keys = %+v, want the configured key disabled and the added key enabled", when, keys)
+		}
+		if key := at.complete(); key != addedKey {
+			t.Errorf("%s: upstream received a request with %s, want %s", when, key, addedKey)
+		}
+	}
+	if err := at.pm.Reload(at.cfg); err != nil {
+		t.Fatal(err)
+	}
+	check("after a reload")
+	at.start()
+	check("after a restart")
+
+	// Removing the added key and enabling the configured one restores the configuration
+	if rec := at.do(http.MethodDelete, "/vertigo/v1/admin/keys/test/"+addedID, adminToken, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("removing a key: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := at.do(http.MethodPost, "/vertigo/v1/admin/keys/test/"+configID+"/enable", adminToken, ""); rec.Code != http.StatusOK {
+		t.Fatalf("enabling a key: status %d, body %s", rec.Code, rec.Body)
+	}
+	if overrides, err := store.NewKeyStore(at.database).Overrides(); err != nil || len(overrides) != 0 {
+		t.Errorf("overrides = %+v, %v; want none left", overrides, err)
+	}
+	if key := at.complete(); key != configKey {
+		t.Errorf("upstream received a request with %s, want %s", key, configKey)
+	}
+}
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vertigo/internal/batch"
+	"vertigo/internal/config"
+	"vertigo/internal/proxy"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMaxFileSizeMB limits uploads to the Files API when batch.max_file_size_mb is not set.
+const defaultMaxFileSizeMB = 100
+
+// The only completion window of a batch, as in the OpenAI Batch API.
+const (
+	completionWindow         = "24h"
+	completionWindowDuration = 24 * time.Hour
+)
+
+// BatchAPI represents the OpenAI-compatible Files and Batches handlers. The batches themselves are
+// drained by a batch.Runner. Files and batches belong to the credential that created them, by
+// proxy.CredentialIdentity, so the X-Vertigo-Client header cannot reach another client's objects; other
+// clients cannot list them, and get a 404 for their IDs.
+type BatchAPI struct {
+	Files   *store.FileStore
+	Batches *store.BatchStore
+	Config  config.BatchConfig
+	Log     *logrus.Logger
+}
+
+// NewBatchAPI creates a new BatchAPI instance.
+func NewBatchAPI(files *store.FileStore, batches *store.BatchStore, cfg config.BatchConfig, logger *logrus.Logger) *BatchAPI {
+	return &BatchAPI{
+		Files:   files,
+		Batches: batches,
+		Config:  cfg,
+		Log:     logger,
+	}
+}
+
+// FilesHandler handles requests to the /openai/v1/files endpoint. GET lists the files (?purpose=...), and
+// POST uploads a batch input file as multipart form data with the fields file and purpose.
+func (api *BatchAPI) FilesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		files, err := api.Files.Files(proxy.CredentialIdentity(r.Header), r.URL.Query().Get("purpose"))
+		if err != nil {
+			api.Log.Errorf("Failed to query files: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to query files")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   files,
+		})
+
+	case http.MethodPost:
+		maxSize := int64(api.Config.MaxFileSizeMB)
+		if maxSize <= 0 {
+			maxSize = defaultMaxFileSizeMB
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, ErrorTypeInvalidRequest, "", "File exceeds the maximum size of "+strconv.FormatInt(maxSize, 10)+" MB")
+				return
+			}
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid upload, expected multipart form data with file and purpose")
+			return
+		}
+		if purpose := r.FormValue("purpose"); purpose != store.FilePurposeBatch {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid purpose, only batch is supported")
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Missing file")
+			return
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Failed to read file")
+			return
+		}
+
+		f, err := api.Files.CreateFile(proxy.CredentialIdentity(r.Header), store.FilePurposeBatch, header.Filename, content)
+		if err != nil {
+			api.Log.Errorf("Failed to store file: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to store file")
+			return
+		}
+		api.Log.WithFields(logrus.Fields{"file_id": f.ID, "bytes": f.Bytes, "client": proxy.CredentialFingerprint(f.Client)}).Info("Uploaded file")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+	}
+}
+
+// FileHandler handles requests to the /openai/v1/files/{id} endpoint. GET describes the file and DELETE removes it.
+func (api *BatchAPI) FileHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	client := proxy.CredentialIdentity(r.Header)
+	switch r.Method {
+	case http.MethodGet:
+		f, err := api.Files.File(id, client)
+		if err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+
+	case http.MethodDelete:
+		if err := api.Files.DeleteFile(id, client); err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      id,
+			"object":  "file",
+			"deleted": true,
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+	}
+}
+
+// FileContentHandler handles requests to the /openai/v1/files/{id}/content endpoint. GET downloads the file,
+// e.g. the output or error file of a batch.
+func (api *BatchAPI) FileContentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+	content, err := api.Files.Content(r.PathValue("id"), proxy.CredentialIdentity(r.Header))
+	if err != nil {
+		api.writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Write(content)
+}
+
+// BatchesHandler handles requests to the /openai/v1/batches endpoint. POST creates a batch from an uploaded
+// input file ({"input_file_id", "endpoint", "completion_window", "metadata"}), and GET lists batches, newest
+// first, with the limit and after pagination parameters.
+func (api *BatchAPI) BatchesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit := 20
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > 100 {
+				writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid limit parameter, expected 1 to 100")
+				return
+			}
+			limit = n
+		}
+		// One more than asked for tells whether there are more
+		batches, err := api.Batches.Batches(proxy.CredentialIdentity(r.Header), limit+1, r.URL.Query().Get("after"))
+		if err != nil {
+			api.Log.Errorf("Failed to query batches: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to query batches")
+			return
+		}
+		hasMore := len(batches) > limit
+		if hasMore {
+			batches = batches[:limit]
+		}
+		resp := map[string]interface{}{
+			"object":   "list",
+			"data":     batches,
+			"has_more": hasMore,
+		}
+		if len(batches) > 0 {
+			resp["first_id"] = batches[0].ID
+			resp["last_id"] = batches[len(batches)-1].ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodPost:
+		var req struct {
+			InputFileID      string            `json:"input_file_id"`
+			Endpoint         string            `json:"endpoint"`
+			CompletionWindow string            `json:"completion_window"`
+			Metadata         map[string]string `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.InputFileID == "" {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid batch, expected input_file_id, endpoint and completion_window")
+			return
+		}
+		if req.Endpoint != batch.Endpoint {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid endpoint, only "+batch.Endpoint+" is supported")
+			return
+		}
+		if req.CompletionWindow != completionWindow {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid completion_window, only "+completionWindow+" is supported")
+			return
+		}
+		client := proxy.CredentialIdentity(r.Header)
+		f, err := api.Files.File(req.InputFileID, client)
+		if err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+		if f.Purpose != store.FilePurposeBatch {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "The input file was not uploaded with purpose batch")
+			return
+		}
+
+		b, err := api.Batches.CreateBatch(store.Batch{
+			Endpoint:         req.Endpoint,
+			InputFileID:      req.InputFileID,
+			CompletionWindow: req.CompletionWindow,
+			Metadata:         req.Metadata,
+			Client:           client,
+		}, completionWindowDuration)
+		if err != nil {
+			api.Log.Errorf("Failed to create batch: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to create batch")
+			return
+		}
+		api.Log.WithFields(logrus.Fields{"batch_id": b.ID, "input_file_id": b.InputFileID, "client": proxy.CredentialFingerprint(b.Client)}).Info("Created batch")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+	}
+}
+
+// BatchHandler handles requests to the /openai/v1/batches/{id} endpoint. GET describes the batch and its progress.
+func (api *BatchAPI) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+	b, err := api.batch(r)
+	if err != nil {
+		api.writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// BatchCancelHandler handles requests to the /openai/v1/batches/{id}/cancel endpoint. POST cancels the
+// batch: it moves to cancelling, and to cancelled once the requests in flight are done, with the results
+// so far in its output and error files.
+func (api *BatchAPI) BatchCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+	b, err := api.batch(r)
+	if err == nil {
+		b, err = api.Batches.CancelBatch(b.ID)
+	}
+	if err != nil {
+		api.writeStoreError(w, err)
+		return
+	}
+	api.Log.WithField("batch_id", b.ID).Info("Cancelling batch")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// batch returns the batch named by the request path, or ErrBatchNotFound if the caller did not create it.
+func (api *BatchAPI) batch(r *http.Request) (store.Batch, error) {
+	b, err := api.Batches.Batch(r.PathValue("id"))
+	if err != nil {
+		return store.Batch{}, err
+	}
+	if b.Client != proxy.CredentialIdentity(r.Header) {
+		return store.Batch{}, store.ErrBatchNotFound
+	}
+	return b, nil
+}
+
+// writeStoreError maps the errors of the file and batch stores to HTTP responses.
+func (api *BatchAPI) writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrFileNotFound), errors.Is(err, store.ErrBatchNotFound):
+		writeError(w, http.StatusNotFound, ErrorTypeInvalidRequest, "", err.Error())
+	case errors.Is(err, store.ErrBatchNotCancellable):
+		writeError(w, http.StatusConflict, ErrorTypeInvalidRequest, "", err.Error())
+	default:
+		api.Log.Errorf("Batch store failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Internal server error")
+	}
+}
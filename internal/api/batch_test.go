@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vertigo/internal/config"
+	"vertigo/internal/db"
+	"vertigo/internal/proxy"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestBatchAPI(t *testing.T) http.Handler {
+	t.Helper()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	api := NewBatchAPI(store.NewFileStore(database), store.NewBatchStore(database), config.BatchConfig{}, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openai/v1/files", api.FilesHandler)
+	mux.HandleFunc("/openai/v1/files/{id}", api.FileHandler)
+	mux.HandleFunc("/openai/v1/files/{id}/content", api.FileContentHandler)
+	mux.HandleFunc("/openai/v1/batches", api.BatchesHandler)
+	mux.HandleFunc("/openai/v1/batches/{id}", api.BatchHandler)
+	mux.HandleFunc("/openai/v1/batches/{id}/cancel", api.BatchCancelHandler)
+	return mux
+}
+
+// do sends a request with the bearer token of client and decodes a JSON response into v, if it is not nil.
+func do(t *testing.T, handler http.Handler, client string, req *http.Request, v interface{}) int {
+	t.Helper()
+	req.Header.Set("Authorization", "Bearer "+client+"-token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("invalid response %s: %v", rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+func uploadBatchFile(t *testing.T, handler http.Handler, client string) store.File {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "batch")
+	part, _ := form.CreateFormFile("file", "input.jsonl")
+	part.Write([]byte(`{"custom_id":"1","method":"POST","url":"/v1/chat/completions","body":{"model":"gemini-a","messages":[]}}` + "\n"))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/openai/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	var f store.File
+	if code := do(t, handler, client, req, &f); code != http.StatusOK {
+		t.Fatalf("upload status = %d", code)
+	}
+	return f
+}
+
+func createBatch(t *testing.T, handler http.Handler, client, fileID, window string) (store.Batch, int) {
+	t.Helper()
+	body := `{"input_file_id":"` + fileID + `","endpoint":"/v1/chat/completions","completion_window":"` + window + `"}`
+	var b store.Batch
+	code := do(t, handler, client, httptest.NewRequest(http.MethodPost, "/openai/v1/batches", strings.NewReader(body)), &b)
+	return b, code
+}
+
+func TestFilesAndBatchesBelongToTheirClient(t *testing.T) {
+	handler := newTestBatchAPI(t)
+	f := uploadBatchFile(t, handler, "alice")
+	b, code := createBatch(t, handler, "alice", f.ID, "24h")
+	if code != http.StatusOK {
+		t.Fatalf("create batch status = %d", code)
+	}
+
+	var files, batches struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	do(t, handler, "bob", httptest.NewRequest(http.MethodGet, "/openai/v1/files", nil), &files)
+	do(t, handler, "bob", httptest.NewRequest(http.MethodGet, "/openai/v1/batches", nil), &batches)
+	if len(files.Data) != 0 || len(batches.Data) != 0 {
+		t.Errorf("bob sees %d files and %d batches of alice", len(files.Data), len(batches.Data))
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/openai/v1/files/"+f.ID, nil),
+		httptest.NewRequest(http.MethodGet, "/openai/v1/files/"+f.ID+"/content", nil),
+		httptest.NewRequest(http.MethodDelete, "/openai/v1/files/"+f.ID, nil),
+		httptest.NewRequest(http.MethodGet, "/openai/v1/batches/"+b.ID, nil),
+		httptest.NewRequest(http.MethodPost, "/openai/v1/batches/"+b.ID+"/cancel", nil),
+	} {
+		if code := do(t, handler, "bob", req, nil); code != http.StatusNotFound {
+			t.Errorf("bob: %s %s status = %d, want 404", req.Method, req.URL.Path, code)
+		}
+	}
+	if _, code := createBatch(t, handler, "bob", f.ID, "24h"); code != http.StatusNotFound {
+		t.Errorf("bob created a batch from alice's file, status = %d, want 404", code)
+	}
+
+	// Nothing bob tried changed alice's file or batch
+	do(t, handler, "alice", httptest.NewRequest(http.MethodGet, "/openai/v1/files", nil), &files)
+	if len(files.Data) != 1 {
+		t.Errorf("alice has %d files, want 1", len(files.Data))
+	}
+	var got store.Batch
+	if code := do(t, handler, "alice", httptest.NewRequest(http.MethodGet, "/openai/v1/batches/"+b.ID, nil), &got); code != http.StatusOK || got.Status != store.BatchValidating {
+		t.Errorf("alice's batch: status %d, batch status %q, want it still validating", code, got.Status)
+	}
+	if code := do(t, handler, "alice", httptest.NewRequest(http.MethodPost, "/openai/v1/batches/"+b.ID+"/cancel", nil), &got); code != http.StatusOK || got.Status != store.BatchCancelling {
+		t.Errorf("alice cancelling her batch: status %d, batch status %q", code, got.Status)
+	}
+}
+
+func TestBatchCompletionWindow(t *testing.T) {
+	handler := newTestBatchAPI(t)
+	f := uploadBatchFile(t, handler, "alice")
+	for _, window := range []string{"1h", "48h", "24", ""} {
+		if _, code := createBatch(t, handler, "alice", f.ID, window); code != http.StatusBadRequest {
+			t.Errorf("completion_window %q: status = %d, want 400", window, code)
+		}
+	}
+}
+
+func TestClientHeaderCannotReachAnotherClientsFiles(t *testing.T) {
+	handler := newTestBatchAPI(t)
+	f := uploadBatchFile(t, handler, "alice")
+
+	alice := http.Header{"Authorization": {"Bearer alice-token"}}
+	// The short hash alice's token shows in logs and usage reports does not own her files either
+	if got, want := proxy.CredentialFingerprint(proxy.CredentialIdentity(alice)), proxy.ClientIdentity(alice); got != want {
+		t.Errorf("fingerprint = %q, want the client identity %q", got, want)
+	}
+	for _, spoofed := range []string{"alice", proxy.CredentialIdentity(alice), proxy.ClientIdentity(alice)} {
+		req := httptest.NewRequest(http.MethodGet, "/openai/v1/files/"+f.ID+"/content", nil)
+		req.Header.Set(proxy.ClientHeader, spoofed)
+		if code := do(t, handler, "bob", req, nil); code != http.StatusNotFound {
+			t.Errorf("bob claiming to be %q read alice's file, status = %d, want 404", spoofed, code)
+		}
+
+		var files struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		req = httptest.NewRequest(http.MethodGet, "/openai/v1/files", nil)
+		req.Header.Set(proxy.ClientHeader, spoofed)
+		do(t, handler, "bob", req, &files)
+		if len(files.Data) != 0 {
+			t.Errorf("bob claiming to be %q lists %d of alice's files", spoofed, len(files.Data))
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"vertigo/internal/gemini"
+	"vertigo/internal/proxy"
+)
+
+// Error types used in OpenAI-style error bodies.
+const (
+	ErrorTypeInvalidRequest = "invalid_request_error"
+	ErrorTypeAuthentication = "authentication_error"
+	ErrorTypeRateLimit      = "rate_limit_error"
+	ErrorTypeServer         = "server_error"
+)
+
+// defaultRetryAfter is suggested to clients after a rate limit when upstream gave no hint.
+// It matches how long a rate-limited key is quarantined.
+const defaultRetryAfter = time.Minute
+
+// ErrorResponse is the OpenAI error body: {"error": {"message", "type", "param", "code"}}.
+type ErrorResponse struct {
+	Error ErrorObject `json:"error"`
+}
+
+// ErrorObject describes a single error. Param and Code are null when they do not apply.
+type ErrorObject struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// writeError writes an OpenAI-style error response. An empty code is encoded as null.
+func writeError(w http.ResponseWriter, status int, errType, code, message string) {
+	obj := ErrorObject{Message: message, Type: errType}
+	if code != "" {
+		obj.Code = &code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: obj})
+}
+
+// writeStreamError reports a failure after a stream has started as a final SSE event carrying an
+// OpenAI-style error body.
+func writeStreamError(w http.ResponseWriter, message string) {
+	body, _ := json.Marshal(ErrorResponse{Error: ErrorObject{Message: message, Type: ErrorTypeServer}})
+	fmt.Fprintf(w, "data: %s\n\n", body)
+	w.(http.Flusher).Flush()
+}
+
+// writeProxyError maps a failure from the proxy manager to an OpenAI-style error response.
+// Upstream rejections of the request itself are passed through; anything that concerns the
+// proxy's keys or internals is reported with a generic message, since the full error is only logged.
+func writeProxyError(w http.ResponseWriter, err error) {
+	var noKeys *proxy.NoKeysError
+	if errors.As(err, &noKeys) {
+		setRetryAfter(w, noKeys.RetryAfter)
+		writeError(w, http.StatusServiceUnavailable, ErrorTypeServer, "no_keys_available",
+			"No upstream API keys are currently available for this model, please retry later")
+		return
+	}
+
+	var circuitErr *proxy.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		setRetryAfter(w, circuitErr.RetryAfter)
+		writeError(w, http.StatusServiceUnavailable, ErrorTypeServer, "circuit_open",
+			"The model is failing upstream and temporarily unavailable, please retry later")
+		return
+	}
+
+	var queueErr *proxy.QueueError
+	if errors.As(err, &queueErr) {
+		setRetryAfter(w, queueErr.RetryAfter)
+		if queueErr.Full {
+			writeError(w, http.StatusServiceUnavailable, ErrorTypeServer, "queue_full",
+				"Too many requests are waiting for this model, please retry later")
+			return
+		}
+		w.Header().Set(QueueWaitHeader, strconv.FormatFloat(queueErr.Waited.Seconds(), 'f', 3, 64))
+		writeError(w, http.StatusServiceUnavailable, ErrorTypeServer, "queue_timeout",
+			"Timed out waiting for an upstream slot for this model, please retry later")
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// The client is gone; the status is only seen by the access log
+		writeError(w, proxy.StatusClientClosedRequest, ErrorTypeServer, "", "Request canceled")
+		return
+	}
+	var timeoutErr *gemini.TimeoutError
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &timeoutErr) {
+		writeError(w, http.StatusGatewayTimeout, ErrorTypeServer, "timeout", "The request timed out")
+		return
+	}
+
+	if errors.Is(err, proxy.ErrUnknownModel) {
+		writeError(w, http.StatusNotFound, ErrorTypeInvalidRequest, "model_not_found", "The requested model is not served by any provider")
+		return
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) || errors.Is(err, proxy.ErrStreamInterrupted) {
+		writeError(w, http.StatusBadGateway, ErrorTypeServer, "", "Failed to connect to upstream")
+		return
+	}
+
+	var apiErr *gemini.APIError
+	if !errors.As(err, &apiErr) {
+		writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Internal server error")
+		return
+	}
+
+	switch status := apiErr.StatusCode; {
+	case status == http.StatusTooManyRequests:
+		retryAfter := apiErr.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+		setRetryAfter(w, retryAfter)
+		writeError(w, http.StatusTooManyRequests, ErrorTypeRateLimit, "rate_limit_exceeded",
+			"Rate limit reached for this model, please retry later")
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		// Upstream rejected the proxy's own credentials, which is not the client's fault
+		writeError(w, http.StatusBadGateway, ErrorTypeServer, "upstream_auth_failed", "Upstream authentication failed")
+	case status == http.StatusServiceUnavailable:
+		writeError(w, http.StatusServiceUnavailable, ErrorTypeServer, "", "The model is overloaded, please retry later")
+	case status >= 500:
+		writeError(w, http.StatusBadGateway, ErrorTypeServer, "", "Upstream server error")
+	default:
+		message := apiErr.Message()
+		if message == "" {
+			message = http.StatusText(status)
+		}
+		code := ""
+		if status == http.StatusNotFound {
+			code = "model_not_found"
+		}
+		writeError(w, status, ErrorTypeInvalidRequest, code, message)
+	}
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounding up.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// setQueueHeaders reports the request's wait for an upstream slot.
+func setQueueHeaders(w http.ResponseWriter, wait time.Duration, depth int) {
+	w.Header().Set(QueueWaitHeader, strconv.FormatFloat(wait.Seconds(), 'f', 3, 64))
+	w.Header().Set(QueueDepthHeader, strconv.Itoa(depth))
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"vertigo/internal/gemini"
+	"vertigo/internal/proxy"
+)
+
+func TestWriteProxyError(t *testing.T) {
+	wrap := func(err error) error { return fmt.Errorf("failed to get response from upstream: %w", err) }
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantType       string
+		wantCode       string
+		wantMessage    string // Checked when set
+		wantRetryAfter string
+	}{
+		{"no keys", wrap(&proxy.NoKeysError{Model: "m", RetryAfter: 1500 * time.Millisecond}), 503, ErrorTypeServer, "no_keys_available", "", "2"},
+		{"circuit open", wrap(&proxy.CircuitOpenError{Provider: "p", Model: "m", RetryAfter: 30 * time.Second}), 503, ErrorTypeServer, "circuit_open", "", "30"},
+		{"queue full", wrap(&proxy.QueueError{Model: "m", Full: true, RetryAfter: time.Second}), 503, ErrorTypeServer, "queue_full", "", "1"},
+		{"upstream bad request", wrap(&gemini.APIError{StatusCode: 400, Body: []byte(`{"error":{"message":"invalid temperature"}}`)}),
+			400, ErrorTypeInvalidRequest, "", "invalid temperature", ""},
+		{"upstream not found", wrap(&gemini.APIError{StatusCode: 404}), 404, ErrorTypeInvalidRequest, "model_not_found", "Not Found", ""},
+		{"upstream rate limit", wrap(&gemini.APIError{StatusCode: 429}), 429, ErrorTypeRateLimit, "rate_limit_exceeded", "", "60"},
+		{"upstream auth", wrap(&gemini.APIError{StatusCode: 401, Body: []byte(`{"error":{"message":"API key not valid"}}`)}),
+			502, ErrorTypeServer, "upstream_auth_failed", "Upstream authentication failed", ""},
+		{"upstream overloaded", wrap(&gemini.APIError{StatusCode: 503}), 503, ErrorTypeServer, "", "", ""},
+		{"upstream timeout", wrap(&gemini.TimeoutError{Phase: "first byte", Limit: time.Minute}), 504, ErrorTypeServer, "timeout", "", ""},
+		{"deadline", wrap(context.DeadlineExceeded), 504, ErrorTypeServer, "timeout", "", ""},
+		{"canceled", wrap(context.Canceled), proxy.StatusClientClosedRequest, ErrorTypeServer, "", "", ""},
+		{"connection failed", wrap(&url.Error{Op: "Post", URL: "https://upstream", Err: errors.New("refused")}), 502, ErrorTypeServer, "", "Failed to connect to upstream", ""},
+		{"unknown model", fmt.Errorf("no provider: %w", proxy.ErrUnknownModel), 404, ErrorTypeInvalidRequest, "model_not_found", "", ""},
+		{"internal", fmt.Errorf("key sk-secret rejected"), 500, ErrorTypeServer, "", "Internal server error", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeProxyError(rec, tt.err)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", rec.Body.String(), err)
+			}
+			code := ""
+			if body.Error.Code != nil {
+				code = *body.Error.Code
+			}
+			if body.Error.Type != tt.wantType || code != tt.wantCode {
+				t.Errorf("error type %q, code %q; want %q, %q", body.Error.Type, code, tt.wantType, tt.wantCode)
+			}
+			if tt.wantMessage != "" && body.Error.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", body.Error.Message, tt.wantMessage)
+			}
+		})
+	}
+
+	// A timed out wait for a slot reports how long the request waited
+	rec := httptest.NewRecorder()
+	writeProxyError(rec, &proxy.QueueError{Model: "m", Waited: 2500 * time.Millisecond})
+	if code := rec.Code; code != http.StatusServiceUnavailable || rec.Header().Get(QueueWaitHeader) != "2.500" {
+		t.Errorf("queue timeout: status %d, %s %q", code, QueueWaitHeader, rec.Header().Get(QueueWaitHeader))
+	}
+}
@@ -3,14 +3,33 @@ package api
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 
+	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
+	"vertigo/internal/middleware"
 	"vertigo/internal/proxy"
+	"vertigo/internal/tracing"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Response headers set by the chat completions handler.
+const (
+	// ModelHeader reports the upstream model that served the request.
+	ModelHeader = metrics.ModelHeader
+	// CacheHeader reports whether the response came from the response cache (hit or miss).
+	CacheHeader = "X-Vertigo-Cache"
+	// QueueWaitHeader reports how long the request waited for an upstream slot, in seconds.
+	QueueWaitHeader = "X-Vertigo-Queue-Wait"
+	// QueueDepthHeader reports how many requests were already waiting for the model when it arrived.
+	QueueDepthHeader = "X-Vertigo-Queue-Depth"
 )
 
 // OpenAIAPI represents the OpenAI-compatible API handlers.
@@ -33,7 +52,7 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		api.Log.Errorf("Failed to read request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Failed to read request body")
 		return
 	}
 	r.Body.Close()
@@ -41,7 +60,7 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 	var reqBodyMap map[string]interface{}
 	if err := json.Unmarshal(body, &reqBodyMap); err != nil {
 		api.Log.Errorf("Failed to unmarshal request body: %v", err)
-		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "invalid_json", "Failed to parse request body as JSON")
 		return
 	}
 
@@ -53,32 +72,78 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 	// Extract conversation ID from headers or generate a new one
 	conversationID := r.Header.Get("X-Conversation-ID")
 	if conversationID == "" {
-		// In a real application, you might want to generate a unique ID and return it to the client.
-		// For now, we'll use a placeholder.
-		conversationID = "default-conversation"
+		// Requests without a conversation ID share a placeholder whose history is never saved
+		conversationID = proxy.DefaultConversationID
 	}
 
 	// Process the request using the proxy manager
-	geminiResponseReader, err := api.ProxyManager.ProcessRequest(body, conversationID, stream)
+	info := middleware.RequestInfoFromContext(r.Context())
+	info.Update(func(ri *middleware.RequestInfo) { ri.ConversationID = conversationID })
+
+	proxyResponse, err := api.ProxyManager.ProcessRequest(r.Context(), body, r.Header, conversationID, stream)
 	if err != nil {
 		api.Log.Errorf("Failed to process request: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProxyError(w, err)
 		return
 	}
+	geminiResponseReader := proxyResponse.Body
+	info.Update(func(ri *middleware.RequestInfo) {
+		ri.Model = proxyResponse.Model
+		ri.KeyIndex = proxyResponse.KeyIndex
+		ri.CacheStatus = proxyResponse.CacheStatus
+		ri.UpstreamLatency = proxyResponse.UpstreamLatency
+	})
+	// Closing the body records usage, so it must happen for streaming and non-streaming responses alike
+	defer func() {
+		geminiResponseReader.Close()
+		info.Update(func(ri *middleware.RequestInfo) {
+			ri.PromptTokens = proxyResponse.Usage.PromptTokens
+			ri.CompletionTokens = proxyResponse.Usage.CompletionTokens
+			ri.CachedTokens = proxyResponse.Usage.CachedTokens
+		})
+	}()
+
+	// Report the model that actually answered, which may be a fallback
+	w.Header().Set(ModelHeader, proxyResponse.Model)
+	if proxyResponse.CacheStatus != "" {
+		w.Header().Set(CacheHeader, proxyResponse.CacheStatus)
+	}
+	if proxyResponse.Queue != nil {
+		setQueueHeaders(w, proxyResponse.Queue.Wait, proxyResponse.Queue.Depth)
+	}
 
 	if stream {
-		defer geminiResponseReader.Close() // Ensure the reader is closed after streaming
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 		w.WriteHeader(http.StatusOK)
 
-		scanner := bufio.NewScanner(geminiResponseReader)
-		for scanner.Scan() {
-			line := scanner.Text()
+		_, span := tracing.Tracer().Start(r.Context(), "api.stream", trace.WithAttributes(tracing.AttrModel.String(proxyResponse.Model)))
+		chunks := 0
+		defer func() {
+			span.SetAttributes(attribute.Int("vertigo.stream.chunks", chunks))
+			span.End()
+		}()
+
+		var thoughts thoughtSplitter
+		// A bufio.Reader has no line length limit, unlike bufio.Scanner, so large chunks such as
+		// tool arguments cannot break the stream
+		reader := bufio.NewReader(geminiResponseReader)
+		done := false
+		var streamErr error
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err != io.EOF || line == "" {
+					streamErr = err
+					break
+				}
+			}
+			line = strings.TrimRight(line, "\r\n")
 			if strings.HasPrefix(line, "data: ") {
 				jsonStr := strings.TrimPrefix(line, "data: ")
 				if jsonStr == "[DONE]" {
+					done = true
 					break
 				}
 
@@ -92,9 +157,17 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 
 				// Extract content and finish_reason safely
 				content := ""
+				reasoningContent := ""
 				finishReason := interface{}(nil) // Use interface{} for nil or string
 
-				if choices, ok := geminiChunk["choices"].([]interface{}); ok && len(choices) > 0 {
+				choices, _ := geminiChunk["choices"].([]interface{})
+				usage, hasUsage := geminiChunk["usage"].(map[string]interface{})
+				if len(choices) == 0 && !(hasUsage && proxyResponse.IncludeUsage) {
+					// Usage-only chunks are requested upstream for accounting; forward them only if the client asked
+					continue
+				}
+
+				if len(choices) > 0 {
 					api.Log.Debugf("Choices found: %+v", choices)
 					if firstChoice, ok := choices[0].(map[string]interface{}); ok {
 						api.Log.Debugf("First Choice: %+v", firstChoice)
@@ -104,6 +177,9 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 								content = c
 								api.Log.Debugf("Content extracted: %s", content)
 							}
+							if rc, ok := delta["reasoning_content"].(string); ok {
+								reasoningContent = rc
+							}
 						}
 						if fr, ok := firstChoice["finish_reason"]; ok {
 							finishReason = fr
@@ -112,24 +188,48 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 					}
 				}
 
+				// Move thought summaries out of the content into reasoning_content
+				if proxyResponse.IncludeThoughts {
+					reasoning, answer := thoughts.Split(content)
+					if finishReason != nil {
+						restReasoning, restAnswer := thoughts.Flush()
+						reasoning, answer = reasoning+restReasoning, answer+restAnswer
+					}
+					reasoningContent += reasoning
+					content = answer
+				}
+
+				delta := map[string]string{
+					"content": content,
+				}
+				if reasoningContent != "" {
+					delta["reasoning_content"] = reasoningContent
+				}
+
 				// Transform Gemini chunk to OpenAI SSE format
 				openAIChunk := map[string]interface{}{
 					"id":      "chatcmpl-test", // Placeholder ID
 					"object":  "chat.completion.chunk",
 					"created": 1678886400,
-					"model":   reqBodyMap["model"],
+					"model":   proxyResponse.Model,
 					"choices": []map[string]interface{}{
 						{
-							"index": 0,
-							"delta": map[string]string{
-								"content": content,
-							},
+							"index":         0,
+							"delta":         delta,
 							"finish_reason": finishReason,
 						},
 					},
 				}
 
-				jsonBytes, err := json.Marshal(openAIChunk);
+				if len(choices) == 0 {
+					openAIChunk["choices"] = []map[string]interface{}{}
+				}
+				if hasUsage && proxyResponse.IncludeUsage {
+					annotateCachedTokens(usage, proxyResponse.CachedTokens)
+					openAIChunk["usage"] = usage
+				}
+
+				jsonBytes, err := json.Marshal(openAIChunk)
 				if err != nil {
 					api.Log.Errorf("Failed to marshal OpenAI chunk: %v", err)
 					continue
@@ -137,11 +237,25 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 
 				fmt.Fprintf(w, "data: %s\n\n", jsonBytes)
 				w.(http.Flusher).Flush()
+				chunks++
 			}
 		}
 
-		if err := scanner.Err(); err != nil {
-			api.Log.Errorf("Error reading Gemini stream: %v", err)
+		if !done {
+			// Headers and tokens have already been sent, so the failure can only be reported in-band.
+			// Omitting [DONE] lets clients tell the truncated stream apart from a complete one.
+			if streamErr == nil || streamErr == io.EOF {
+				streamErr = io.ErrUnexpectedEOF
+			}
+			span.RecordError(streamErr)
+			api.Log.Errorf("Error reading Gemini stream: %v", streamErr)
+			message := "The upstream stream was interrupted"
+			var timeoutErr *gemini.TimeoutError
+			if errors.As(streamErr, &timeoutErr) {
+				message = "The upstream stream timed out"
+			}
+			writeStreamError(w, message)
+			return
 		}
 		fmt.Fprintf(w, "data: [DONE]\n\n")
 		w.(http.Flusher).Flush()
@@ -151,39 +265,43 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 		geminiResponse, err := io.ReadAll(geminiResponseReader)
 		if err != nil {
 			api.Log.Errorf("Failed to read Gemini response: %v", err)
-			http.Error(w, "Failed to read Gemini response", http.StatusInternalServerError)
+			writeError(w, http.StatusBadGateway, ErrorTypeServer, "", "Failed to read upstream response")
 			return
 		}
 
-		// Set headers before writing any body content
-		w.Header().Del("Content-Type") // Ensure no conflicting Content-Type header exists
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
 		if len(geminiResponse) == 0 {
 			api.Log.Warnf("Received empty Gemini response for non-streaming request.")
-			json.NewEncoder(w).Encode(map[string]string{"error": "empty response from Gemini API"})
+			writeError(w, http.StatusBadGateway, ErrorTypeServer, "", "Empty response from upstream")
 			return
 		}
 
 		api.Log.Debugf("Raw Gemini Response (non-streaming): %s", geminiResponse) // Log raw response
 
 		// Unmarshal and re-marshal to ensure valid JSON output
-		var jsonResponse interface{}
+		var jsonResponse map[string]interface{}
 		if err := json.Unmarshal(geminiResponse, &jsonResponse); err != nil {
 			api.Log.Errorf("Failed to unmarshal Gemini response: %v", err)
-			http.Error(w, "Failed to process Gemini response", http.StatusInternalServerError)
+			writeError(w, http.StatusBadGateway, ErrorTypeServer, "", "Failed to process upstream response")
 			return
 		}
+		jsonResponse["model"] = proxyResponse.Model
+		if proxyResponse.IncludeThoughts {
+			extractReasoningContent(jsonResponse)
+		}
+		if usage, ok := jsonResponse["usage"].(map[string]interface{}); ok {
+			annotateCachedTokens(usage, proxyResponse.CachedTokens)
+		}
 
 		finalResponse, err := json.Marshal(jsonResponse)
 		if err != nil {
 			api.Log.Errorf("Failed to marshal final response: %v", err)
-			http.Error(w, "Failed to process Gemini response", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Internal server error")
 			return
 		}
 
 		api.Log.Debugf("Final Response (non-streaming): %s", finalResponse) // Log the final response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write(finalResponse)
 	}
 }
@@ -192,12 +310,24 @@ func (api *OpenAIAPI) ChatCompletionsHandler(w http.ResponseWriter, r *http.Requ
 func (api *OpenAIAPI) ModelsHandler(w http.ResponseWriter, r *http.Request) {
 	// This is a simplified implementation. In a real scenario, you might dynamically
 	// fetch available models from Gemini API or maintain a more sophisticated list.
-	models := []map[string]interface{}{
-		{"id": "vertigo-1.0-blast", "object": "model", "created": 1678886400, "owned_by": "vertigo"},
+	models := []map[string]interface{}{}
+	for _, name := range api.ProxyManager.VirtualModelNames() {
+		models = append(models, map[string]interface{}{"id": name, "object": "model", "created": 1678886400, "owned_by": "vertigo"})
+	}
+	models = append(models, []map[string]interface{}{
 		{"id": "gemini-2.0-flash", "object": "model", "created": 1678886400, "owned_by": "google"},
 		{"id": "gemini-2.5-flash-lite", "object": "model", "created": 1678886400, "owned_by": "google"},
 		{"id": "gemini-2.5-flash", "object": "model", "created": 1678886400, "owned_by": "google"},
 		{"id": "gemini-2.5-pro", "object": "model", "created": 1678886400, "owned_by": "google"},
+	}...)
+	listed := make(map[string]bool)
+	for _, m := range models {
+		listed[m["id"].(string)] = true
+	}
+	for _, m := range api.ProxyManager.ProviderModels() {
+		if !listed[m.ID] {
+			models = append(models, map[string]interface{}{"id": m.ID, "object": "model", "created": 1678886400, "owned_by": m.Provider})
+		}
 	}
 
 	resp := map[string]interface{}{
@@ -208,3 +338,45 @@ func (api *OpenAIAPI) ModelsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// extractReasoningContent moves thought summaries out of each choice's message content into reasoning_content.
+func extractReasoningContent(response map[string]interface{}) {
+	choices, _ := response["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		message, ok := choice["message"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		content, ok := message["content"].(string)
+		if !ok {
+			continue
+		}
+		reasoning, answer := splitThoughts(content)
+		if reasoning == "" {
+			continue
+		}
+		message["content"] = answer
+		message["reasoning_content"] = reasoning
+	}
+}
+
+// annotateCachedTokens reports prompt tokens served from a Gemini context cache in
+// usage.prompt_tokens_details.cached_tokens, unless upstream already reported them.
+func annotateCachedTokens(usage map[string]interface{}, cachedTokens int) {
+	if cachedTokens == 0 {
+		return
+	}
+	details, ok := usage["prompt_tokens_details"].(map[string]interface{})
+	if !ok {
+		details = make(map[string]interface{})
+		usage["prompt_tokens_details"] = details
+	}
+	if existing, ok := details["cached_tokens"].(float64); ok && existing > 0 {
+		return
+	}
+	details["cached_tokens"] = cachedTokens
+}
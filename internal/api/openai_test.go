@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vertigo/internal/config"
+	"vertigo/internal/db"
+	"vertigo/internal/proxy"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestChatCompletionsStreamFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstream   string // The stream upstream sends before it ends
+		wantStatus int
+		wantBody   string
+	}{
+		{"before the first event", ": keepalive\n\n", http.StatusBadGateway, `"Failed to connect to upstream"`},
+		{"after the first event", `data: {"choices":[{"delta":{"content":"Hel"}}]}` + "\n\n", http.StatusOK,
+			`data: {"error":{"message":"The upstream stream was interrupted"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, tt.upstream)
+			}))
+			defer server.Close()
+			database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			pm, err := proxy.NewManager(&config.Config{Providers: []config.ProviderConfig{
+				{Name: "test", Type: "openai", BaseURL: server.URL, APIKeys: []string{"k1"}},
+			}}, store.NewConversationStore(database), logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/openai/v1/chat/completions",
+				strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+			NewOpenAIAPI(pm, logger).ChatCompletionsHandler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.wantBody)
+			}
+			if strings.Contains(body, "[DONE]") {
+				t.Errorf("body = %q, want no [DONE] after a failure", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"strings"
+)
+
+// Gemini's OpenAI-compatible endpoint wraps thought summaries in these tags inside the message content.
+const (
+	thoughtOpenTag  = "<thought>"
+	thoughtCloseTag = "</thought>"
+)
+
+// thoughtSplitter separates thought summaries from answer text across stream chunks.
+// Tags split over chunk boundaries are held back until the next chunk completes them.
+type thoughtSplitter struct {
+	inThought bool
+	pending   string
+}
+
+// Split consumes the next piece of content and returns the reasoning and answer text it contains.
+func (ts *thoughtSplitter) Split(chunk string) (string, string) {
+	var reasoning, answer strings.Builder
+	data := ts.pending + chunk
+	ts.pending = ""
+
+	for data != "" {
+		tag := thoughtOpenTag
+		out := &answer
+		if ts.inThought {
+			tag = thoughtCloseTag
+			out = &reasoning
+		}
+
+		if idx := strings.Index(data, tag); idx >= 0 {
+			out.WriteString(data[:idx])
+			data = data[idx+len(tag):]
+			ts.inThought = !ts.inThought
+			continue
+		}
+
+		// Hold back a trailing partial tag so it can be matched once the rest arrives.
+		keep := partialSuffix(data, tag)
+		out.WriteString(data[:len(data)-keep])
+		ts.pending = data[len(data)-keep:]
+		break
+	}
+
+	return reasoning.String(), answer.String()
+}
+
+// Flush returns any text held back by Split, attributed to the current section.
+func (ts *thoughtSplitter) Flush() (string, string) {
+	rest := ts.pending
+	ts.pending = ""
+	if ts.inThought {
+		return rest, ""
+	}
+	return "", rest
+}
+
+// splitThoughts separates thought summaries from the answer in a complete message.
+func splitThoughts(content string) (string, string) {
+	var ts thoughtSplitter
+	reasoning, answer := ts.Split(content)
+	restReasoning, restAnswer := ts.Flush()
+	return reasoning + restReasoning, answer + restAnswer
+}
+
+// partialSuffix returns the length of the longest suffix of s that is a proper prefix of tag.
+func partialSuffix(s, tag string) int {
+	for n := len(tag) - 1; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
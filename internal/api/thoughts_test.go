@@ -0,0 +1,129 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestThoughtSplitter(t *testing.T) {
+	tests := []struct {
+		name          string
+		chunks        []string
+		wantReasoning string
+		wantAnswer    string
+	}{
+		{
+			name:       "no thoughts",
+			chunks:     []string{"Hello", " world"},
+			wantAnswer: "Hello world",
+		},
+		{
+			name:          "thought in one chunk",
+			chunks:        []string{"<thought>Let me think</thought>The answer"},
+			wantReasoning: "Let me think",
+			wantAnswer:    "The answer",
+		},
+		{
+			name:          "thought across chunks",
+			chunks:        []string{"<thought>Let me", " think</thought>", "The answer"},
+			wantReasoning: "Let me think",
+			wantAnswer:    "The answer",
+		},
+		{
+			name:          "open tag split across chunks",
+			chunks:        []string{"<tho", "ught>reasoning</thought>answer"},
+			wantReasoning: "reasoning",
+			wantAnswer:    "answer",
+		},
+		{
+			name:          "close tag split across chunks",
+			chunks:        []string{"<thought>reasoning</th", "ought>answer"},
+			wantReasoning: "reasoning",
+			wantAnswer:    "answer",
+		},
+		{
+			name:          "tag split one byte at a time",
+			chunks:        []string{"<", "t", "h", "o", "u", "g", "h", "t", ">", "r", "<", "/", "thought", ">", "a"},
+			wantReasoning: "r",
+			wantAnswer:    "a",
+		},
+		{
+			name:       "partial tag that never completes",
+			chunks:     []string{"a <tho", "se are fine"},
+			wantAnswer: "a <those are fine",
+		},
+		{
+			name:       "trailing partial tag is flushed",
+			chunks:     []string{"x < y and <th"},
+			wantAnswer: "x < y and <th",
+		},
+		{
+			name:          "unterminated thought is flushed as reasoning",
+			chunks:        []string{"<thought>still thinking</tho"},
+			wantReasoning: "still thinking</tho",
+		},
+		{
+			name:          "several thoughts",
+			chunks:        []string{"<thought>a</thought>b<thought>c</thought>d"},
+			wantReasoning: "ac",
+			wantAnswer:    "bd",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ts thoughtSplitter
+			var reasoning, answer string
+			for _, chunk := range tt.chunks {
+				r, a := ts.Split(chunk)
+				reasoning += r
+				answer += a
+			}
+			r, a := ts.Flush()
+			reasoning += r
+			answer += a
+
+			if reasoning != tt.wantReasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning, tt.wantReasoning)
+			}
+			if answer != tt.wantAnswer {
+				t.Errorf("answer = %q, want %q", answer, tt.wantAnswer)
+			}
+		})
+	}
+}
+
+func TestThoughtSplitterHoldsBackPartialTags(t *testing.T) {
+	var ts thoughtSplitter
+	if _, answer := ts.Split("Hi <thou"); answer != "Hi " {
+		t.Errorf("answer = %q, want the text before the partial tag", answer)
+	}
+	reasoning, answer := ts.Split("ght>x")
+	if reasoning != "x" || answer != "" {
+		t.Errorf("Split() = %q, %q, want %q, %q", reasoning, answer, "x", "")
+	}
+}
+
+func TestSplitThoughts(t *testing.T) {
+	reasoning, answer := splitThoughts("<thought>why</thought>because")
+	if reasoning != "why" || answer != "because" {
+		t.Errorf("splitThoughts() = %q, %q", reasoning, answer)
+	}
+}
+
+func TestPartialSuffix(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"abc", 0},
+		{"abc<", 1},
+		{"abc<thought", 8},
+		{"<thought>", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := partialSuffix(tt.s, thoughtOpenTag); got != tt.want {
+			t.Errorf("partialSuffix(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UsageAPI represents the usage reporting and price table handlers. They are served as part of the
+// admin API, behind AdminAPI.Authenticate.
+type UsageAPI struct {
+	UsageStore *store.UsageStore
+	Log        *logrus.Logger
+}
+
+// NewUsageAPI creates a new UsageAPI instance.
+func NewUsageAPI(usageStore *store.UsageStore, logger *logrus.Logger) *UsageAPI {
+	return &UsageAPI{
+		UsageStore: usageStore,
+		Log:        logger,
+	}
+}
+
+// UsageHandler handles requests to the /vertigo/v1/usage endpoint.
+// It accepts group_by (a comma-separated list of day, model, client and hedge) and days (the report window, default 30).
+func (api *UsageAPI) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+		return
+	}
+
+	groupBy := []string{"day", "model", "client"}
+	if g := r.URL.Query().Get("group_by"); g != "" {
+		groupBy = strings.Split(g, ",")
+	}
+	days := 30
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid days parameter")
+			return
+		}
+		days = n
+	}
+
+	summaries, err := api.UsageStore.Summary(groupBy, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		api.Log.Errorf("Failed to query usage: %v", err)
+		writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", err.Error())
+		return
+	}
+	if summaries == nil {
+		summaries = []store.UsageSummary{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   summaries,
+	})
+}
+
+// PricesHandler handles requests to the /vertigo/v1/prices endpoint.
+// GET lists the price table, PUT creates or replaces a model's price and DELETE removes it (?model=...).
+func (api *UsageAPI) PricesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		prices, err := api.UsageStore.Prices()
+		if err != nil {
+			api.Log.Errorf("Failed to query prices: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to query prices")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   prices,
+		})
+
+	case http.MethodPut:
+		var price store.ModelPrice
+		if err := json.NewDecoder(r.Body).Decode(&price); err != nil || price.Model == "" {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Invalid price")
+			return
+		}
+		if err := api.UsageStore.SetPrice(price); err != nil {
+			api.Log.Errorf("Failed to set price: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to set price")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(price)
+
+	case http.MethodDelete:
+		model := r.URL.Query().Get("model")
+		if model == "" {
+			writeError(w, http.StatusBadRequest, ErrorTypeInvalidRequest, "", "Missing model parameter")
+			return
+		}
+		if err := api.UsageStore.DeletePrice(model); err != nil {
+			api.Log.Errorf("Failed to delete price: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrorTypeServer, "", "Failed to delete price")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest, "", "Method not allowed")
+	}
+}
@@ -0,0 +1,253 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/metrics"
+	"vertigo/internal/middleware"
+	"vertigo/internal/proxy"
+	"vertigo/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Endpoint is the only endpoint batch requests can target.
+const Endpoint = "/v1/chat/completions"
+
+// handlerPath is the path of the handler batch requests are sent to.
+const handlerPath = "/openai" + Endpoint
+
+const (
+	// rateLimitBackoff is how long a request waits before it is sent again after a rate limit or an
+	// unavailable model that did not say when to retry.
+	rateLimitBackoff = 10 * time.Second
+	// maxServerErrorAttempts is how often a request is sent when upstream keeps failing.
+	maxServerErrorAttempts = 3
+)
+
+// request is a line of a batch input file.
+type request struct {
+	line     int
+	CustomID string                 `json:"custom_id"`
+	Method   string                 `json:"method"`
+	URL      string                 `json:"url"`
+	Body     map[string]interface{} `json:"body"`
+}
+
+// outputLine is a line of a batch output or error file.
+type outputLine struct {
+	ID       string          `json:"id"`
+	CustomID string          `json:"custom_id"`
+	Response *outputResponse `json:"response"`
+	Error    *outputError    `json:"error"`
+}
+
+type outputResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type outputError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// parseInput reads the requests of a batch input file, checking that every line is a POST to endpoint
+// with a unique custom_id and a body naming a model. Lines are numbered from 1; blank lines are skipped.
+func parseInput(content []byte, endpoint string) ([]request, []store.BatchError) {
+	var requests []request
+	var errs []store.BatchError
+	customIDs := make(map[string]bool)
+	for i, raw := range bytes.Split(content, []byte("\n")) {
+		line := i + 1
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		invalid := func(code, format string, args ...interface{}) {
+			errs = append(errs, store.BatchError{Code: code, Message: fmt.Sprintf(format, args...), Line: line})
+		}
+
+		var req request
+		if err := json.Unmarshal(raw, &req); err != nil {
+			invalid("invalid_json_line", "This line is not valid JSON: %v", err)
+			continue
+		}
+		req.line = line
+		switch {
+		case req.CustomID == "":
+			invalid("missing_required_parameter", "The custom_id is missing")
+		case customIDs[req.CustomID]:
+			invalid("duplicate_custom_id", "The custom_id %q is used by an earlier line", req.CustomID)
+		case req.Method != http.MethodPost:
+			invalid("invalid_method", "The method must be POST")
+		case req.URL != endpoint:
+			invalid("invalid_url", "The url must be %s, the endpoint of the batch", endpoint)
+		case req.Body == nil:
+			invalid("missing_required_parameter", "The body is missing")
+		default:
+			if model, _ := req.Body["model"].(string); model == "" {
+				invalid("missing_required_parameter", "The body names no model")
+				continue
+			}
+			customIDs[req.CustomID] = true
+			requests = append(requests, req)
+		}
+	}
+	if len(requests) == 0 && len(errs) == 0 {
+		errs = append(errs, store.BatchError{Code: "empty_file", Message: "The input file contains no requests"})
+	}
+	return requests, errs
+}
+
+// send makes the request of a batch line at batch priority, on behalf of the client that created the
+// batch, and returns its output line. Requests that are rate-limited or find the model unavailable are
+// sent again after a pause for as long as the batch has time left, and server errors a few times. An
+// error is only returned when ctx is done.
+func (r *Runner) send(ctx context.Context, b store.Batch, req request) (store.BatchResult, error) {
+	body := make(map[string]interface{}, len(req.Body))
+	for k, v := range req.Body {
+		body[k] = v
+	}
+	body["stream"] = false
+	delete(body, "stream_options")
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return store.BatchResult{}, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, handlerPath, bytes.NewReader(encoded))
+		if err != nil {
+			return store.BatchResult{}, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set(proxy.PriorityHeader, config.PriorityBatch)
+		if b.Client != "" {
+			httpReq.Header.Set(proxy.ClientHeader, proxy.CredentialFingerprint(b.Client))
+		}
+		rec := &recorder{header: make(http.Header)}
+		r.serve(b, rec, httpReq)
+		if ctx.Err() != nil {
+			return store.BatchResult{}, ctx.Err()
+		}
+
+		status := rec.statusCode()
+		retry := status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable ||
+			(status >= 500 && attempt < maxServerErrorAttempts)
+		if retry {
+			wait := rateLimitBackoff
+			if seconds, err := strconv.Atoi(rec.header.Get("Retry-After")); err == nil && seconds > 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+			if time.Now().Add(wait).Unix() < b.ExpiresAt {
+				metrics.BatchRequests.WithLabelValues("retried").Inc()
+				select {
+				case <-ctx.Done():
+					return store.BatchResult{}, ctx.Err()
+				case <-time.After(wait):
+				}
+				continue
+			}
+		}
+
+		out := outputLine{
+			ID:       newRequestID(),
+			CustomID: req.CustomID,
+			Response: &outputResponse{
+				StatusCode: status,
+				RequestID:  rec.header.Get(middleware.RequestIDHeader),
+				Body:       json.RawMessage(bytes.TrimSpace(rec.body.Bytes())),
+			},
+		}
+		if !json.Valid(out.Response.Body) {
+			out.Response.Body, _ = json.Marshal(rec.body.String())
+		}
+		line, err := json.Marshal(out)
+		if err != nil {
+			return store.BatchResult{}, err
+		}
+		failed := status >= http.StatusBadRequest
+		result := "completed"
+		if failed {
+			result = "failed"
+		}
+		metrics.BatchRequests.WithLabelValues(result).Inc()
+		return store.BatchResult{Line: req.line, Failed: failed, Output: line}, nil
+	}
+}
+
+// serve hands a request to the handler. A panic that gets past the handler's own recovery, such as the
+// abort of a response that had already started, becomes a server error of the request: no HTTP server
+// recovers it here, so it would otherwise end the process.
+func (r *Runner) serve(b store.Batch, rec *recorder, httpReq *http.Request) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		if p != http.ErrAbortHandler {
+			r.Log.WithFields(logrus.Fields{"batch_id": b.ID, "panic": p, "stack": string(debug.Stack())}).Error("Recovered from panic in batch request")
+		}
+		rec.status = http.StatusInternalServerError
+		rec.body.Reset()
+		rec.body.WriteString(`{"error":{"message":"Internal server error","type":"server_error","param":null,"code":null}}`)
+	}()
+	r.Handler.ServeHTTP(rec, httpReq)
+}
+
+// errorLine returns the error file line of a request that was never sent.
+func errorLine(req request, code, message string) []byte {
+	line, _ := json.Marshal(outputLine{
+		ID:       newRequestID(),
+		CustomID: req.CustomID,
+		Error:    &outputError{Code: code, Message: message},
+	})
+	return line
+}
+
+func newRequestID() string {
+	return "batch_req_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// recorder captures the response of the chat completions handler.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+// Flush does nothing; it lets the handler treat the recorder like a streaming connection.
+func (rec *recorder) Flush() {}
+
+func (rec *recorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,298 @@
+// Package batch drains the batches of the Batches API in the background.
+package batch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for the batch runner.
+const (
+	defaultConcurrency  = 4
+	defaultPollInterval = 5 * time.Second
+)
+
+// Runner drains batches by sending their requests through Handler, the chat completions handler, so
+// they get the same routing, failover and accounting as interactive traffic. Every request's result is
+// saved as soon as it is known, so a batch interrupted by a restart resumes where it stopped.
+type Runner struct {
+	Files   *store.FileStore
+	Batches *store.BatchStore
+	// Handler serves the chat completions of a batch, normally the /openai/v1/chat/completions handler.
+	Handler http.Handler
+	Config  config.BatchConfig
+	Log     *logrus.Logger
+
+	mutex   sync.Mutex
+	running map[string]bool
+	// slots bounds the requests in flight across all batches.
+	slots chan struct{}
+}
+
+// NewRunner creates a new Runner.
+func NewRunner(cfg config.BatchConfig, files *store.FileStore, batches *store.BatchStore, handler http.Handler, logger *logrus.Logger) *Runner {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	return &Runner{
+		Files:   files,
+		Batches: batches,
+		Handler: handler,
+		Config:  cfg,
+		Log:     logger,
+		running: make(map[string]bool),
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+// Run drains batches until ctx is done. Every poll interval it picks up the batches that have not ended,
+// including those a previous run left unfinished.
+func (r *Runner) Run(ctx context.Context) {
+	interval := r.Config.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		batches, err := r.Batches.PendingBatches()
+		if err != nil {
+			r.Log.Errorf("Failed to load pending batches: %v", err)
+		}
+		for _, b := range batches {
+			r.start(ctx, b)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// start processes a batch in the background unless it is already being processed.
+func (r *Runner) start(ctx context.Context, b store.Batch) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.running[b.ID] {
+		return
+	}
+	r.running[b.ID] = true
+
+	go func() {
+		defer func() {
+			r.mutex.Lock()
+			delete(r.running, b.ID)
+			r.mutex.Unlock()
+		}()
+		if err := r.process(ctx, b); err != nil {
+			r.Log.WithField("batch_id", b.ID).Errorf("Failed to process batch: %v", err)
+		}
+	}()
+}
+
+// process takes a batch from wherever it stands to its end: validating its input, sending the requests
+// that have no result yet, and writing its output and error files.
+func (r *Runner) process(ctx context.Context, b store.Batch) error {
+	log := r.Log.WithField("batch_id", b.ID)
+
+	content, err := r.Files.Content(b.InputFileID, b.Client)
+	if errors.Is(err, store.ErrFileNotFound) {
+		errs := []store.BatchError{{Code: "invalid_file", Message: "The input file no longer exists"}}
+		return r.fail(b, errs)
+	}
+	if err != nil {
+		return err
+	}
+	requests, errs := parseInput(content, b.Endpoint)
+	if b.Status == store.BatchValidating {
+		if len(errs) > 0 {
+			log.WithField("errors", len(errs)).Info("Batch failed validation")
+			return r.fail(b, errs)
+		}
+		started, err := r.Batches.StartBatch(b.ID, len(requests))
+		if err != nil {
+			return err
+		}
+		if started {
+			log.WithField("requests", len(requests)).Info("Started batch")
+			b.Status = store.BatchInProgress
+		}
+	}
+
+	if b.Status == store.BatchInProgress {
+		results, err := r.Batches.Results(b.ID)
+		if err != nil {
+			return err
+		}
+		if err := r.sendRequests(ctx, b, requests, results); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	status, err := r.Batches.Status(b.ID)
+	if err != nil {
+		return err
+	}
+	final := store.BatchCompleted
+	switch {
+	case status == store.BatchCancelling || status == store.BatchValidating:
+		final = store.BatchCancelled
+	case status == store.BatchInProgress && time.Now().Unix() >= b.ExpiresAt:
+		final = store.BatchExpired
+	case status == store.BatchInProgress:
+		if _, err := r.Batches.FinalizeBatch(b.ID); err != nil {
+			return err
+		}
+	}
+	return r.finish(b, final, requests)
+}
+
+// sendRequests sends the requests of a batch that have no result yet, until they are all done, the batch
+// is cancelled or expires, or ctx is done.
+func (r *Runner) sendRequests(ctx context.Context, b store.Batch, requests []request, results []store.BatchResult) error {
+	counts := store.BatchRequestCounts{Total: len(requests)}
+	var countsMutex sync.Mutex
+	done := make(map[int]bool, len(results))
+	for _, res := range results {
+		done[res.Line] = true
+		if res.Failed {
+			counts.Failed++
+		} else {
+			counts.Completed++
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var err error
+	for _, req := range requests {
+		if done[req.line] {
+			continue
+		}
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		// The batch may have been cancelled or run out of time while waiting for a slot
+		var status string
+		status, err = r.Batches.Status(b.ID)
+		if err != nil || status != store.BatchInProgress || time.Now().Unix() >= b.ExpiresAt {
+			<-r.slots
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-r.slots }()
+			res, err := r.send(ctx, b, req)
+			if err != nil {
+				// Left without a result, so the request is sent again when the batch resumes
+				return
+			}
+			if err := r.Batches.SaveResult(b.ID, res); err != nil {
+				r.Log.WithField("batch_id", b.ID).Errorf("Failed to save batch result: %v", err)
+				return
+			}
+			countsMutex.Lock()
+			if res.Failed {
+				counts.Failed++
+			} else {
+				counts.Completed++
+			}
+			current := counts
+			countsMutex.Unlock()
+			if err := r.Batches.UpdateCounts(b.ID, current); err != nil {
+				r.Log.WithField("batch_id", b.ID).Errorf("Failed to update batch counts: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return err
+}
+
+// fail ends a batch that did not pass validation.
+func (r *Runner) fail(b store.Batch, errs []store.BatchError) error {
+	return r.Batches.FinishBatch(b.ID, store.BatchFailed, "", "", &store.BatchErrors{Object: "list", Data: errs}, store.BatchRequestCounts{})
+}
+
+// finish writes the output file with the successful results of a batch and the error file with the
+// failed ones, in input order, and ends the batch with the given status. When a batch expires, its
+// requests without a result are reported in the error file.
+func (r *Runner) finish(b store.Batch, status string, requests []request) error {
+	results, err := r.Batches.Results(b.ID)
+	if err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(results))
+	var output, errorOutput bytes.Buffer
+	counts := store.BatchRequestCounts{Total: len(requests)}
+	for _, res := range results {
+		done[res.Line] = true
+		if res.Failed {
+			counts.Failed++
+			errorOutput.Write(res.Output)
+			errorOutput.WriteByte('\n')
+		} else {
+			counts.Completed++
+			output.Write(res.Output)
+			output.WriteByte('\n')
+		}
+	}
+	if status == store.BatchExpired {
+		for _, req := range requests {
+			if !done[req.line] {
+				counts.Failed++
+				errorOutput.Write(errorLine(req, "batch_expired", "This request could not be executed before the completion window expired."))
+				errorOutput.WriteByte('\n')
+			}
+		}
+	}
+
+	var outputFileID, errorFileID string
+	if output.Len() > 0 {
+		f, err := r.Files.CreateFile(b.Client, store.FilePurposeBatchOutput, b.ID+"_output.jsonl", output.Bytes())
+		if err != nil {
+			return err
+		}
+		outputFileID = f.ID
+	}
+	if errorOutput.Len() > 0 {
+		f, err := r.Files.CreateFile(b.Client, store.FilePurposeBatchOutput, b.ID+"_error.jsonl", errorOutput.Bytes())
+		if err != nil {
+			return err
+		}
+		errorFileID = f.ID
+	}
+	if err := r.Batches.FinishBatch(b.ID, status, outputFileID, errorFileID, nil, counts); err != nil {
+		return err
+	}
+	r.Log.WithFields(logrus.Fields{
+		"batch_id":  b.ID,
+		"status":    status,
+		"completed": counts.Completed,
+		"failed":    counts.Failed,
+	}).Info("Finished batch")
+	if err := r.Batches.DeleteResults(b.ID); err != nil {
+		return fmt.Errorf("batch finished but its results were kept: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"vertigo/internal/config"
+)
+
+// Entry is a cached chat completion.
+type Entry struct {
+	Model string
+	// Body is a non-streaming chat completion response in OpenAI format.
+	Body      []byte
+	CreatedAt time.Time
+}
+
+// Cache stores chat completions keyed by a canonical request hash.
+type Cache interface {
+	// Get returns the entry stored under key if it exists and has not expired.
+	Get(key string) (*Entry, bool)
+	// Set stores an entry under key.
+	Set(key string, entry *Entry) error
+}
+
+// New creates the cache backend selected in the configuration. It returns nil when caching is disabled.
+func New(cfg config.CacheConfig, db *sql.DB) (Cache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	switch cfg.Backend {
+	case "", "memory":
+		maxEntries := cfg.MaxEntries
+		if maxEntries <= 0 {
+			maxEntries = 1000
+		}
+		return NewMemoryCache(maxEntries, ttl), nil
+	case "sqlite":
+		return NewSQLiteCache(db, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Backend)
+	}
+}
+
+// Key returns the canonical hash of a request body. Streaming options are excluded so that streaming
+// and non-streaming requests for the same prompt share an entry.
+func Key(reqBodyMap map[string]interface{}) (string, error) {
+	canonical := make(map[string]interface{}, len(reqBodyMap))
+	for k, v := range reqBodyMap {
+		if k == "stream" || k == "stream_options" {
+			continue
+		}
+		canonical[k] = v
+	}
+
+	// encoding/json writes map keys in sorted order, which makes the encoding canonical.
+	data, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ContextKey returns the canonical hash of everything in a request body but its model and, if it is a
+// user message, its last message, which is the prompt the semantic cache matches on. Requests only share semantic cache
+// entries when their system prompt, earlier turns, tools and sampling parameters are identical.
+func ContextKey(reqBodyMap map[string]interface{}) (string, error) {
+	context := make(map[string]interface{}, len(reqBodyMap))
+	for k, v := range reqBodyMap {
+		if k == "model" {
+			continue
+		}
+		context[k] = v
+	}
+	if messages, ok := reqBodyMap["messages"].([]interface{}); ok && len(messages) > 0 {
+		if last, ok := messages[len(messages)-1].(map[string]interface{}); ok && last["role"] == "user" {
+			context["messages"] = messages[:len(messages)-1]
+		}
+	}
+	return Key(context)
+}
+
+// NewSemantic creates the semantic cache described in the configuration. It returns nil when it is disabled.
+func NewSemantic(cfg config.SemanticCacheConfig, db *sql.DB) *SemanticCache {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = 0.95
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	maxCandidates := cfg.MaxCandidates
+	if maxCandidates <= 0 {
+		maxCandidates = 1000
+	}
+	return NewSemanticCache(db, threshold, ttl, maxCandidates)
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	key := func(body string) string {
+		var reqBodyMap map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &reqBodyMap); err != nil {
+			t.Fatal(err)
+		}
+		k, err := Key(reqBodyMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	base := key(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}]}`)
+	if key(`{"messages":[{"content":"hi","role":"user"}],"temperature":0,"model":"m"}`) != base {
+		t.Error("the order of the fields changed the key")
+	}
+	if key(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}],"stream":true,"stream_options":{"include_usage":true}}`) != base {
+		t.Error("the streaming options changed the key")
+	}
+	if key(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"hello"}]}`) == base {
+		t.Error("a different prompt has the same key")
+	}
+	if key(`{"model":"m","temperature":1,"messages":[{"role":"user","content":"hi"}]}`) == base {
+		t.Error("a different temperature has the same key")
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	mc := NewMemoryCache(2, time.Hour)
+	for _, key := range []string{"a", "b"} {
+		mc.Set(key, &Entry{Model: key, CreatedAt: time.Now()})
+	}
+	// Reading a makes b the least recently used entry
+	if _, ok := mc.Get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	mc.Set("c", &Entry{Model: "c", CreatedAt: time.Now()})
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := mc.Get(key); ok != want {
+			t.Errorf("Get(%s) found = %v, want %v", key, ok, want)
+		}
+	}
+	if n := mc.order.Len(); n != 2 {
+		t.Errorf("cache holds %d entries, want 2", n)
+	}
+}
+
+func TestMemoryCacheExpires(t *testing.T) {
+	mc := NewMemoryCache(10, time.Minute)
+	mc.Set("old", &Entry{CreatedAt: time.Now().Add(-2 * time.Minute)})
+	mc.Set("new", &Entry{CreatedAt: time.Now()})
+
+	if _, ok := mc.Get("old"); ok {
+		t.Error("an expired entry was returned")
+	}
+	if _, ok := mc.items["old"]; ok {
+		t.Error("an expired entry was kept")
+	}
+	if _, ok := mc.Get("new"); !ok {
+		t.Error("a fresh entry is missing")
+	}
+}
+
+func TestCompletionToSSE(t *testing.T) {
+	completion := `{"id":"c1","object":"chat.completion","created":1,"model":"m",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":3,"completion_tokens":1}}`
+	sse, err := CompletionToSSE([]byte(completion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunk struct {
+		Object  string `json:"object"`
+		Choices []struct {
+			Delta        map[string]interface{} `json:"delta"`
+			FinishReason string                 `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	data, rest, _ := strings.Cut(strings.TrimPrefix(string(sse), "data: "), "\n\n")
+	if rest != "data: [DONE]\n\n" {
+		t.Fatalf("stream = %q, want one chunk and [DONE]", sse)
+	}
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 ||
+		chunk.Choices[0].Delta["content"] != "Hello" || chunk.Choices[0].FinishReason != "stop" {
+		t.Errorf("chunk = %s", data)
+	}
+
+	// The replayed stream reassembles into the same completion
+	roundTrip, err := CompletionFromSSE(sse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got map[string]interface{}
+	json.Unmarshal([]byte(completion), &want)
+	json.Unmarshal(roundTrip, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %s, want %s", roundTrip, completion)
+	}
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-memory LRU cache with a fixed capacity and TTL.
+type MemoryCache struct {
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List // Most recently used at the front
+	items      map[string]*list.Element
+	mutex      sync.Mutex
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// NewMemoryCache creates a new MemoryCache.
+func NewMemoryCache(maxEntries int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored under key if it exists and has not expired.
+func (mc *MemoryCache) Get(key string) (*Entry, bool) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	elem, ok := mc.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryItem)
+	if time.Since(item.entry.CreatedAt) > mc.ttl {
+		mc.order.Remove(elem)
+		delete(mc.items, key)
+		return nil, false
+	}
+	mc.order.MoveToFront(elem)
+	return item.entry, true
+}
+
+// Set stores an entry under key, evicting the least recently used entry when the cache is full.
+func (mc *MemoryCache) Set(key string, entry *Entry) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if elem, ok := mc.items[key]; ok {
+		elem.Value.(*memoryItem).entry = entry
+		mc.order.MoveToFront(elem)
+		return nil
+	}
+
+	mc.items[key] = mc.order.PushFront(&memoryItem{key: key, entry: entry})
+	for mc.order.Len() > mc.maxEntries {
+		oldest := mc.order.Back()
+		mc.order.Remove(oldest)
+		delete(mc.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// SemanticCache is a vector index of cached completions stored in the semantic_cache table.
+// Entries are matched by cosine similarity of the embedded prompt within a SemanticScope.
+type SemanticCache struct {
+	db        *sql.DB
+	threshold float64
+	ttl       time.Duration
+	// maxCandidates bounds how many of the newest entries in a scope a lookup compares.
+	maxCandidates int
+}
+
+// SemanticScope restricts which entries a prompt can match. Context is the ContextKey of the request,
+// so a prompt only matches answers given with the same system prompt, earlier turns, tools and
+// sampling parameters. Client and Model are empty when matches are not restricted by them.
+type SemanticScope struct {
+	Client  string
+	Model   string
+	Context string
+}
+
+// SemanticMatch is the closest cached entry found for a prompt.
+type SemanticMatch struct {
+	ID         int64
+	Prompt     string
+	Similarity float64
+	Entry      *Entry
+}
+
+// NewSemanticCache creates a new SemanticCache with a database connection.
+func NewSemanticCache(db *sql.DB, threshold float64, ttl time.Duration, maxCandidates int) *SemanticCache {
+	return &SemanticCache{
+		db:            db,
+		threshold:     threshold,
+		ttl:           ttl,
+		maxCandidates: maxCandidates,
+	}
+}
+
+// HasEntries reports whether the scope has any unexpired entries. When it has none, a lookup cannot
+// match and the prompt need not be embedded to look it up.
+func (sc *SemanticCache) HasEntries(scope SemanticScope) (bool, error) {
+	var exists bool
+	err := sc.db.QueryRow("SELECT EXISTS (SELECT 1 FROM semantic_cache WHERE client = ? AND model = ? AND context = ? AND expires_at > ?)",
+		scope.Client, scope.Model, scope.Context, time.Now().Unix()).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to query semantic cache: %w", err)
+	}
+	return exists, nil
+}
+
+// Lookup returns the most similar unexpired entry in the given scope if its similarity reaches the threshold.
+// Only the newest maxCandidates entries of the scope are compared.
+func (sc *SemanticCache) Lookup(scope SemanticScope, embedding []float32) (*SemanticMatch, error) {
+	rows, err := sc.db.Query(`SELECT id, prompt, embedding FROM semantic_cache
+		WHERE client = ? AND model = ? AND context = ? AND expires_at > ? ORDER BY id DESC LIMIT ?`,
+		scope.Client, scope.Model, scope.Context, time.Now().Unix(), sc.maxCandidates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query semantic cache: %w", err)
+	}
+	defer rows.Close()
+
+	var best *SemanticMatch
+	for rows.Next() {
+		var (
+			match SemanticMatch
+			blob  []byte
+		)
+		if err := rows.Scan(&match.ID, &match.Prompt, &blob); err != nil {
+			return nil, fmt.Errorf("failed to scan semantic cache entry: %w", err)
+		}
+		match.Similarity = cosineSimilarity(embedding, decodeEmbedding(blob))
+		if match.Similarity < sc.threshold || (best != nil && match.Similarity <= best.Similarity) {
+			continue
+		}
+		best = &match
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read semantic cache: %w", err)
+	}
+	rows.Close()
+	if best == nil {
+		return nil, nil
+	}
+
+	// Only the best match's response is loaded
+	var (
+		entry     Entry
+		createdAt int64
+	)
+	err = sc.db.QueryRow("SELECT response_model, body, created_at FROM semantic_cache WHERE id = ?", best.ID).
+		Scan(&entry.Model, &entry.Body, &createdAt)
+	if err == sql.ErrNoRows {
+		// Removed as expired since it was compared
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query semantic cache entry: %w", err)
+	}
+	entry.CreatedAt = time.Unix(createdAt, 0)
+	best.Entry = &entry
+	return best, nil
+}
+
+// Store adds an entry to the index and removes expired entries.
+func (sc *SemanticCache) Store(scope SemanticScope, prompt string, embedding []float32, entry *Entry) error {
+	_, err := sc.db.Exec("INSERT INTO semantic_cache (client, model, context, prompt, embedding, response_model, body, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		scope.Client, scope.Model, scope.Context, prompt, encodeEmbedding(embedding), entry.Model, entry.Body, entry.CreatedAt.Unix(), entry.CreatedAt.Add(sc.ttl).Unix())
+	if err != nil {
+		return fmt.Errorf("failed to insert semantic cache entry: %w", err)
+	}
+
+	_, err = sc.db.Exec("DELETE FROM semantic_cache WHERE expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired semantic cache entries: %w", err)
+	}
+	return nil
+}
+
+// encodeEmbedding packs an embedding as little-endian float32 values.
+func encodeEmbedding(embedding []float32) []byte {
+	buf := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
+
+func decodeEmbedding(buf []byte) []float32 {
+	embedding := make([]float32, len(buf)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return embedding
+}
+
+// cosineSimilarity returns the cosine of the angle between two vectors, or 0 if they are not comparable.
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vertigo/internal/db"
+)
+
+func newTestSemanticCache(t *testing.T, maxCandidates int) *SemanticCache {
+	t.Helper()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return NewSemanticCache(database, 0.9, time.Hour, maxCandidates)
+}
+
+func TestContextKey(t *testing.T) {
+	request := func(system, prompt string, temperature float64) map[string]interface{} {
+		return map[string]interface{}{
+			"model":       "m",
+			"temperature": temperature,
+			"messages": []interface{}{
+				map[string]interface{}{"role": "system", "content": system},
+				map[string]interface{}{"role": "user", "content": prompt},
+			},
+		}
+	}
+	key := func(reqBodyMap map[string]interface{}) string {
+		k, err := ContextKey(reqBodyMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	base := key(request("Be brief.", "continue", 0))
+	if key(request("Be brief.", "go on", 0)) != base {
+		t.Error("the last user message changed the context")
+	}
+	other := request("Be brief.", "continue", 0)
+	other["model"] = "other"
+	if key(other) != base {
+		t.Error("the model changed the context")
+	}
+	if key(request("Be verbose.", "continue", 0)) == base {
+		t.Error("a different system prompt has the same context")
+	}
+	if key(request("Be brief.", "continue", 1)) == base {
+		t.Error("different sampling parameters have the same context")
+	}
+	withTools := request("Be brief.", "continue", 0)
+	withTools["tools"] = []interface{}{map[string]interface{}{"type": "function"}}
+	if key(withTools) == base {
+		t.Error("tools did not change the context")
+	}
+
+	// A trailing tool result is part of the context, not the prompt
+	toolTurn := func(result string) map[string]interface{} {
+		r := request("Be brief.", "continue", 0)
+		r["messages"] = append(r["messages"].([]interface{}), map[string]interface{}{"role": "tool", "content": result})
+		return r
+	}
+	if key(toolTurn("a")) == key(toolTurn("b")) {
+		t.Error("different tool results have the same context")
+	}
+}
+
+func TestSemanticCacheScope(t *testing.T) {
+	sc := newTestSemanticCache(t, 100)
+	scope := SemanticScope{Client: "c", Model: "m", Context: "ctx"}
+	entry := &Entry{Model: "m", Body: []byte(`{"id":"1"}`), CreatedAt: time.Now()}
+
+	if ok, err := sc.HasEntries(scope); err != nil || ok {
+		t.Fatalf("HasEntries() = %v, %v on an empty cache", ok, err)
+	}
+	if err := sc.Store(scope, "continue", []float32{1, 0}, entry); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := sc.HasEntries(scope); !ok {
+		t.Error("HasEntries() = false after Store")
+	}
+
+	match, err := sc.Lookup(scope, []float32{1, 0.1})
+	if err != nil || match == nil {
+		t.Fatalf("Lookup() = %v, %v, want a match", match, err)
+	}
+	if string(match.Entry.Body) != `{"id":"1"}` || match.Prompt != "continue" {
+		t.Errorf("Lookup() = %+v", match)
+	}
+
+	otherContext := scope
+	otherContext.Context = "other"
+	if match, _ := sc.Lookup(otherContext, []float32{1, 0}); match != nil {
+		t.Error("Lookup() matched an entry of another conversation")
+	}
+	if match, _ := sc.Lookup(scope, []float32{0, 1}); match != nil {
+		t.Error("Lookup() matched a dissimilar prompt")
+	}
+}
+
+func TestSemanticCacheMaxCandidates(t *testing.T) {
+	sc := newTestSemanticCache(t, 2)
+	scope := SemanticScope{Context: "ctx"}
+	now := time.Now()
+	sc.Store(scope, "old", []float32{1, 0}, &Entry{Model: "m", Body: []byte("old"), CreatedAt: now})
+	sc.Store(scope, "new 1", []float32{0, 1}, &Entry{Model: "m", Body: []byte("new 1"), CreatedAt: now})
+	sc.Store(scope, "new 2", []float32{0, 1}, &Entry{Model: "m", Body: []byte("new 2"), CreatedAt: now})
+
+	// The oldest entry is beyond the newest two compared
+	if match, _ := sc.Lookup(scope, []float32{1, 0}); match != nil {
+		t.Errorf("Lookup() = %q, want no match beyond max candidates", match.Prompt)
+	}
+	if match, _ := sc.Lookup(scope, []float32{0, 1}); match == nil {
+		t.Error("Lookup() found no match among the newest entries")
+	}
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SQLiteCache persists cached completions in the response_cache table.
+type SQLiteCache struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// NewSQLiteCache creates a new SQLiteCache with a database connection.
+func NewSQLiteCache(db *sql.DB, ttl time.Duration) *SQLiteCache {
+	return &SQLiteCache{
+		db:  db,
+		ttl: ttl,
+	}
+}
+
+// Get returns the entry stored under key if it exists and has not expired.
+func (sc *SQLiteCache) Get(key string) (*Entry, bool) {
+	row := sc.db.QueryRow("SELECT model, body, created_at FROM response_cache WHERE key = ? AND expires_at > ?", key, time.Now().Unix())
+	var entry Entry
+	var createdAt int64
+	if err := row.Scan(&entry.Model, &entry.Body, &createdAt); err != nil {
+		return nil, false
+	}
+	entry.CreatedAt = time.Unix(createdAt, 0)
+	return &entry, true
+}
+
+// Set stores an entry under key and removes expired entries.
+func (sc *SQLiteCache) Set(key string, entry *Entry) error {
+	_, err := sc.db.Exec("INSERT OR REPLACE INTO response_cache (key, model, body, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		key, entry.Model, entry.Body, entry.CreatedAt.Unix(), entry.CreatedAt.Add(sc.ttl).Unix())
+	if err != nil {
+		return fmt.Errorf("failed to insert cache entry: %w", err)
+	}
+
+	_, err = sc.db.Exec("DELETE FROM response_cache WHERE expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired cache entries: %w", err)
+	}
+	return nil
+}
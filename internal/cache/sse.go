@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotCacheable is returned when a streamed response cannot be reassembled into a single completion.
+var ErrNotCacheable = errors.New("response is not cacheable")
+
+// CompletionFromSSE reassembles an OpenAI-compatible SSE stream into a non-streaming chat completion.
+// Streams that did not finish or that carry tool calls are reported as ErrNotCacheable.
+func CompletionFromSSE(data []byte) ([]byte, error) {
+	var (
+		id, model        interface{}
+		created          interface{}
+		content          strings.Builder
+		reasoningContent strings.Builder
+		finishReason     interface{}
+		usage            interface{}
+		done             bool
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		jsonStr := strings.TrimPrefix(line, "data: ")
+		if jsonStr == "[DONE]" {
+			done = true
+			break
+		}
+
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(jsonStr), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal stream chunk: %w", err)
+		}
+		if id == nil {
+			id, model, created = chunk["id"], chunk["model"], chunk["created"]
+		}
+		if u, ok := chunk["usage"]; ok && u != nil {
+			usage = u
+		}
+
+		choices, _ := chunk["choices"].([]interface{})
+		if len(choices) == 0 {
+			continue
+		}
+		choice, _ := choices[0].(map[string]interface{})
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			if _, ok := delta["tool_calls"]; ok {
+				return nil, ErrNotCacheable
+			}
+			if c, ok := delta["content"].(string); ok {
+				content.WriteString(c)
+			}
+			if rc, ok := delta["reasoning_content"].(string); ok {
+				reasoningContent.WriteString(rc)
+			}
+		}
+		if fr, ok := choice["finish_reason"]; ok && fr != nil {
+			finishReason = fr
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !done || finishReason == nil {
+		return nil, ErrNotCacheable
+	}
+
+	message := map[string]interface{}{
+		"role":    "assistant",
+		"content": content.String(),
+	}
+	if reasoningContent.Len() > 0 {
+		message["reasoning_content"] = reasoningContent.String()
+	}
+	completion := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"message":       message,
+				"finish_reason": finishReason,
+			},
+		},
+	}
+	if usage != nil {
+		completion["usage"] = usage
+	}
+	return json.Marshal(completion)
+}
+
+// CompletionToSSE converts a non-streaming chat completion into an OpenAI-compatible SSE stream,
+// so that cached completions can be replayed to streaming clients.
+func CompletionToSSE(body []byte) ([]byte, error) {
+	var completion map[string]interface{}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cached completion: %w", err)
+	}
+
+	var buf bytes.Buffer
+	choices, _ := completion["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		chunk := map[string]interface{}{
+			"id":      completion["id"],
+			"object":  "chat.completion.chunk",
+			"created": completion["created"],
+			"model":   completion["model"],
+			"choices": []interface{}{
+				map[string]interface{}{
+					"index":         choice["index"],
+					"delta":         choice["message"],
+					"finish_reason": choice["finish_reason"],
+				},
+			},
+		}
+		if usage, ok := completion["usage"]; ok {
+			chunk["usage"] = usage
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "data: %s\n\n", data)
+	}
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.Bytes(), nil
+}
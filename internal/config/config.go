@@ -1,7 +1,12 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"reflect"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,10 +19,322 @@ type Config struct {
 	} `yaml:"server"`
 	Gemini struct {
 		APIKeys []string `yaml:"api_keys"`
+		// APIKeysFile names a file with further keys, one per line.
+		APIKeysFile string `yaml:"api_keys_file"`
 	} `yaml:"gemini"`
+	Database DatabaseConfig `yaml:"database"`
+	// Providers are the upstream APIs. When none are configured, a single Gemini provider
+	// is used with the keys under gemini.api_keys, which must then be the only keys given.
+	Providers []ProviderConfig       `yaml:"providers"`
+	Routing   RoutingConfig          `yaml:"routing"`
+	Models    map[string]ModelConfig `yaml:"models"`
+	Cache     CacheConfig            `yaml:"cache"`
+	// ContextCache configures Gemini context caching of repeated system prompts.
+	ContextCache ContextCacheConfig `yaml:"context_cache"`
+	Usage        UsageConfig        `yaml:"usage"`
+	Tracing      TracingConfig      `yaml:"tracing"`
+	Timeouts     TimeoutsConfig     `yaml:"timeouts"`
+	Reload       ReloadConfig       `yaml:"reload"`
+	Admin        AdminConfig        `yaml:"admin"`
+	HealthCheck  HealthCheckConfig  `yaml:"health_check"`
+	// CircuitBreaker stops sending requests for a model to a provider that keeps failing.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Hedging        HedgingConfig        `yaml:"hedging"`
+	Queue          QueueConfig          `yaml:"queue"`
+	// Batch serves OpenAI-compatible Files and Batches APIs for offline jobs.
+	Batch BatchConfig `yaml:"batch"`
 }
 
-// Load reads a YAML file from the given path and unmarshals it into a Config struct.
+// BatchConfig configures the Files and Batches APIs. Batches are drained in the background at batch
+// priority, Concurrency requests at a time across all batches, and their progress is kept in the database
+// so they resume after a restart. PollInterval is how often new and cancelled batches are picked up, and
+// uploads are limited to MaxFileSizeMB megabytes.
+type BatchConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Concurrency   int           `yaml:"concurrency"`
+	PollInterval  time.Duration `yaml:"poll_interval"`
+	MaxFileSizeMB int           `yaml:"max_file_size_mb"`
+}
+
+// Request priorities, highest first.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// QueueConfig configures the queue in front of upstream calls. With it enabled, a request for a model whose
+// keys are all rate-limited, or that is at its max_concurrency, waits up to Timeout for a slot instead of
+// failing, and at most MaxSize requests wait per model. Waiting requests are served by priority, then in
+// arrival order. A request's priority comes from the X-Vertigo-Priority header, then from Clients by client
+// identity, then from DefaultPriority.
+type QueueConfig struct {
+	Enabled         bool              `yaml:"enabled"`
+	MaxSize         int               `yaml:"max_size"`
+	Timeout         time.Duration     `yaml:"timeout"`
+	DefaultPriority string            `yaml:"default_priority"`
+	Clients         map[string]string `yaml:"clients"`
+}
+
+// HedgingConfig configures request hedging. Hedging is turned on per virtual model, per model or per
+// request with the X-Vertigo-Hedge header; when the first upstream attempt has not started responding
+// after Delay, a second attempt is sent with another key and the slower of the two is canceled.
+type HedgingConfig struct {
+	Delay time.Duration `yaml:"delay"`
+}
+
+// CircuitBreakerConfig configures the circuit breakers kept for each model and provider. A circuit opens
+// after FailureThreshold consecutive server errors, timeouts or connection failures, and requests then fail
+// fast or go to the model's fallbacks. After OpenDuration, up to HalfOpenRequests trial requests are sent;
+// a success closes the circuit and a failure opens it again.
+type CircuitBreakerConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// HealthCheckConfig configures the background key prober. Every Interval it probes each key that is
+// quarantined, and each key not yet shown to work, or that failed since, once it has not been used or
+// probed for IdleAfter. Model is the default probe model for providers without a probe_model; without
+// either, keys are probed by listing models.
+type HealthCheckConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Interval  time.Duration `yaml:"interval"`
+	IdleAfter time.Duration `yaml:"idle_after"`
+	Model     string        `yaml:"model"`
+}
+
+// AdminConfig configures the admin API, which manages key pools at runtime. Requests must carry one of
+// Tokens as a bearer token. With Persist, runtime key changes are saved to the database and survive restarts.
+type AdminConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Tokens  []string `yaml:"tokens"`
+	Persist bool     `yaml:"persist"`
+}
+
+// ReloadConfig configures reloading the configuration file while the server is running. A reload is
+// always triggered by SIGHUP; with Watch, it is also triggered when the file changes, checked every Interval.
+type ReloadConfig struct {
+	Watch    bool          `yaml:"watch"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// DatabaseConfig configures the SQLite database holding conversations, caches and usage.
+type DatabaseConfig struct {
+	Path string `yaml:"path"`
+}
+
+// ProviderConfig describes an upstream API and its key pool.
+type ProviderConfig struct {
+	Name string `yaml:"name"`
+	// Type is "gemini" for Gemini's OpenAI-compatible API, which enables Gemini-only features such as
+	// context caching and thinking budgets, "vertex" for Vertex AI's OpenAI-compatible API, or "openai"
+	// for any other OpenAI-compatible server.
+	Type    string `yaml:"type"`
+	BaseURL string `yaml:"base_url"`
+	// Auth is "bearer" (the default), "header" to send the key in AuthHeader, or "none".
+	Auth       string   `yaml:"auth"`
+	AuthHeader string   `yaml:"auth_header"`
+	APIKeys    []string `yaml:"api_keys"`
+	// APIKeysFile names a file with further keys, one per line.
+	APIKeysFile string `yaml:"api_keys_file"`
+	// Models are the model names or glob patterns served by this provider. Requests go to the first
+	// provider with a matching pattern, or else to the first provider that lists no models.
+	Models []string `yaml:"models"`
+
+	// Vertex AI settings. Project and Region select the endpoint unless BaseURL is set. Each service
+	// account JSON key file in CredentialsFiles acts as one key of the pool; TokenURL overrides the
+	// OAuth token endpoint named in the files.
+	Project          string   `yaml:"project"`
+	Region           string   `yaml:"region"`
+	CredentialsFiles []string `yaml:"credentials_files"`
+	TokenURL         string   `yaml:"token_url"`
+
+	// ProbeModel is the model the health checks request a single token from. When empty, keys are
+	// probed by listing models, which needs no model but does not test per-model quotas.
+	ProbeModel string `yaml:"probe_model"`
+}
+
+// UpstreamProviders returns the configured providers, or the Gemini provider implied by gemini.api_keys.
+func (c *Config) UpstreamProviders() []ProviderConfig {
+	if len(c.Providers) > 0 {
+		return c.Providers
+	}
+	return []ProviderConfig{{Name: "gemini", Type: "gemini", APIKeys: c.Gemini.APIKeys}}
+}
+
+// TimeoutsConfig bounds upstream requests. Unset durations fall back to the built-in defaults,
+// and models can override any of them in their ModelConfig.
+type TimeoutsConfig struct {
+	Connect   time.Duration   `yaml:"connect"`
+	Stream    RequestTimeouts `yaml:"stream"`
+	NonStream RequestTimeouts `yaml:"non_stream"`
+}
+
+// RequestTimeouts are the limits for one upstream request: the wait for the first byte of the response,
+// the longest gap between two chunks, and the whole request.
+type RequestTimeouts struct {
+	FirstByte time.Duration `yaml:"first_byte"`
+	Idle      time.Duration `yaml:"idle"`
+	Total     time.Duration `yaml:"total"`
+}
+
+// TracingConfig configures OpenTelemetry trace export. Exporter is "otlp" (OTLP over HTTP to Endpoint),
+// "stdout", or "file" (JSON spans appended to File).
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	File        string  `yaml:"file"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// UsageConfig configures usage accounting. Prices are written to the price table at startup,
+// replacing existing entries for the same models; the table can also be edited at runtime.
+type UsageConfig struct {
+	Enabled bool         `yaml:"enabled"`
+	Prices  []ModelPrice `yaml:"prices"`
+}
+
+// ModelPrice is the price of a model in US dollars per million tokens.
+type ModelPrice struct {
+	Model       string  `yaml:"model"`
+	Input       float64 `yaml:"input"`
+	CachedInput float64 `yaml:"cached_input"`
+	Output      float64 `yaml:"output"`
+}
+
+// ContextCacheConfig configures Gemini context caching. A system prompt of at least MinTokens
+// that is seen MinRepeats times for the same model is uploaded to a Gemini cachedContents entry.
+// Requests with tools never use one.
+type ContextCacheConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	MinTokens  int           `yaml:"min_tokens"`
+	MinRepeats int           `yaml:"min_repeats"`
+	TTL        time.Duration `yaml:"ttl"`
+}
+
+// CacheConfig configures the exact-match response cache.
+type CacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Backend is either "memory" (an LRU of MaxEntries) or "sqlite".
+	Backend    string        `yaml:"backend"`
+	TTL        time.Duration `yaml:"ttl"`
+	MaxEntries int           `yaml:"max_entries"`
+	// DeterministicOnly restricts caching to requests with temperature 0, so that requests without a
+	// temperature are not cached either. It is on unless set to false; see Deterministic.
+	DeterministicOnly *bool               `yaml:"deterministic_only"`
+	Semantic          SemanticCacheConfig `yaml:"semantic"`
+}
+
+// Deterministic reports whether caching is restricted to requests with temperature 0, which is the default.
+func (c CacheConfig) Deterministic() bool {
+	return c.DeterministicOnly == nil || *c.DeterministicOnly
+}
+
+// SemanticCacheConfig configures the embedding-based cache, which matches the last user message
+// against previously answered prompts with the same system prompt, earlier turns, tools and sampling
+// parameters. It is independent of the exact-match cache.
+type SemanticCacheConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	EmbeddingModel string        `yaml:"embedding_model"`
+	Threshold      float64       `yaml:"threshold"`
+	TTL            time.Duration `yaml:"ttl"`
+	// PerClient and PerModel restrict matches to entries created by the same client or for the same model.
+	PerClient bool `yaml:"per_client"`
+	PerModel  bool `yaml:"per_model"`
+	// MaxCandidates is how many of the newest entries in a scope a lookup compares the prompt with.
+	MaxCandidates int `yaml:"max_candidates"`
+}
+
+// ModelConfig holds per-model settings for upstream Gemini models.
+type ModelConfig struct {
+	// Fallbacks is the ordered list of models to try when this model fails on every key.
+	Fallbacks []string `yaml:"fallbacks"`
+	// Timeouts override the global request timeouts for this model, e.g. for slow reasoning models.
+	Timeouts ModelTimeouts `yaml:"timeouts"`
+	// Hedge sends a second attempt for requests to this model that are slow to start responding.
+	Hedge bool `yaml:"hedge"`
+	// MaxConcurrency limits the requests in flight for this model; 0 means no limit.
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+// ModelTimeouts are per-model overrides of the connect timeout and of the streaming and non-streaming
+// request timeouts.
+type ModelTimeouts struct {
+	Connect   time.Duration   `yaml:"connect"`
+	Stream    RequestTimeouts `yaml:"stream"`
+	NonStream RequestTimeouts `yaml:"non_stream"`
+}
+
+// RoutingConfig holds the virtual model aliases exposed to clients.
+type RoutingConfig struct {
+	VirtualModels map[string]VirtualModel `yaml:"virtual_models"`
+	Thinking      ThinkingConfig          `yaml:"thinking"`
+}
+
+// ThinkingConfig translates reasoning_effort into a Gemini thinking budget instead of a model switch.
+// Budgets maps an effort level (none, minimal, low, medium, high) to a token budget; -1 lets Gemini decide.
+type ThinkingConfig struct {
+	Enabled         bool           `yaml:"enabled"`
+	Budgets         map[string]int `yaml:"budgets"`
+	IncludeThoughts bool           `yaml:"include_thoughts"`
+}
+
+// VirtualModel is a client-facing model alias that resolves to a real upstream model.
+// Rules are evaluated in order and the first match wins. When none match, the Auto router
+// picks a model if it is enabled, and Default is used otherwise.
+type VirtualModel struct {
+	Default string        `yaml:"default"`
+	Rules   []RoutingRule `yaml:"rules"`
+	Auto    AutoRouting   `yaml:"auto"`
+	// Hedge turns on request hedging for every request to this virtual model.
+	Hedge bool `yaml:"hedge"`
+}
+
+// AutoRouting configures the heuristic router, which scores a request by its complexity
+// and picks the tier with the highest MinScore not above that score.
+type AutoRouting struct {
+	Enabled            bool       `yaml:"enabled"`
+	Tiers              []AutoTier `yaml:"tiers"`
+	Keywords           []string   `yaml:"keywords"`
+	MediumPromptTokens int        `yaml:"medium_prompt_tokens"`
+	LongPromptTokens   int        `yaml:"long_prompt_tokens"`
+	ManyCodeBlocks     int        `yaml:"many_code_blocks"`
+	DeepConversation   int        `yaml:"deep_conversation"`
+}
+
+// AutoTier maps a minimum complexity score to a model.
+type AutoTier struct {
+	MinScore int    `yaml:"min_score"`
+	Model    string `yaml:"model"`
+}
+
+// RoutingRule maps a set of request conditions to a target model.
+type RoutingRule struct {
+	Match  RuleMatch              `yaml:"match"`
+	Model  string                 `yaml:"model"`
+	Params map[string]interface{} `yaml:"params"`
+}
+
+// RuleMatch describes the conditions a request must satisfy for a rule to apply.
+// Zero-valued fields are ignored, so an empty match always applies.
+type RuleMatch struct {
+	ReasoningEffort []string `yaml:"reasoning_effort"`
+	MinPromptTokens int      `yaml:"min_prompt_tokens"`
+	MaxPromptTokens int      `yaml:"max_prompt_tokens"`
+	HasTools        *bool    `yaml:"has_tools"`
+	HasImages       *bool    `yaml:"has_images"`
+	Header          string   `yaml:"header"`
+	HeaderValue     string   `yaml:"header_value"`
+}
+
+// Load reads a YAML file from the given path and unmarshals it into a Config struct. ${VAR} references
+// in its values are replaced with environment variables, VERTIGO_* environment variables
+// override the parsed values, and API key files are read. Unset values get their defaults, and the
+// result is validated.
 func Load(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -25,9 +342,53 @@ func Load(path string) (*Config, error) {
 	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := decodeYAML(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := applyEnvOverrides(&cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.loadKeyFiles(); err != nil {
+		return nil, err
+	}
+	cfg.applyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s:\n%w", path, err)
+	}
 
 	return &cfg, nil
 }
+
+// LoadDatabase returns the database settings of the configuration file at path, with the same ${VAR}
+// references, environment overrides and defaults as Load, but without reading key files or validating
+// the rest of the configuration; only references in the database section must be set. It serves tools
+// that only need the database, such as "vertigo usage".
+// If the file does not exist and required is false, the settings come from the environment and defaults.
+func LoadDatabase(path string, required bool) (DatabaseConfig, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var doc struct {
+			Database yaml.Node `yaml:"database"`
+		}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return DatabaseConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if doc.Database.Kind != 0 {
+			if err := interpolateNode(&doc.Database); err != nil {
+				return DatabaseConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+			if err := doc.Database.Decode(&cfg.Database); err != nil {
+				return DatabaseConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+		}
+	case required || !errors.Is(err, fs.ErrNotExist):
+		return DatabaseConfig{}, err
+	}
+	if err := applyEnv(EnvPrefix+"DATABASE_", reflect.ValueOf(&cfg.Database).Elem()); err != nil {
+		return DatabaseConfig{}, err
+	}
+	cfg.applyDefaults()
+	return cfg.Database, nil
+}
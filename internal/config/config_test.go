@@ -0,0 +1,109 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vertigo.yaml")
+	// The rest of the file need not be valid for the database settings to be read
+	content := "database:\n  path: \"${VERTIGO_TEST_DIR}/custom.db\"\nserver:\n  port: -1\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VERTIGO_TEST_DIR", dir)
+
+	cfg, err := LoadDatabase(path, true)
+	if err != nil {
+		t.Fatalf("LoadDatabase() error = %v", err)
+	}
+	if want := filepath.Join(dir, "custom.db"); cfg.Path != want {
+		t.Errorf("Path = %q, want %q", cfg.Path, want)
+	}
+
+	t.Setenv("VERTIGO_DATABASE_PATH", "/data/env.db")
+	if cfg, _ := LoadDatabase(path, true); cfg.Path != "/data/env.db" {
+		t.Errorf("Path = %q, want the VERTIGO_DATABASE_PATH override", cfg.Path)
+	}
+
+	missing := filepath.Join(dir, "missing.yaml")
+	if cfg, err := LoadDatabase(missing, false); err != nil || cfg.Path != "/data/env.db" {
+		t.Errorf("LoadDatabase() = %q, %v, want the environment without a file", cfg.Path, err)
+	}
+	if _, err := LoadDatabase(missing, true); err == nil {
+		t.Error("LoadDatabase() error = nil for a required file that does not exist")
+	}
+
+	os.Unsetenv("VERTIGO_DATABASE_PATH")
+	if cfg, _ := LoadDatabase(missing, false); cfg.Path != DefaultDatabasePath {
+		t.Errorf("Path = %q, want the default %q", cfg.Path, DefaultDatabasePath)
+	}
+}
+
+func TestLoadInterpolatesValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vertigo.yaml")
+	content := `server:
+  port: ${VERTIGO_TEST_PORT}
+  host: ${VERTIGO_TEST_HOST:-127.0.0.1}
+# ${VERTIGO_TEST_UNSET} is only mentioned in a comment
+gemini:
+  api_keys: ["${VERTIGO_TEST_KEY}"]
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VERTIGO_TEST_PORT", "8080")
+	// Characters that would change the meaning of the YAML text if pasted into it
+	key := "key: with # and\nnewline"
+	t.Setenv("VERTIGO_TEST_KEY", key)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Server.Port != 8080 || cfg.Server.Host != "127.0.0.1" {
+		t.Errorf("server = %+v, want port 8080 on the default host", cfg.Server)
+	}
+	if len(cfg.Gemini.APIKeys) != 1 || cfg.Gemini.APIKeys[0] != key {
+		t.Errorf("api_keys = %q, want [%q]", cfg.Gemini.APIKeys, key)
+	}
+
+	os.Unsetenv("VERTIGO_TEST_PORT")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "VERTIGO_TEST_PORT is not set") {
+		t.Errorf("Load() error = %v, want one about the unset VERTIGO_TEST_PORT", err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	cfg := &Config{Batch: BatchConfig{Enabled: true}}
+	if warnings := cfg.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "queue.enabled") {
+		t.Errorf("Warnings() = %q, want one about the queue", warnings)
+	}
+	cfg.Queue.Enabled = true
+	if warnings := cfg.Warnings(); len(warnings) != 0 {
+		t.Errorf("Warnings() = %q, want none", warnings)
+	}
+}
+
+func TestValidateGeminiKeysWithProviders(t *testing.T) {
+	cfg := &Config{}
+	cfg.applyDefaults()
+	cfg.Gemini.APIKeys = []string{"gemini-key"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v for gemini.api_keys alone", err)
+	}
+
+	cfg.Providers = []ProviderConfig{{Name: "openai", Type: "openai", APIKeys: []string{"openai-key"}}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "gemini.api_keys") {
+		t.Errorf("Validate() error = %v, want gemini.api_keys rejected next to providers", err)
+	}
+
+	cfg.Gemini.APIKeys = nil
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v for providers alone", err)
+	}
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of the environment variables that override configuration values.
+const EnvPrefix = "VERTIGO_"
+
+// envReference matches ${VAR} and ${VAR:-default}.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// decodeYAML parses a YAML document into v, first replacing the ${VAR} references in its values. Values
+// are replaced after parsing, so a variable holding a colon, a hash or a newline stays a single value,
+// and references in comments are left alone.
+func decodeYAML(data []byte, v interface{}) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		// An empty document
+		return nil
+	}
+	if err := interpolateNode(&doc); err != nil {
+		return err
+	}
+	return doc.Decode(v)
+}
+
+// interpolateNode replaces the ${VAR} references in the scalars of a YAML node and its children, and
+// reports every reference to an unset variable that has no default.
+func interpolateNode(node *yaml.Node) error {
+	var errs []error
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "${") {
+		value, err := interpolate(node.Value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", node.Line, err))
+		}
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				// Let the type of an unquoted value follow its new text, e.g. a port number
+				node.Tag = ""
+			}
+		}
+	}
+	for _, child := range node.Content {
+		if err := interpolateNode(child); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// interpolate replaces ${VAR} with the value of the environment variable VAR, and ${VAR:-default}
+// with default when VAR is unset or empty. A variable without a default must be set, though it may
+// be empty.
+func interpolate(text string) (string, error) {
+	var errs []error
+	result := envReference.ReplaceAllStringFunc(text, func(ref string) string {
+		m := envReference.FindStringSubmatch(ref)
+		value, ok := os.LookupEnv(m[1])
+		if value != "" {
+			return value
+		}
+		if strings.Contains(ref, ":-") {
+			return m[2]
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("environment variable %s is not set", m[1]))
+		}
+		return ""
+	})
+	return result, errors.Join(errs...)
+}
+
+// applyEnvOverrides sets configuration values from VERTIGO_* environment variables. A variable is named
+// after the YAML path of the value in upper case, e.g. VERTIGO_SERVER_PORT or VERTIGO_TIMEOUTS_STREAM_IDLE.
+// Values of providers are addressed by provider name, e.g. VERTIGO_PROVIDERS_OPENAI_API_KEYS. Lists are
+// comma-separated. Maps, such as models and virtual models, can only be set in the file.
+func applyEnvOverrides(cfg *Config) error {
+	if err := applyEnv(EnvPrefix, reflect.ValueOf(cfg).Elem()); err != nil {
+		return err
+	}
+	for i := range cfg.Providers {
+		prefix := EnvPrefix + "PROVIDERS_" + envName(cfg.Providers[i].Name) + "_"
+		if err := applyEnv(prefix, reflect.ValueOf(&cfg.Providers[i]).Elem()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEnv walks the fields of a struct and sets each scalar or string list field whose variable is set.
+func applyEnv(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + envName(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(name+"_", field); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setField parses value into a field of a supported kind. Fields of other kinds are left alone.
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(&b))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// envName turns a YAML key or provider name into the form used in variable names.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// loadKeyFiles appends the keys read from api_keys_file to the keys listed in the configuration.
+func (c *Config) loadKeyFiles() error {
+	keys, err := readKeyFile(c.Gemini.APIKeysFile)
+	if err != nil {
+		return err
+	}
+	c.Gemini.APIKeys = append(c.Gemini.APIKeys, keys...)
+	for i := range c.Providers {
+		keys, err := readKeyFile(c.Providers[i].APIKeysFile)
+		if err != nil {
+			return fmt.Errorf("provider %q: %w", c.Providers[i].Name, err)
+		}
+		c.Providers[i].APIKeys = append(c.Providers[i].APIKeys, keys...)
+	}
+	return nil
+}
+
+// readKeyFile reads one key per line, skipping blank lines and lines starting with "#".
+func readKeyFile(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key file: %w", err)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
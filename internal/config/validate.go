@@ -0,0 +1,205 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults for values that are needed before any component is created.
+const (
+	DefaultPort         = 1925
+	DefaultHost         = "0.0.0.0"
+	DefaultDatabasePath = "vertigo.db"
+)
+
+// applyDefaults fills in unset values. Components with their own defaults, such as the caches and
+// timeouts, keep applying them where they are used.
+func (c *Config) applyDefaults() {
+	if c.Server.Port == 0 {
+		c.Server.Port = DefaultPort
+	}
+	if c.Server.Host == "" {
+		c.Server.Host = DefaultHost
+	}
+	if c.Database.Path == "" {
+		c.Database.Path = DefaultDatabasePath
+	}
+}
+
+// Validate checks the configuration and reports every problem found, not just the first one.
+// It does not read credential files or contact upstream providers.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port %d is not a valid port", c.Server.Port)
+	check(c.Server.Host != "", "server.host is empty")
+	check(c.Database.Path != "", "database.path is empty")
+
+	if len(c.Providers) == 0 {
+		errs = append(errs, validateKeys("gemini.api_keys", c.Gemini.APIKeys)...)
+	} else {
+		// The keys would be silently unused
+		check(len(c.Gemini.APIKeys) == 0, "gemini.api_keys cannot be combined with providers; list the keys under a provider of type gemini")
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Providers {
+		field := fmt.Sprintf("providers[%d]", i)
+		check(p.Name != "", "%s has no name", field)
+		check(!names[p.Name], "%s: provider name %q is used more than once", field, p.Name)
+		names[p.Name] = true
+
+		switch p.Type {
+		case "", "gemini", "openai":
+			if p.Auth != "none" {
+				errs = append(errs, validateKeys(field+".api_keys", p.APIKeys)...)
+			}
+		case "vertex":
+			check(len(p.CredentialsFiles) > 0, "%s.credentials_files is empty", field)
+			check(p.BaseURL != "" || (p.Project != "" && p.Region != ""), "%s needs a project and region, or a base_url", field)
+		default:
+			check(false, "%s.type %q is not one of gemini, vertex, openai", field, p.Type)
+		}
+		switch p.Auth {
+		case "", "bearer", "none":
+		case "header":
+			check(p.AuthHeader != "", "%s uses header auth but sets no auth_header", field)
+		default:
+			check(false, "%s.auth %q is not one of bearer, header, none", field, p.Auth)
+		}
+	}
+
+	for _, name := range sortedKeys(c.Routing.VirtualModels) {
+		vm := c.Routing.VirtualModels[name]
+		field := "routing.virtual_models." + name
+		check(vm.Default != "" || vm.Auto.Enabled, "%s has no default model", field)
+		for i, rule := range vm.Rules {
+			check(rule.Model != "", "%s.rules[%d] has no model", field, i)
+		}
+		for i, tier := range vm.Auto.Tiers {
+			check(tier.Model != "", "%s.auto.tiers[%d] has no model", field, i)
+		}
+	}
+	for _, name := range sortedKeys(c.Models) {
+		for i, fallback := range c.Models[name].Fallbacks {
+			check(fallback != "" && fallback != name, "models.%s.fallbacks[%d] must name another model", name, i)
+		}
+		check(c.Models[name].MaxConcurrency >= 0, "models.%s.max_concurrency must not be negative", name)
+		check(c.Models[name].Timeouts.Connect >= 0, "models.%s.timeouts.connect must not be negative", name)
+	}
+
+	switch c.Cache.Backend {
+	case "", "memory", "sqlite":
+	default:
+		check(false, "cache.backend %q is not one of memory, sqlite", c.Cache.Backend)
+	}
+	check(c.Cache.Semantic.Threshold >= 0 && c.Cache.Semantic.Threshold <= 1, "cache.semantic.threshold must be between 0 and 1")
+	check(c.Cache.Semantic.MaxCandidates >= 0, "cache.semantic.max_candidates must not be negative")
+	if c.Tracing.Enabled {
+		switch c.Tracing.Exporter {
+		case "", "otlp", "stdout":
+		case "file":
+			check(c.Tracing.File != "", "tracing.file is required by the file exporter")
+		default:
+			check(false, "tracing.exporter %q is not one of otlp, stdout, file", c.Tracing.Exporter)
+		}
+		check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if c.Admin.Enabled {
+		check(len(c.Admin.Tokens) > 0, "admin.tokens is empty")
+		for i, token := range c.Admin.Tokens {
+			check(len(token) >= 16, "admin.tokens[%d] is shorter than 16 characters", i)
+		}
+	}
+
+	check(c.CircuitBreaker.FailureThreshold >= 0, "circuit_breaker.failure_threshold must not be negative")
+	check(c.CircuitBreaker.HalfOpenRequests >= 0, "circuit_breaker.half_open_requests must not be negative")
+
+	check(c.Queue.MaxSize >= 0, "queue.max_size must not be negative")
+	check(c.Queue.DefaultPriority == "" || validPriority(c.Queue.DefaultPriority),
+		"queue.default_priority %q is not one of interactive, batch", c.Queue.DefaultPriority)
+	for _, client := range sortedKeys(c.Queue.Clients) {
+		priority := c.Queue.Clients[client]
+		check(validPriority(priority), "queue.clients.%s %q is not one of interactive, batch", client, priority)
+	}
+
+	check(c.Batch.Concurrency >= 0, "batch.concurrency must not be negative")
+	check(c.Batch.MaxFileSizeMB >= 0, "batch.max_file_size_mb must not be negative")
+
+	durations := []struct {
+		field string
+		value time.Duration
+	}{
+		{"cache.ttl", c.Cache.TTL},
+		{"cache.semantic.ttl", c.Cache.Semantic.TTL},
+		{"context_cache.ttl", c.ContextCache.TTL},
+		{"timeouts.connect", c.Timeouts.Connect},
+		{"timeouts.stream.first_byte", c.Timeouts.Stream.FirstByte},
+		{"timeouts.stream.idle", c.Timeouts.Stream.Idle},
+		{"timeouts.stream.total", c.Timeouts.Stream.Total},
+		{"timeouts.non_stream.first_byte", c.Timeouts.NonStream.FirstByte},
+		{"timeouts.non_stream.idle", c.Timeouts.NonStream.Idle},
+		{"timeouts.non_stream.total", c.Timeouts.NonStream.Total},
+		{"reload.interval", c.Reload.Interval},
+		{"health_check.interval", c.HealthCheck.Interval},
+		{"health_check.idle_after", c.HealthCheck.IdleAfter},
+		{"circuit_breaker.open_duration", c.CircuitBreaker.OpenDuration},
+		{"hedging.delay", c.Hedging.Delay},
+		{"queue.timeout", c.Queue.Timeout},
+		{"batch.poll_interval", c.Batch.PollInterval},
+	}
+	for _, d := range durations {
+		check(d.value >= 0, "%s must not be negative", d.field)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Warnings reports settings that are valid but probably not what was meant.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.Batch.Enabled && !c.Queue.Enabled {
+		warnings = append(warnings, "batch.enabled is set but queue.enabled is not, so batch requests are not held back for interactive ones")
+	}
+	return warnings
+}
+
+// validateKeys reports a missing key list and keys that are empty or still the placeholders
+// from the example configuration.
+func validateKeys(field string, keys []string) []error {
+	if len(keys) == 0 {
+		return []error{fmt.Errorf("%s is empty", field)}
+	}
+	var errs []error
+	for i, key := range keys {
+		switch {
+		case strings.TrimSpace(key) == "":
+			errs = append(errs, fmt.Errorf("%s[%d] is empty", field, i))
+		case strings.HasPrefix(key, "YOUR_"):
+			errs = append(errs, fmt.Errorf("%s[%d] is a placeholder, not an API key", field, i))
+		}
+	}
+	return errs
+}
+
+func validPriority(priority string) bool {
+	return priority == PriorityInteractive || priority == PriorityBatch
+}
+
+// sortedKeys returns the keys of a map in order, so that problems are reported in a stable order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often a watched configuration file is checked for changes.
+const DefaultWatchInterval = 5 * time.Second
+
+// Watch calls reload with the trigger ("signal" or "file") whenever the process receives SIGHUP and,
+// if cfg.Watch is set, whenever the modification time or size of the file at path changes. The file is
+// polled rather than watched through inotify so that editors that replace the file, and bind-mounted
+// files such as Kubernetes ConfigMaps, are handled alike. Watch returns when ctx is done.
+func Watch(ctx context.Context, path string, cfg ReloadConfig, reload func(trigger string)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if cfg.Watch {
+		interval := cfg.Interval
+		if interval <= 0 {
+			interval = DefaultWatchInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last, _ := os.Stat(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last, _ = os.Stat(path)
+			reload("signal")
+		case <-tick:
+			info, err := os.Stat(path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+			reload("file")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vertigo.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  port: 1925\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	triggers := make(chan string, 10)
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, path, ReloadConfig{Watch: true, Interval: 10 * time.Millisecond}, func(trigger string) {
+			triggers <- trigger
+		})
+		close(done)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case trigger := <-triggers:
+			return trigger
+		case <-time.After(time.Second):
+			t.Fatal("no reload")
+			return ""
+		}
+	}
+
+	// An unchanged file triggers nothing
+	time.Sleep(50 * time.Millisecond)
+	if len(triggers) != 0 {
+		t.Fatalf("%d reloads of an unchanged file", len(triggers))
+	}
+
+	if err := os.WriteFile(path, []byte("server:\n  port: 8080\n  host: localhost\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if trigger := next(); trigger != "file" {
+		t.Errorf("trigger = %q, want file", trigger)
+	}
+
+	// Watch has registered for SIGHUP by the time it polled the file
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if trigger := next(); trigger != "signal" {
+		t.Errorf("trigger = %q, want signal", trigger)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch() kept running after its context was cancelled")
+	}
+}
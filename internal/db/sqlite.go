@@ -33,6 +33,98 @@ func InitDB(dataSourceName string) (*sql.DB, error) {
 		timestamp INTEGER NOT NULL,
 		FOREIGN KEY (conversation_id) REFERENCES conversations(id)
 	);
+	CREATE TABLE IF NOT EXISTS response_cache (
+		key TEXT PRIMARY KEY,
+		model TEXT NOT NULL,
+		body BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS semantic_cache (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client TEXT NOT NULL,
+		model TEXT NOT NULL,
+		context TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		embedding BLOB NOT NULL,
+		response_model TEXT NOT NULL,
+		body BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_semantic_cache_context ON semantic_cache (client, model, context, id);
+	CREATE TABLE IF NOT EXISTS usage (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		model TEXT NOT NULL,
+		key_id TEXT NOT NULL,
+		client TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		stream INTEGER NOT NULL,
+		prompt_tokens INTEGER NOT NULL,
+		completion_tokens INTEGER NOT NULL,
+		cached_tokens INTEGER NOT NULL,
+		latency_ms INTEGER NOT NULL,
+		status INTEGER NOT NULL,
+		cache_status TEXT NOT NULL,
+		hedge TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_usage_timestamp ON usage (timestamp);
+	CREATE TABLE IF NOT EXISTS model_prices (
+		model TEXT PRIMARY KEY,
+		input REAL NOT NULL,
+		cached_input REAL NOT NULL,
+		output REAL NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS key_overrides (
+		provider TEXT NOT NULL,
+		key TEXT NOT NULL,
+		action TEXT NOT NULL,
+		disabled INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (provider, key)
+	);
+	CREATE TABLE IF NOT EXISTS files (
+		id TEXT PRIMARY KEY,
+		purpose TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		bytes INTEGER NOT NULL,
+		content BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		client TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS batches (
+		id TEXT PRIMARY KEY,
+		endpoint TEXT NOT NULL,
+		errors TEXT NOT NULL,
+		input_file_id TEXT NOT NULL,
+		completion_window TEXT NOT NULL,
+		status TEXT NOT NULL,
+		output_file_id TEXT NOT NULL,
+		error_file_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		in_progress_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		finalizing_at INTEGER NOT NULL,
+		completed_at INTEGER NOT NULL,
+		failed_at INTEGER NOT NULL,
+		expired_at INTEGER NOT NULL,
+		cancelling_at INTEGER NOT NULL,
+		cancelled_at INTEGER NOT NULL,
+		total INTEGER NOT NULL,
+		completed INTEGER NOT NULL,
+		failed INTEGER NOT NULL,
+		metadata TEXT NOT NULL,
+		client TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_batches_status ON batches (status);
+	CREATE TABLE IF NOT EXISTS batch_results (
+		batch_id TEXT NOT NULL,
+		line INTEGER NOT NULL,
+		failed INTEGER NOT NULL,
+		output BLOB NOT NULL,
+		PRIMARY KEY (batch_id, line)
+	);
 	`
 
 	_, err = db.Exec(sqlStmt)
@@ -2,41 +2,161 @@ package gemini
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
-const ( 
-	GeminiAPIURL = "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"
+// DefaultBaseURL is Gemini's OpenAI-compatible API. Chat completions and embeddings are served below it,
+// while context caches use the native API one level up, since they have no OpenAI-compatible equivalent.
+const DefaultBaseURL = "https://generativelanguage.googleapis.com/v1beta/openai"
+
+// Ways of authenticating upstream requests with an API key.
+const (
+	// AuthBearer sends the key as "Authorization: Bearer <key>". It is the default.
+	AuthBearer = "bearer"
+	// AuthHeader sends the key in the header named by Client.AuthHeader, e.g. "api-key".
+	AuthHeader = "header"
+	// AuthNone sends no credentials, for local servers.
+	AuthNone = "none"
+	// AuthServiceAccount treats each key as a service account and sends an OAuth access token
+	// from the key's entry in Client.TokenSources.
+	AuthServiceAccount = "service_account"
 )
 
-// Client for interacting with the Gemini API.
+// APIError is returned when the Gemini API responds with a non-200 status.
+type APIError struct {
+	StatusCode int
+	Body       []byte
+	// RetryAfter is how long upstream asked us to wait, from the Retry-After header or the
+	// RetryInfo error detail. It is zero when upstream gave no hint.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Gemini API returned non-200 status: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// Message returns the error message reported by upstream, or an empty string if the body has none.
+// Gemini wraps errors as {"error": {...}}, and the OpenAI-compatible endpoint sometimes as a list of those.
+func (e *APIError) Message() string {
+	detail := e.detail()
+	if detail == nil {
+		return ""
+	}
+	return detail.Message
+}
+
+type errorDetail struct {
+	Message string `json:"message"`
+	Details []struct {
+		Type       string `json:"@type"`
+		RetryDelay string `json:"retryDelay"`
+	} `json:"details"`
+}
+
+type errorBody struct {
+	Error *errorDetail `json:"error"`
+}
+
+func (e *APIError) detail() *errorDetail {
+	var body errorBody
+	if err := json.Unmarshal(e.Body, &body); err == nil && body.Error != nil {
+		return body.Error
+	}
+	var list []errorBody
+	if err := json.Unmarshal(e.Body, &list); err == nil && len(list) > 0 && list[0].Error != nil {
+		return list[0].Error
+	}
+	return nil
+}
+
+// newAPIError builds the APIError for a non-200 upstream response.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Body: body}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	} else if detail := apiErr.detail(); detail != nil {
+		for _, d := range detail.Details {
+			if delay, err := time.ParseDuration(d.RetryDelay); err == nil && delay > 0 {
+				apiErr.RetryAfter = delay
+				break
+			}
+		}
+	}
+	return apiErr
+}
+
+// Client for interacting with the Gemini API, or any other OpenAI-compatible API at BaseURL.
 type Client struct {
 	HTTPClient *http.Client
-	Log        *logrus.Logger
+	BaseURL    string
+	// Auth is one of AuthBearer, AuthHeader, AuthNone or AuthServiceAccount; empty means AuthBearer.
+	Auth         string
+	AuthHeader   string
+	TokenSources map[string]*TokenSource
+	Log          *logrus.Logger
 }
 
-// NewClient creates a new Gemini API client.
-func NewClient(logger *logrus.Logger) *Client {
+// NewClient creates a new API client for baseURL, or Gemini's API if it is empty. The HTTP client has no
+// overall timeout, since that would cut off long streams; requests are bounded by their Timeouts instead,
+// and connecting by connectTimeout.
+func NewClient(baseURL string, connectTimeout time.Duration, logger *logrus.Logger) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
 	return &Client{
 		HTTPClient: &http.Client{
-			Timeout: 60 * time.Second,
+			Transport: newTransport(connectTimeout),
 		},
-		Log: logger,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Log:     logger,
+	}
+}
+
+// WithConnectTimeout returns a copy of the client with its own connections, established within
+// connectTimeout. It shares the client's credentials.
+func (c *Client) WithConnectTimeout(connectTimeout time.Duration) *Client {
+	clone := *c
+	clone.HTTPClient = &http.Client{Transport: newTransport(connectTimeout)}
+	return &clone
+}
+
+// newTransport creates an HTTP transport that connects, including the TLS handshake, within connectTimeout.
+func newTransport(connectTimeout time.Duration) *http.Transport {
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	return transport
 }
 
-// ChatCompletions sends a chat completions request to the Gemini API.
-func (c *Client) ChatCompletions(apiKey string, requestBody []byte, stream bool) (io.ReadCloser, error) {
+// CloseIdleConnections closes the client's idle connections. Requests in flight are not affected.
+func (c *Client) CloseIdleConnections() {
+	c.HTTPClient.CloseIdleConnections()
+}
+
+// ChatCompletions sends a chat completions request to the Gemini API, bounded by timeouts.
+// A streamed body stays subject to the idle and total timeouts until it is closed.
+func (c *Client) ChatCompletions(ctx context.Context, apiKey string, requestBody []byte, stream bool, timeouts Timeouts) (io.ReadCloser, error) {
 	c.Log.Debugf("Gemini API Request (stream=%t): %s", stream, requestBody)
 
-	req, err := http.NewRequest("POST", GeminiAPIURL, bytes.NewBuffer(requestBody))
+	timer := startTimer(ctx, timeouts)
+	req, err := http.NewRequestWithContext(timer.ctx, "POST", c.BaseURL+"/chat/completions", bytes.NewBuffer(requestBody))
 	if err != nil {
+		timer.stop()
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
@@ -44,11 +164,13 @@ func (c *Client) ChatCompletions(apiKey string, requestBody []byte, stream bool)
 		// Modify the request body to include the stream parameter
 		var reqMap map[string]interface{}
 		if err := json.Unmarshal(requestBody, &reqMap); err != nil {
+			timer.stop()
 			return nil, fmt.Errorf("failed to unmarshal request body for streaming: %w", err)
 		}
 		reqMap["stream"] = true
 		modifiedBody, err := json.Marshal(reqMap)
 		if err != nil {
+			timer.stop()
 			return nil, fmt.Errorf("failed to marshal modified request body for streaming: %w", err)
 		}
 		req.Body = io.NopCloser(bytes.NewBuffer(modifiedBody))
@@ -56,34 +178,175 @@ func (c *Client) ChatCompletions(apiKey string, requestBody []byte, stream bool)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if err := c.authorize(req, apiKey); err != nil {
+		timer.stop()
+		return nil, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
+		err = timer.err(err)
+		timer.stop()
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
 	c.Log.Debugf("Gemini API Response Status: %d", resp.StatusCode)
+	body := &timedBody{ReadCloser: resp.Body, timer: timer}
 
 	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		respBody, _ := io.ReadAll(body)
+		body.Close()
 		c.Log.Errorf("Gemini API Error Response Body: %s", respBody)
-		return nil, fmt.Errorf("Gemini API returned non-200 status: %d, body: %s", resp.StatusCode, respBody)
+		return nil, newAPIError(resp, respBody)
 	}
 
 	// If not streaming, read the entire body and return a new reader
 	if !stream {
-		respBody, err := io.ReadAll(resp.Body)
+		respBody, err := io.ReadAll(body)
+		body.Close()
 		if err != nil {
-			resp.Body.Close()
 			return nil, fmt.Errorf("failed to read response body: %w", err)
 		}
-		resp.Body.Close()
 		c.Log.Debugf("Gemini API Full Response Body (non-stream): %s", respBody)
 		return io.NopCloser(bytes.NewBuffer(respBody)), nil
 	}
 
-	// For streaming, return the original response body reader
-	return resp.Body, nil
+	// For streaming, return the response body reader, which keeps the timeouts running until it is closed
+	return body, nil
+}
+
+// authorize adds the API key to a request according to the client's auth style.
+func (c *Client) authorize(req *http.Request, apiKey string) error {
+	switch c.Auth {
+	case AuthNone:
+	case AuthHeader:
+		req.Header.Set(c.AuthHeader, apiKey)
+	case AuthServiceAccount:
+		ts, ok := c.TokenSources[apiKey]
+		if !ok {
+			return fmt.Errorf("no service account loaded for key")
+		}
+		token, err := ts.Token(req.Context())
+		if err != nil {
+			return fmt.Errorf("failed to authenticate with service account: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	return nil
+}
+
+// do sends a request that is read in full by the caller, bounded by DefaultTimeouts.
+func (c *Client) do(req *http.Request) ([]byte, *http.Response, error) {
+	timer := startTimer(req.Context(), DefaultTimeouts)
+	defer timer.stop()
+
+	resp, err := c.HTTPClient.Do(req.WithContext(timer.ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %w", timer.err(err))
+	}
+	body := &timedBody{ReadCloser: resp.Body, timer: timer}
+	defer body.Close()
+
+	respBody, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return respBody, resp, nil
+}
+
+// Embeddings sends an embeddings request to the Gemini API and returns the embedding of the input.
+func (c *Client) Embeddings(ctx context.Context, apiKey, model, input string) ([]float32, error) {
+	requestBody, err := json.Marshal(EmbeddingRequest{Model: model, Input: input})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embeddings request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/embeddings", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := c.authorize(req, apiKey); err != nil {
+		return nil, err
+	}
+
+	respBody, resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Log.Errorf("Gemini API Error Response Body: %s", respBody)
+		return nil, newAPIError(resp, respBody)
+	}
+
+	var embeddingResp EmbeddingResponse
+	if err := json.Unmarshal(respBody, &embeddingResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal embeddings response: %w", err)
+	}
+	if len(embeddingResp.Data) == 0 {
+		return nil, fmt.Errorf("embeddings response contained no data")
+	}
+	return embeddingResp.Data[0].Embedding, nil
+}
+
+// CreateCachedContent creates a Gemini context cache holding a system instruction for the given model.
+// The cache can only be referenced by requests made with the same API key.
+func (c *Client) CreateCachedContent(ctx context.Context, apiKey, model, systemInstruction string, ttl time.Duration) (*CachedContent, error) {
+	cacheReq := CachedContentRequest{
+		Model: "models/" + model,
+		TTL:   fmt.Sprintf("%ds", int(ttl.Seconds())),
+	}
+	cacheReq.SystemInstruction.Parts = []ChatPart{{Text: systemInstruction}}
+
+	requestBody, err := json.Marshal(cacheReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cached content request: %w", err)
+	}
+
+	nativeURL := strings.TrimSuffix(c.BaseURL, "/openai") + "/cachedContents"
+	req, err := http.NewRequestWithContext(ctx, "POST", nativeURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", apiKey)
+
+	respBody, resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Log.Errorf("Gemini API Error Response Body: %s", respBody)
+		return nil, newAPIError(resp, respBody)
+	}
+
+	var cachedContent CachedContent
+	if err := json.Unmarshal(respBody, &cachedContent); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cached content response: %w", err)
+	}
+	return &cachedContent, nil
+}
+
+// ListModels requests the models list with an API key. It is the cheapest authenticated call, used to
+// check whether a key works; the list itself is discarded.
+func (c *Client) ListModels(ctx context.Context, apiKey string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/models", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := c.authorize(req, apiKey); err != nil {
+		return err
+	}
+
+	respBody, resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newAPIError(resp, respBody)
+	}
+	return nil
 }
@@ -0,0 +1,227 @@
+package gemini
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloudPlatformScope is the OAuth scope requested for Vertex AI.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// DefaultTokenURL is Google's OAuth token endpoint, used when the service account file names none.
+const DefaultTokenURL = "https://oauth2.googleapis.com/token"
+
+// tokenRefreshMargin is how long before expiry a cached access token is replaced.
+const tokenRefreshMargin = 5 * time.Minute
+
+// tokenRequestTimeout bounds a token exchange.
+const tokenRequestTimeout = 30 * time.Second
+
+// ServiceAccount holds the fields of a Google service account JSON key file that are needed to sign JWTs.
+type ServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// TokenSource exchanges signed JWTs for OAuth access tokens on behalf of a service account
+// and caches each token until shortly before it expires.
+type TokenSource struct {
+	account    ServiceAccount
+	key        *rsa.PrivateKey
+	tokenURL   string
+	httpClient *http.Client
+
+	// mutex guards the cached token and the exchange in flight; it is never held during an exchange.
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+	fetch   *tokenFetch
+}
+
+// tokenFetch is a token exchange in flight, shared by every caller that needs its result.
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// NewTokenSource reads a service account JSON key file. tokenURL overrides the file's token_uri if set.
+func NewTokenSource(path, tokenURL string, httpClient *http.Client) (*TokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account file: %w", err)
+	}
+	var account ServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse service account file %s: %w", path, err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, fmt.Errorf("service account file %s has no client_email or private_key", path)
+	}
+
+	key, err := parsePrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", path, err)
+	}
+
+	if tokenURL == "" {
+		tokenURL = account.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	return &TokenSource{account: account, key: key, tokenURL: tokenURL, httpClient: httpClient}, nil
+}
+
+// Token returns a valid access token. A token about to expire is still returned while its replacement
+// is fetched in the background; without a valid token, Token waits for the exchange until ctx is done.
+// Concurrent callers share a single exchange, and none of them holds up the others.
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mutex.Lock()
+	now := time.Now()
+	valid := ts.token != "" && now.Before(ts.expires)
+	if valid && ts.expires.Sub(now) > tokenRefreshMargin {
+		token := ts.token
+		ts.mutex.Unlock()
+		return token, nil
+	}
+	fetch := ts.fetch
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		ts.fetch = fetch
+		// The exchange serves every caller, so it must not be canceled with the one that started it
+		go ts.refresh(context.WithoutCancel(ctx), fetch)
+	}
+	if valid {
+		token := ts.token
+		ts.mutex.Unlock()
+		return token, nil
+	}
+	ts.mutex.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.token, fetch.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// refresh runs a token exchange, caches its token and hands the result to the callers waiting for it.
+func (ts *TokenSource) refresh(ctx context.Context, fetch *tokenFetch) {
+	token, expires, err := ts.exchange(ctx)
+
+	ts.mutex.Lock()
+	if err == nil {
+		ts.token, ts.expires = token, expires
+	}
+	ts.fetch = nil
+	ts.mutex.Unlock()
+
+	fetch.token, fetch.err = token, err
+	close(fetch.done)
+}
+
+// exchange trades a signed JWT for an access token and returns the token with its expiry time.
+func (ts *TokenSource) exchange(ctx context.Context) (string, time.Time, error) {
+	assertion, err := ts.signJWT(time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, tokenRequestTimeout)
+	defer cancel()
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to fetch access token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body of a failed exchange describes the problem without echoing credentials
+		return "", time.Time{}, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token response contained no access token")
+	}
+	return tokenResp.AccessToken, time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second), nil
+}
+
+// signJWT creates the RS256-signed assertion exchanged for an access token.
+func (ts *TokenSource) signJWT(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": ts.account.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   ts.account.ClientEmail,
+		"scope": CloudPlatformScope,
+		"aud":   ts.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parsePrivateKey decodes a PEM-encoded RSA key in PKCS#8 or PKCS#1 form.
+func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -0,0 +1,340 @@
+package gemini
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testClientEmail = "vertigo@example.iam.gserviceaccount.com"
+
+// testKey is shared by the tests, since generating an RSA key is slow.
+var testKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// tokenServer is a fake OAuth token endpoint. respond decides the response to the n-th exchange,
+// counted from 1; the assertion of every exchange is checked.
+type tokenServer struct {
+	*httptest.Server
+	t         *testing.T
+	exchanges atomic.Int32
+	respond   func(n int, w http.ResponseWriter, r *http.Request)
+}
+
+func newTokenServer(t *testing.T, respond func(n int, w http.ResponseWriter, r *http.Request)) *tokenServer {
+	ts := &tokenServer{t: t, respond: respond}
+	ts.Server = httptest.NewServer(http.HandlerFunc(ts.handle))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (s *tokenServer) handle(w http.ResponseWriter, r *http.Request) {
+	n := int(s.exchanges.Add(1))
+	if err := r.ParseForm(); err != nil {
+		s.t.Errorf("invalid token request: %v", err)
+	}
+	if grant := r.PostForm.Get("grant_type"); grant != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		s.t.Errorf("grant_type = %q", grant)
+	}
+	if err := verifyAssertion(r.PostForm.Get("assertion"), s.URL); err != nil {
+		s.t.Errorf("invalid assertion: %v", err)
+	}
+	s.respond(n, w, r)
+}
+
+// respondToken answers an exchange with an access token valid for expiresIn.
+func respondToken(w http.ResponseWriter, token string, expiresIn time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"expires_in":   int(expiresIn.Seconds()),
+		"token_type":   "Bearer",
+	})
+}
+
+// verifyAssertion checks the RS256 signature and the claims of a JWT assertion.
+func verifyAssertion(assertion, audience string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("assertion has %d parts, want 3", len(parts))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&testKey().PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("signature does not verify: %w", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" || header.Typ != "JWT" || header.Kid != "key-1" {
+		return fmt.Errorf("header = %+v", header)
+	}
+
+	var claims struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	switch {
+	case claims.Iss != testClientEmail:
+		return fmt.Errorf("iss = %q", claims.Iss)
+	case claims.Scope != CloudPlatformScope:
+		return fmt.Errorf("scope = %q", claims.Scope)
+	case claims.Aud != audience:
+		return fmt.Errorf("aud = %q, want %q", claims.Aud, audience)
+	case claims.Iat > now || claims.Iat < now-60:
+		return fmt.Errorf("iat = %d, want about %d", claims.Iat, now)
+	case claims.Exp != claims.Iat+3600:
+		return fmt.Errorf("exp = %d, want an hour after iat", claims.Exp)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("invalid segment encoding: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// newTestTokenSource writes a service account file for testKey and reads it back, exchanging tokens at tokenURL.
+func newTestTokenSource(t *testing.T, tokenURL string) *TokenSource {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(testKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(ServiceAccount{
+		ClientEmail:  testClientEmail,
+		PrivateKeyID: "key-1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     "https://oauth2.invalid/token",
+	})
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(path, account, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := NewTokenSource(path, tokenURL, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("NewTokenSource() error = %v", err)
+	}
+	return ts
+}
+
+func TestTokenSourceExchangesSignedJWT(t *testing.T) {
+	server := newTokenServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		respondToken(w, "token-1", time.Hour)
+	})
+	ts := newTestTokenSource(t, server.URL)
+
+	token, err := ts.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if token != "token-1" {
+		t.Errorf("Token() = %q, want token-1", token)
+	}
+}
+
+func TestTokenSourceUsesTokenURIFromFile(t *testing.T) {
+	ts := newTestTokenSource(t, "")
+	if ts.tokenURL != "https://oauth2.invalid/token" {
+		t.Errorf("tokenURL = %q, want the token_uri of the file", ts.tokenURL)
+	}
+}
+
+func TestTokenSourceCachesTokens(t *testing.T) {
+	server := newTokenServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		respondToken(w, fmt.Sprintf("token-%d", n), time.Hour)
+	})
+	ts := newTestTokenSource(t, server.URL)
+
+	for i := 0; i < 3; i++ {
+		if token, err := ts.Token(context.Background()); err != nil || token != "token-1" {
+			t.Fatalf("Token() = %q, %v, want the cached token-1", token, err)
+		}
+	}
+	if n := server.exchanges.Load(); n != 1 {
+		t.Errorf("made %d exchanges, want 1", n)
+	}
+}
+
+func TestTokenSourceRefreshesWithinMargin(t *testing.T) {
+	server := newTokenServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		// The first token expires within the refresh margin
+		expiresIn := time.Hour
+		if n == 1 {
+			expiresIn = tokenRefreshMargin - time.Minute
+		}
+		respondToken(w, fmt.Sprintf("token-%d", n), expiresIn)
+	})
+	ts := newTestTokenSource(t, server.URL)
+
+	if token, _ := ts.Token(context.Background()); token != "token-1" {
+		t.Fatalf("Token() = %q, want token-1", token)
+	}
+	// Still valid, so it is returned while its replacement is fetched
+	if token, _ := ts.Token(context.Background()); token != "token-1" {
+		t.Fatalf("Token() = %q, want token-1 until it is replaced", token)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		token, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token == "token-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the token was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.exchanges.Load(); n != 2 {
+		t.Errorf("made %d exchanges, want 2", n)
+	}
+}
+
+func TestTokenSourceReplacesExpiredTokens(t *testing.T) {
+	server := newTokenServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		respondToken(w, fmt.Sprintf("token-%d", n), 0)
+	})
+	ts := newTestTokenSource(t, server.URL)
+
+	for want := 1; want <= 2; want++ {
+		token, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != fmt.Sprintf("token-%d", want) {
+			t.Errorf("Token() = %q, want token-%d", token, want)
+		}
+	}
+}
+
+func TestTokenSourceErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+		want    string
+	}{
+		{
+			name: "non-200 status",
+			respond: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			},
+			want: "status 400: {\"error\":\"invalid_grant\"}",
+		},
+		{
+			name:    "empty token",
+			respond: func(w http.ResponseWriter) { respondToken(w, "", time.Hour) },
+			want:    "no access token",
+		},
+		{
+			name:    "invalid JSON",
+			respond: func(w http.ResponseWriter) { fmt.Fprint(w, "not json") },
+			want:    "failed to parse token response",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTokenServer(t, func(n int, w http.ResponseWriter, r *http.Request) { tt.respond(w) })
+			ts := newTestTokenSource(t, server.URL)
+
+			_, err := ts.Token(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Token() error = %v, want it to mention %q", err, tt.want)
+			}
+			// A failed exchange is not cached
+			ts.Token(context.Background())
+			if n := server.exchanges.Load(); n != 2 {
+				t.Errorf("made %d exchanges, want a retry after the failure", n)
+			}
+		})
+	}
+}
+
+func TestTokenSourceSlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	server := newTokenServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		<-release
+		respondToken(w, "token-1", time.Hour)
+	})
+	ts := newTestTokenSource(t, server.URL)
+
+	// Callers give up when their context is done rather than waiting for the exchange
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ts.Token(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Token() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Token() returned after %s, want about 50ms", elapsed)
+	}
+
+	// Callers waiting at the same time share the exchange, which outlives the caller that started it
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], _ = ts.Token(context.Background())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("caller %d got %q, want token-1", i, token)
+		}
+	}
+	if n := server.exchanges.Load(); n != 1 {
+		t.Errorf("made %d exchanges, want 1", n)
+	}
+}
@@ -0,0 +1,129 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// DefaultConnectTimeout bounds establishing a connection, including the TLS handshake.
+const DefaultConnectTimeout = 10 * time.Second
+
+// Default timeouts for streaming and non-streaming requests. A non-streaming response only starts
+// once the whole completion has been generated, so its first byte can take as long as the request.
+var (
+	DefaultStreamTimeouts = Timeouts{FirstByte: 2 * time.Minute, Idle: time.Minute, Total: 15 * time.Minute}
+	DefaultTimeouts       = Timeouts{FirstByte: 5 * time.Minute, Idle: time.Minute, Total: 5 * time.Minute}
+)
+
+// Timeouts bounds a single upstream request. A zero value disables the corresponding limit.
+type Timeouts struct {
+	// FirstByte limits the wait for the first byte of the response body.
+	FirstByte time.Duration
+	// Idle limits the gap between two chunks of the response body once it has started.
+	Idle time.Duration
+	// Total limits the whole request, including reading the body.
+	Total time.Duration
+}
+
+// TimeoutError is returned when an upstream request exceeds one of its timeouts.
+type TimeoutError struct {
+	// Phase is "first byte", "idle" or "total".
+	Phase string
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %s", e.Phase, e.Limit)
+}
+
+// Timeout reports true, so TimeoutError satisfies net.Error-style timeout checks.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// requestTimer enforces Timeouts on a request by canceling its context with a TimeoutError as the cause.
+// Unlike http.Client.Timeout, it does not cut off a stream that keeps making progress.
+type requestTimer struct {
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	idle      time.Duration
+	total     *time.Timer
+	firstByte *time.Timer
+	idleTimer *time.Timer
+	started   bool
+}
+
+// startTimer derives the context for a request and starts its total and first byte timers.
+func startTimer(parent context.Context, t Timeouts) *requestTimer {
+	ctx, cancel := context.WithCancelCause(parent)
+	rt := &requestTimer{ctx: ctx, cancel: cancel, idle: t.Idle}
+	if t.Total > 0 {
+		rt.total = time.AfterFunc(t.Total, func() { cancel(&TimeoutError{Phase: "total", Limit: t.Total}) })
+	}
+	if t.FirstByte > 0 {
+		rt.firstByte = time.AfterFunc(t.FirstByte, func() { cancel(&TimeoutError{Phase: "first byte", Limit: t.FirstByte}) })
+	}
+	return rt
+}
+
+// progress records that response data arrived, switching from the first byte timer to the idle timer.
+func (rt *requestTimer) progress() {
+	if !rt.started {
+		rt.started = true
+		if rt.firstByte != nil {
+			rt.firstByte.Stop()
+		}
+		if rt.idle > 0 {
+			idle := rt.idle
+			rt.idleTimer = time.AfterFunc(idle, func() { rt.cancel(&TimeoutError{Phase: "idle", Limit: idle}) })
+		}
+		return
+	}
+	if rt.idleTimer != nil {
+		rt.idleTimer.Reset(rt.idle)
+	}
+}
+
+// stop releases the timers and the request context.
+func (rt *requestTimer) stop() {
+	for _, t := range []*time.Timer{rt.total, rt.firstByte, rt.idleTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	rt.cancel(nil)
+}
+
+// err replaces the error of a request canceled by one of its timers with the TimeoutError that caused it.
+func (rt *requestTimer) err(err error) error {
+	var timeoutErr *TimeoutError
+	if errors.As(context.Cause(rt.ctx), &timeoutErr) {
+		return timeoutErr
+	}
+	return err
+}
+
+// timedBody is a response body that feeds its requestTimer and stops it when closed.
+type timedBody struct {
+	io.ReadCloser
+	timer *requestTimer
+}
+
+func (tb *timedBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if n > 0 {
+		tb.timer.progress()
+	}
+	if err != nil && err != io.EOF {
+		err = tb.timer.err(err)
+	}
+	return n, err
+}
+
+func (tb *timedBody) Close() error {
+	tb.timer.stop()
+	return tb.ReadCloser.Close()
+}
@@ -0,0 +1,193 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// chunkInterval is how often the fake server sends a chunk of a stream that makes progress.
+const chunkInterval = 20 * time.Millisecond
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewClient(server.URL, 0, logger)
+}
+
+// sleep waits for d or until the client gives up on the request.
+func sleep(r *http.Request, d time.Duration) bool {
+	// The server only notices a closed connection once the request body has been read
+	io.Copy(io.Discard, r.Body)
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// streamChunks sends n SSE chunks, one every interval, or endlessly if n is negative.
+func streamChunks(w http.ResponseWriter, r *http.Request, n int, interval time.Duration) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for i := 0; n < 0 || i < n; i++ {
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%d\"}}]}\n\n", i)
+		w.(http.Flusher).Flush()
+		if !sleep(r, interval) {
+			return
+		}
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func assertTimeout(t *testing.T, err error, phase string) {
+	t.Helper()
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("error = %v, want a %s TimeoutError", err, phase)
+	}
+	if timeoutErr.Phase != phase {
+		t.Errorf("timeout phase = %q, want %q", timeoutErr.Phase, phase)
+	}
+}
+
+func TestFirstByteTimeoutBeforeHeaders(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		sleep(r, time.Second)
+	})
+
+	start := time.Now()
+	_, err := client.ChatCompletions(context.Background(), "key", []byte(`{}`), true, Timeouts{FirstByte: 50 * time.Millisecond})
+	assertTimeout(t, err, "first byte")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request gave up after %s, want about 50ms", elapsed)
+	}
+}
+
+func TestFirstByteTimeoutAfterHeaders(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		sleep(r, time.Second)
+	})
+
+	body, err := client.ChatCompletions(context.Background(), "key", []byte(`{}`), true, Timeouts{FirstByte: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("ChatCompletions() error = %v", err)
+	}
+	defer body.Close()
+	_, err = io.ReadAll(body)
+	assertTimeout(t, err, "first byte")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// Two chunks, then the server stalls
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"x\"}}]}\n\n")
+			w.(http.Flusher).Flush()
+			sleep(r, chunkInterval)
+		}
+		sleep(r, time.Second)
+	})
+
+	body, err := client.ChatCompletions(context.Background(), "key", []byte(`{}`), true, Timeouts{FirstByte: time.Second, Idle: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("ChatCompletions() error = %v", err)
+	}
+	defer body.Close()
+	start := time.Now()
+	data, err := io.ReadAll(body)
+	assertTimeout(t, err, "idle")
+	if len(data) == 0 {
+		t.Error("the chunks sent before the stall were not read")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("stream gave up after %s, want about 100ms after the last chunk", elapsed)
+	}
+}
+
+func TestIdleTimeoutNonStreaming(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":`)
+		w.(http.Flusher).Flush()
+		sleep(r, time.Second)
+	})
+
+	_, err := client.ChatCompletions(context.Background(), "key", []byte(`{}`), false, Timeouts{Idle: 50 * time.Millisecond})
+	assertTimeout(t, err, "idle")
+}
+
+func TestTotalTimeout(t *testing.T) {
+	// A stream that never ends, though it keeps making progress
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		streamChunks(w, r, -1, chunkInterval)
+	})
+
+	body, err := client.ChatCompletions(context.Background(), "key", []byte(`{}`), true, Timeouts{Idle: 100 * time.Millisecond, Total: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("ChatCompletions() error = %v", err)
+	}
+	defer body.Close()
+	_, err = io.ReadAll(body)
+	assertTimeout(t, err, "total")
+}
+
+func TestStreamMakingProgressIsNotCutOff(t *testing.T) {
+	// The old client-wide timeout cut off every request at a fixed duration. Scaled down, a stream
+	// running for many times its first byte and idle timeouts must still be read to the end, as long
+	// as no gap between chunks reaches the idle timeout.
+	timeouts := Timeouts{FirstByte: 100 * time.Millisecond, Idle: 100 * time.Millisecond}
+	const chunks = 30 // about 600ms
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		streamChunks(w, r, chunks, chunkInterval)
+	})
+
+	start := time.Now()
+	body, err := client.ChatCompletions(context.Background(), "key", []byte(`{}`), true, timeouts)
+	if err != nil {
+		t.Fatalf("ChatCompletions() error = %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading the stream failed after %s: %v", time.Since(start), err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*timeouts.Idle {
+		t.Errorf("stream took %s, want it to outlast the timeouts several times over", elapsed)
+	}
+	if want := fmt.Sprintf(`"content":"%d"`, chunks-1); !strings.Contains(string(data), want) {
+		t.Error("the stream was not read to its last chunk")
+	}
+}
+
+func TestCallerCancellationIsNotATimeout(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		sleep(r, time.Second)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.ChatCompletions(ctx, "key", []byte(`{}`), true, Timeouts{FirstByte: time.Second})
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		t.Errorf("error = %v, want the caller's deadline rather than an upstream timeout", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -1,5 +1,9 @@
 package gemini
 
+import (
+	"time"
+)
+
 // ChatPart represents a part in Gemini's content.
 type ChatPart struct {
 	Text string `json:"text"`
@@ -13,7 +17,7 @@ type ChatContent struct {
 
 // ChatRequest represents the outgoing request format for Gemini's chat/completions.
 type ChatRequest struct {
-	Contents []ChatContent `json:"contents"`
+	Contents         []ChatContent `json:"contents"`
 	GenerationConfig struct {
 		Temperature     float32 `json:"temperature,omitempty"`
 		MaxOutputTokens int     `json:"maxOutputTokens,omitempty"`
@@ -40,3 +44,35 @@ type ChatResponse struct {
 		TotalTokenCount  int `json:"totalTokenCount"`
 	} `json:"usageMetadata"`
 }
+
+// EmbeddingRequest represents the outgoing request format for Gemini's OpenAI-compatible embeddings endpoint.
+type EmbeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+// EmbeddingResponse represents the incoming response format from Gemini's OpenAI-compatible embeddings endpoint.
+type EmbeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+}
+
+// CachedContentRequest represents the outgoing request format for creating a Gemini context cache.
+type CachedContentRequest struct {
+	Model             string `json:"model"`
+	SystemInstruction struct {
+		Parts []ChatPart `json:"parts"`
+	} `json:"systemInstruction"`
+	TTL string `json:"ttl"`
+}
+
+// CachedContent represents a Gemini context cache.
+type CachedContent struct {
+	Name          string    `json:"name"`
+	ExpireTime    time.Time `json:"expireTime"`
+	UsageMetadata struct {
+		TotalTokenCount int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// KeyState is the health of a single API key as seen by the key manager.
+type KeyState struct {
+	Provider          string
+	Index             int
+	Healthy           bool
+	QuarantinedModels int
+}
+
+// KeyStateFunc returns the current state of every key in the pool.
+type KeyStateFunc func() []KeyState
+
+var (
+	keyUpDesc = prometheus.NewDesc(
+		"vertigo_key_up",
+		"Whether an API key is currently usable (1) or quarantined (0), by provider and key index.",
+		[]string{"provider", "key_index"}, nil,
+	)
+	keyQuarantinedModelsDesc = prometheus.NewDesc(
+		"vertigo_key_quarantined_models",
+		"Number of models an API key is currently quarantined for, by provider and key index.",
+		[]string{"provider", "key_index"}, nil,
+	)
+)
+
+// keyStateCollector reads key health from the key manager at scrape time.
+type keyStateCollector struct {
+	states atomic.Pointer[KeyStateFunc]
+}
+
+func (c *keyStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- keyUpDesc
+	ch <- keyQuarantinedModelsDesc
+}
+
+func (c *keyStateCollector) Collect(ch chan<- prometheus.Metric) {
+	states := c.states.Load()
+	if states == nil {
+		return
+	}
+	for _, state := range (*states)() {
+		up := 0.0
+		if state.Healthy {
+			up = 1
+		}
+		index := strconv.Itoa(state.Index)
+		ch <- prometheus.MustNewConstMetric(keyUpDesc, prometheus.GaugeValue, up, state.Provider, index)
+		ch <- prometheus.MustNewConstMetric(keyQuarantinedModelsDesc, prometheus.GaugeValue, float64(state.QuarantinedModels), state.Provider, index)
+	}
+}
+
+// keyStates is the collector registered by RegisterKeyStates.
+var keyStates = &keyStateCollector{}
+
+func init() {
+	Registry.MustRegister(keyStates)
+}
+
+// RegisterKeyStates exposes the key health reported by states, replacing any function registered
+// before, so that it can be called once per server.
+func RegisterKeyStates(states KeyStateFunc) {
+	keyStates.states.Store(&states)
+}
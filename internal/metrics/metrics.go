@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every vertigo metric, plus the Go runtime and process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// RequestsTotal counts handled HTTP requests by route, model and status code.
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_requests_total",
+		Help: "HTTP requests handled, by route, upstream model and status code.",
+	}, []string{"route", "model", "status"})
+
+	// RequestDuration observes the full duration of HTTP requests, including streaming.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vertigo_request_duration_seconds",
+		Help:    "HTTP request duration in seconds, by route and upstream model.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"route", "model"})
+
+	// TimeToFirstToken observes the time until the first chunk of a streamed response is written.
+	TimeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vertigo_time_to_first_token_seconds",
+		Help:    "Time until the first chunk of a streamed response is sent, by upstream model.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+	}, []string{"model"})
+
+	// InFlightRequests is the number of HTTP requests currently being served.
+	InFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vertigo_in_flight_requests",
+		Help: "HTTP requests currently being served.",
+	})
+
+	// UpstreamErrors counts failed upstream calls by provider, key index, model and status code.
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_upstream_errors_total",
+		Help: "Failed upstream calls, by provider, key index, model and status code (0 for transport errors).",
+	}, []string{"provider", "key_index", "model", "status"})
+
+	// Tokens counts tokens processed by model and type (prompt, completion or cached).
+	Tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_tokens_total",
+		Help: "Tokens processed, by upstream model and type (prompt, completion, cached).",
+	}, []string{"model", "type"})
+
+	// KeyProbes counts key health probes by provider, key index and result.
+	KeyProbes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_key_probes_total",
+		Help: "API key health probes, by provider, key index and result (ok, failed).",
+	}, []string{"provider", "key_index", "result"})
+
+	// CircuitTransitions counts circuit breaker state changes by provider, model and new state.
+	CircuitTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_circuit_transitions_total",
+		Help: "Circuit breaker state changes, by provider, upstream model and new state (open, half-open, closed).",
+	}, []string{"provider", "model", "state"})
+
+	// HedgedRequests counts hedged upstream calls by model and by the attempt that answered.
+	HedgedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_hedged_requests_total",
+		Help: "Upstream calls that sent a hedged second attempt, by upstream model and winner (primary, hedge, none).",
+	}, []string{"model", "winner"})
+
+	// SkippedHedges counts hedges that were due but not sent, by model and reason.
+	SkippedHedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_skipped_hedges_total",
+		Help: "Hedged second attempts that were due but not sent, by upstream model and reason (no_key, no_slot).",
+	}, []string{"model", "reason"})
+
+	// QueueDepth tracks the requests waiting for an upstream slot by model and priority.
+	QueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vertigo_queue_depth",
+		Help: "Requests waiting for an upstream slot, by upstream model and priority.",
+	}, []string{"model", "priority"})
+
+	// QueueWait observes how long queued requests waited for their slot.
+	QueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vertigo_queue_wait_seconds",
+		Help:    "Time queued requests waited for an upstream slot, by upstream model and priority.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"model", "priority"})
+
+	// QueueRejections counts requests that got no upstream slot by model and reason.
+	QueueRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_queue_rejections_total",
+		Help: "Requests that got no upstream slot, by upstream model and reason (full, timeout).",
+	}, []string{"model", "reason"})
+
+	// BatchRequests counts the requests of batches by result.
+	BatchRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_batch_requests_total",
+		Help: "Requests sent for batches, by result (completed, failed, retried).",
+	}, []string{"result"})
+
+	// CacheRequests counts response cache lookups by cache and result.
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vertigo_cache_requests_total",
+		Help: "Response cache lookups, by cache (exact, semantic) and result (hit, miss).",
+	}, []string{"cache", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestsTotal,
+		RequestDuration,
+		TimeToFirstToken,
+		InFlightRequests,
+		UpstreamErrors,
+		Tokens,
+		KeyProbes,
+		CircuitTransitions,
+		HedgedRequests,
+		SkippedHedges,
+		QueueDepth,
+		QueueWait,
+		QueueRejections,
+		BatchRequests,
+		CacheRequests,
+	)
+}
+
+// Handler returns the HTTP handler serving the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestModelLabel(t *testing.T) {
+	SetKnownModels([]string{"gemini-2.5-pro", "vertigo-1.0-blast"})
+	tests := map[string]string{
+		"gemini-2.5-pro":    "gemini-2.5-pro",
+		"vertigo-1.0-blast": "vertigo-1.0-blast",
+		"made-up-model-1":   OtherModel,
+		"":                  "",
+	}
+	for model, want := range tests {
+		if got := ModelLabel(model); got != want {
+			t.Errorf("ModelLabel(%q) = %q, want %q", model, got, want)
+		}
+	}
+
+	// A reload replaces the known models
+	SetKnownModels([]string{"gemini-2.5-flash"})
+	if got := ModelLabel("gemini-2.5-pro"); got != OtherModel {
+		t.Errorf("ModelLabel() = %q after the model was removed, want %q", got, OtherModel)
+	}
+}
+
+func TestInstrumentLabelsUnknownModelsAsOther(t *testing.T) {
+	SetKnownModels([]string{"gemini-2.5-pro"})
+	RequestsTotal.Reset()
+	handler := Instrument("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ModelHeader, r.URL.Query().Get("model"))
+	}))
+	for _, model := range []string{"gemini-2.5-pro", "made-up-1", "made-up-2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test?model="+model, nil))
+	}
+
+	if n := testutil.CollectAndCount(RequestsTotal); n != 2 {
+		t.Errorf("got %d request series, want 2", n)
+	}
+	if v := testutil.ToFloat64(RequestsTotal.WithLabelValues("/test", OtherModel, "200")); v != 2 {
+		t.Errorf("other model requests = %v, want 2", v)
+	}
+}
+
+func TestRegisterKeyStatesTwice(t *testing.T) {
+	RegisterKeyStates(func() []KeyState { return []KeyState{{Provider: "a", Index: 0, Healthy: true}} })
+	// A second server, e.g. in a test, replaces the first one's key states rather than panicking
+	RegisterKeyStates(func() []KeyState {
+		return []KeyState{{Provider: "b", Index: 0, Healthy: true}, {Provider: "b", Index: 1}}
+	})
+
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "vertigo_key_up" {
+			continue
+		}
+		if n := len(family.GetMetric()); n != 2 {
+			t.Errorf("vertigo_key_up has %d series, want the 2 of the last registration", n)
+		}
+		return
+	}
+	t.Error("vertigo_key_up was not collected")
+}
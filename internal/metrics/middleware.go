@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ModelHeader is the response header the chat handler uses to report the upstream model.
+// It is read back here to label request metrics by model.
+const ModelHeader = "X-Vertigo-Model"
+
+// Instrument wraps a handler to record request counts, durations, time to first token for
+// streamed responses and in-flight requests under the given route label.
+func Instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		InFlightRequests.Inc()
+		defer InFlightRequests.Dec()
+
+		mw := &metricsResponseWriter{ResponseWriter: w, start: start}
+		next.ServeHTTP(mw, r)
+
+		status := mw.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		model := ModelLabel(w.Header().Get(ModelHeader))
+		RequestsTotal.WithLabelValues(route, model, strconv.Itoa(status)).Inc()
+		RequestDuration.WithLabelValues(route, model).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsResponseWriter captures the status code and the time of the first streamed chunk.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	start      time.Time
+	statusCode int
+	wrote      bool
+}
+
+func (mw *metricsResponseWriter) WriteHeader(code int) {
+	if mw.statusCode == 0 {
+		mw.statusCode = code
+	}
+	mw.ResponseWriter.WriteHeader(code)
+}
+
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	if !mw.wrote {
+		mw.wrote = true
+		if mw.Header().Get("Content-Type") == "text/event-stream" {
+			TimeToFirstToken.WithLabelValues(ModelLabel(mw.Header().Get(ModelHeader))).Observe(time.Since(mw.start).Seconds())
+		}
+	}
+	return mw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so that streamed responses keep working when instrumented.
+func (mw *metricsResponseWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
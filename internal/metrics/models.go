@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"sync/atomic"
+)
+
+// OtherModel is the model label of every model name the configuration does not mention. Model names
+// come from client requests, and providers serving "*" pass any name through, so labelling by them
+// would let clients create any number of series.
+const OtherModel = "other"
+
+var knownModels atomic.Pointer[map[string]bool]
+
+// SetKnownModels sets the model names used as model labels, replacing the previous set.
+func SetKnownModels(models []string) {
+	known := make(map[string]bool, len(models))
+	for _, model := range models {
+		known[model] = true
+	}
+	knownModels.Store(&known)
+}
+
+// ModelLabel returns the model label of a model: its name if it is known, OtherModel otherwise.
+// An empty name, for requests that never got as far as a model, stays empty.
+func ModelLabel(model string) string {
+	if model == "" {
+		return ""
+	}
+	if known := knownModels.Load(); known != nil && (*known)[model] {
+		return model
+	}
+	return OtherModel
+}
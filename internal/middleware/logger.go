@@ -1,31 +1,88 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// RequestInfo collects request details for the access log. Handlers fill it in as they learn them.
+type RequestInfo struct {
+	Model            string
+	ConversationID   string
+	KeyIndex         int // Position of the upstream key in the pool, never the key itself
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+	CacheStatus      string
+	UpstreamLatency  time.Duration
+	mutex            sync.Mutex
+}
+
+// Update applies fn to the request info under its lock.
+func (ri *RequestInfo) Update(fn func(ri *RequestInfo)) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+	fn(ri)
+}
+
+// RequestInfoFromContext returns the RequestInfo installed by Logger. It returns a throwaway
+// value when the request was not wrapped, so callers never need to check for nil.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	if ri, ok := ctx.Value(requestInfoKey).(*RequestInfo); ok {
+		return ri
+	}
+	return &RequestInfo{KeyIndex: -1}
+}
+
 // Logger is a middleware that logs the details of each request.
-func Logger(next http.Handler, log *logrus.Logger) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+func Logger(log *logrus.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			info := &RequestInfo{KeyIndex: -1}
 
-		// Create a response writer to capture the status code
-		lrw := &loggingResponseWriter{ResponseWriter: w}
+			// Create a response writer to capture the status code
+			lrw := &loggingResponseWriter{ResponseWriter: w}
 
-		// Call the next handler
-		next.ServeHTTP(lrw, r)
+			// Call the next handler
+			next.ServeHTTP(lrw, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
 
-		log.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"status":      lrw.statusCode,
-			"duration":    time.Since(start),
-			"remote_addr": r.RemoteAddr,
-		}).Info("Request handled")
-	})
+			status := lrw.statusCode
+			if status == 0 {
+				status = http.StatusOK
+			}
+			fields := logrus.Fields{
+				"request_id":  RequestIDFromContext(r.Context()),
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status":      status,
+				"duration":    time.Since(start),
+				"remote_addr": r.RemoteAddr,
+			}
+			info.Update(func(ri *RequestInfo) {
+				if ri.ConversationID != "" {
+					fields["conversation_id"] = ri.ConversationID
+				}
+				if ri.Model == "" {
+					return
+				}
+				fields["model"] = ri.Model
+				fields["key_index"] = ri.KeyIndex
+				fields["prompt_tokens"] = ri.PromptTokens
+				fields["completion_tokens"] = ri.CompletionTokens
+				fields["cached_tokens"] = ri.CachedTokens
+				fields["upstream_latency"] = ri.UpstreamLatency
+				if ri.CacheStatus != "" {
+					fields["cache"] = ri.CacheStatus
+				}
+			})
+			log.WithFields(fields).Info("Request handled")
+		})
+	}
 }
 
 // loggingResponseWriter is a wrapper around http.ResponseWriter to capture the status code.
@@ -35,7 +92,9 @@ type loggingResponseWriter struct {
 }
 
 func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
+	if lrw.statusCode == 0 {
+		lrw.statusCode = code
+	}
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
@@ -45,3 +104,13 @@ func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
 	}
 	return lrw.ResponseWriter.Write(b)
 }
+
+// Flush implements http.Flusher so that server-sent events keep streaming through the wrapper.
+func (lrw *loggingResponseWriter) Flush() {
+	if lrw.statusCode == 0 {
+		lrw.statusCode = http.StatusOK
+	}
+	if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
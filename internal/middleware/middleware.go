@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// Middleware wraps an http.Handler with additional behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middlewares to a handler. The first middleware is the outermost one,
+// so it sees the request first and the response last.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Recover is a middleware that turns panics in later handlers into a JSON 500 response.
+// If the response has already started, the connection is simply closed.
+func Recover(log *logrus.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lrw := &loggingResponseWriter{ResponseWriter: w}
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				log.WithFields(logrus.Fields{
+					"request_id": RequestIDFromContext(r.Context()),
+					"panic":      p,
+					"stack":      string(debug.Stack()),
+				}).Error("Recovered from panic")
+
+				if lrw.statusCode != 0 {
+					// Headers are already sent; abort so the client sees a broken response
+					panic(http.ErrAbortHandler)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": map[string]interface{}{
+						"message": "Internal server error",
+						"type":    "server_error",
+						"param":   nil,
+						"code":    nil,
+					},
+				})
+			}()
+
+			next.ServeHTTP(lrw, r)
+		})
+	}
+}
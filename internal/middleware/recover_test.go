@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecover(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	handler := Recover(log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("started") != "" {
+			w.WriteHeader(http.StatusOK)
+		}
+		panic("boom")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	var body struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Type != "server_error" {
+		t.Errorf("body = %q, want a JSON server_error", rec.Body.String())
+	}
+
+	// Once the response has started, the connection is aborted instead
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("panic = %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?started=1", nil))
+}
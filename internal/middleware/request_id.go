@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request ID on requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestInfoKey
+)
+
+// RequestID is a middleware that propagates the caller's X-Request-ID, or generates one,
+// and echoes it on the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// RequestIDFromContext returns the request ID stored by RequestID, or an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
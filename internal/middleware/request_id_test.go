@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{"passed through", "abc-123", true},
+		{"generated when missing", "", false},
+		{"generated when too long", strings.Repeat("x", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(RequestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(RequestIDHeader)
+			if echoed == "" || echoed != seen {
+				t.Fatalf("response ID %q, context ID %q; want the same non-empty ID", echoed, seen)
+			}
+			if (echoed == tt.incoming) != tt.wantSame {
+				t.Errorf("ID = %q for incoming %q", echoed, tt.incoming)
+			}
+		})
+	}
+}
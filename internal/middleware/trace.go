@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+
+	"vertigo/internal/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace is a middleware that starts a server span for each request, continuing the trace
+// from an incoming traceparent header when there is one. The span is named after the method
+// until TraceRoute names it after the matched route; the raw path is kept as an attribute.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("vertigo.request_id", RequestIDFromContext(r.Context())),
+			),
+		)
+		defer span.End()
+
+		lrw := &loggingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(lrw, r.WithContext(ctx))
+
+		status := lrw.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(tracing.AttrStatusCode.Int(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// TraceRoute names the server span of a request after the ServeMux pattern it matched, e.g.
+// "GET /openai/v1/files/{id}", so span names do not grow with IDs in paths. It wraps the
+// handlers registered on the mux, where r.Pattern is set.
+func TraceRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Pattern != "" {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(attribute.String("http.route", r.Pattern))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceNamesSpansAfterRoutes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	mux := http.NewServeMux()
+	mux.Handle("/openai/v1/files/{id}", TraceRoute(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	handler := Chain(mux, RequestID, Trace)
+
+	for _, path := range []string{"/openai/v1/files/file-1", "/openai/v1/files/file-2", "/unknown/abc"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+	want := []string{"GET /openai/v1/files/{id}", "GET /openai/v1/files/{id}", "GET"}
+	for i, span := range spans {
+		if span.Name() != want[i] {
+			t.Errorf("span %d is named %q, want %q", i, span.Name(), want[i])
+		}
+		var path string
+		for _, attr := range span.Attributes() {
+			if attr.Key == "url.path" {
+				path = attr.Value.AsString()
+			}
+		}
+		if path == "" {
+			t.Errorf("span %q has no url.path attribute", span.Name())
+		}
+	}
+}
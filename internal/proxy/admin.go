@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
+	"vertigo/internal/store"
+)
+
+// Errors returned by the key administration methods.
+var (
+	ErrProviderNotFound = errors.New("provider not found")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrKeyExists        = errors.New("key is already in the pool")
+	ErrKeysNotEditable  = errors.New("keys of this provider can only be changed in the configuration")
+)
+
+// probeTimeout bounds a key probe.
+const probeTimeout = 30 * time.Second
+
+// defaultProbeModel is used to probe providers that cannot list models, when they list no models either.
+const defaultProbeModel = "gemini-2.5-flash"
+
+// KeyInfo describes a key of a provider's pool for the admin API. The key itself is masked; ID identifies
+// it in admin requests and stays the same when other keys are added or removed.
+type KeyInfo struct {
+	Provider          string               `json:"provider"`
+	ID                string               `json:"id"`
+	Index             int                  `json:"index"`
+	Key               string               `json:"key"`
+	Healthy           bool                 `json:"healthy"`
+	Disabled          bool                 `json:"disabled"`
+	BadUntil          *time.Time           `json:"bad_until,omitempty"`
+	QuarantinedModels map[string]time.Time `json:"quarantined_models,omitempty"`
+	Requests          int64                `json:"requests"`
+	Errors            int64                `json:"errors"`
+	PromptTokens      int64                `json:"prompt_tokens"`
+	CompletionTokens  int64                `json:"completion_tokens"`
+	LastUsed          *time.Time           `json:"last_used,omitempty"`
+	LastError         string               `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time           `json:"last_error_at,omitempty"`
+	LastProbe         *time.Time           `json:"last_probe,omitempty"`
+	LastProbeOK       bool                 `json:"last_probe_ok"`
+}
+
+// ProbeResult is the outcome of testing a key with a cheap upstream request.
+type ProbeResult struct {
+	OK bool `json:"ok"`
+	// Model is empty when the key was probed by listing models.
+	Model     string `json:"model,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// KeyID returns the identifier of a key used by the admin API, derived from the key so that it never changes.
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// maskKey hides all but the first and last few characters of a key.
+func maskKey(key string) string {
+	if len(key) <= 12 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// KeyInfos returns the state of every key of every provider.
+func (pm *Manager) KeyInfos() []KeyInfo {
+	var infos []KeyInfo
+	for _, p := range pm.Settings().Providers {
+		keys, statuses := p.KeyManager.snapshot()
+		for i, key := range keys {
+			infos = append(infos, keyInfo(p.Name, i, key, statuses[i]))
+		}
+	}
+	return infos
+}
+
+// keyInfo builds the admin view of a key from its status.
+func keyInfo(provider string, index int, key string, status KeyStatus) KeyInfo {
+	now := time.Now()
+	info := KeyInfo{
+		Provider:         provider,
+		ID:               KeyID(key),
+		Index:            index,
+		Key:              maskKey(key),
+		Disabled:         status.Disabled,
+		Requests:         status.Requests,
+		Errors:           status.Errors,
+		PromptTokens:     status.PromptTokens,
+		CompletionTokens: status.CompletionTokens,
+		LastError:        status.LastError,
+	}
+	info.Healthy = !status.Disabled && (!status.IsBad || now.After(status.BadUntil))
+	if status.IsBad && now.Before(status.BadUntil) {
+		info.BadUntil = &status.BadUntil
+	}
+	for model, until := range status.ModelBadUntil {
+		if now.Before(until) {
+			if info.QuarantinedModels == nil {
+				info.QuarantinedModels = make(map[string]time.Time)
+			}
+			info.QuarantinedModels[model] = until
+		}
+	}
+	if !status.LastUsed.IsZero() {
+		info.LastUsed = &status.LastUsed
+	}
+	if !status.LastErrorAt.IsZero() {
+		info.LastErrorAt = &status.LastErrorAt
+	}
+	if !status.LastProbe.IsZero() {
+		info.LastProbe, info.LastProbeOK = &status.LastProbe, status.LastProbeOK
+	}
+	return info
+}
+
+// AddKey adds a key to a provider's pool at runtime.
+func (pm *Manager) AddKey(providerName, key string) (KeyInfo, error) {
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+
+	p := pm.provider(providerName)
+	if p == nil {
+		return KeyInfo{}, ErrProviderNotFound
+	}
+	if p.Type == ProviderVertex || p.Client.Auth == gemini.AuthNone {
+		return KeyInfo{}, ErrKeysNotEditable
+	}
+	if p.KeyManager.KeyIndex(key) >= 0 {
+		return KeyInfo{}, ErrKeyExists
+	}
+
+	override := pm.keyOverride(p.Name, key)
+	override.Action = store.KeyAdded
+	if slices.Contains(p.configKeys, key) {
+		// The key was removed at runtime earlier; adding it back restores the configuration
+		override.Action = ""
+	}
+	if err := pm.setKeyOverride(override); err != nil {
+		return KeyInfo{}, err
+	}
+	p.KeyManager.AddKey(key)
+	return pm.findKeyInfo(p, key), nil
+}
+
+// RemoveKey removes a key from a provider's pool at runtime.
+func (pm *Manager) RemoveKey(providerName, id string) error {
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+
+	p, key, err := pm.findKey(providerName, id)
+	if err != nil {
+		return err
+	}
+	override := pm.keyOverride(p.Name, key)
+	override.Action, override.Disabled = "", false
+	if slices.Contains(p.configKeys, key) {
+		override.Action = store.KeyRemoved
+	}
+	if err := pm.setKeyOverride(override); err != nil {
+		return err
+	}
+	p.KeyManager.RemoveKey(key)
+	return nil
+}
+
+// SetKeyDisabled disables or re-enables a key at runtime. A disabled key stays in the pool but is never used.
+func (pm *Manager) SetKeyDisabled(providerName, id string, disabled bool) (KeyInfo, error) {
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+
+	p, key, err := pm.findKey(providerName, id)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	override := pm.keyOverride(p.Name, key)
+	override.Disabled = disabled
+	if err := pm.setKeyOverride(override); err != nil {
+		return KeyInfo{}, err
+	}
+	p.KeyManager.SetDisabled(key, disabled)
+	return pm.findKeyInfo(p, key), nil
+}
+
+// ProbeKey tests a key with a cheap upstream request: a one-token completion of model, or of the provider's
+// probe model if model is empty, or else listing models. The result updates the key's health like a real request.
+func (pm *Manager) ProbeKey(ctx context.Context, providerName, id, model string) (ProbeResult, error) {
+	p, key, err := pm.findKey(providerName, id)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	return pm.probe(ctx, p, key, model), nil
+}
+
+// probe tests a key and records the outcome: a working key has its quarantine lifted, and a failing one
+// is handled like a failed request.
+func (pm *Manager) probe(ctx context.Context, p *Provider, key, model string) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	if model == "" {
+		model = pm.probeModel(p)
+	}
+
+	start := time.Now()
+	var err error
+	if model == "" {
+		err = p.Client.ListModels(ctx, key)
+	} else {
+		err = probeCompletion(ctx, p, key, model)
+	}
+	result := ProbeResult{Model: model, LatencyMS: time.Since(start).Milliseconds()}
+	p.KeyManager.RecordProbe(key, err == nil)
+	outcome := "ok"
+	if err != nil {
+		outcome = "failed"
+	}
+	metrics.KeyProbes.WithLabelValues(p.Name, strconv.Itoa(p.KeyManager.KeyIndex(key)), outcome).Inc()
+	if err == nil {
+		result.OK, result.Status = true, http.StatusOK
+		p.KeyManager.MarkKeyAsGood(key, model)
+		return result
+	}
+
+	result.Error = err.Error()
+	var apiErr *gemini.APIError
+	if errors.As(err, &apiErr) {
+		result.Status = apiErr.StatusCode
+		result.Error = apiErr.Message()
+	}
+	if model == "" && result.Status == http.StatusTooManyRequests {
+		// Without a model, a rate limit applies to the key as a whole
+		p.KeyManager.RecordError(key, err)
+		p.KeyManager.MarkKeyAsBad(key, time.Minute)
+		return result
+	}
+	pm.handleKeyError(p, key, model, err)
+	return result
+}
+
+// probeModel returns the model to probe a provider's keys with, or an empty string to list models instead.
+// Vertex AI cannot list models, so its keys are always probed with a model.
+func (pm *Manager) probeModel(p *Provider) string {
+	if p.ProbeModel != "" {
+		return p.ProbeModel
+	}
+	if model := pm.Settings().HealthCheck.Model; model != "" {
+		return model
+	}
+	if p.Type != ProviderVertex {
+		return ""
+	}
+	for _, m := range p.Models {
+		if !strings.ContainsAny(m, "*?[") {
+			return m
+		}
+	}
+	return defaultProbeModel
+}
+
+// probeCompletion requests a single token from a model.
+func probeCompletion(ctx context.Context, p *Provider, key, model string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":      p.upstreamModel(model),
+		"messages":   []map[string]string{{"role": "user", "content": "ping"}},
+		"max_tokens": 1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal probe request: %w", err)
+	}
+	resp, err := p.clientFor(model).ChatCompletions(ctx, key, body, false, gemini.DefaultTimeouts)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	_, err = io.Copy(io.Discard, resp)
+	return err
+}
+
+// provider returns the provider with the given name, or nil.
+func (pm *Manager) provider(name string) *Provider {
+	for _, p := range pm.Settings().Providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// findKey resolves a provider name and key ID.
+func (pm *Manager) findKey(providerName, id string) (*Provider, string, error) {
+	p := pm.provider(providerName)
+	if p == nil {
+		return nil, "", ErrProviderNotFound
+	}
+	for _, key := range p.KeyManager.Keys() {
+		if KeyID(key) == id {
+			return p, key, nil
+		}
+	}
+	return nil, "", ErrKeyNotFound
+}
+
+// findKeyInfo returns the admin view of a key of a provider.
+func (pm *Manager) findKeyInfo(p *Provider, key string) KeyInfo {
+	keys, statuses := p.KeyManager.snapshot()
+	for i, k := range keys {
+		if k == key {
+			return keyInfo(p.Name, i, k, statuses[i])
+		}
+	}
+	return KeyInfo{Provider: p.Name, ID: KeyID(key), Index: -1, Key: maskKey(key)}
+}
+
+// LoadKeyOverrides reads the runtime key changes persisted in KeyStore and applies them to the key pools.
+func (pm *Manager) LoadKeyOverrides() error {
+	if pm.KeyStore == nil {
+		return nil
+	}
+	overrides, err := pm.KeyStore.Overrides()
+	if err != nil {
+		return err
+	}
+
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+	pm.keyOverrides = overrides
+	for _, p := range pm.Settings().Providers {
+		pm.applyKeyOverrides(p)
+	}
+	return nil
+}
+
+// keyOverride returns the current override of a key, or an empty one.
+func (pm *Manager) keyOverride(provider, key string) store.KeyOverride {
+	for _, o := range pm.keyOverrides {
+		if o.Provider == provider && o.Key == key {
+			return o
+		}
+	}
+	return store.KeyOverride{Provider: provider, Key: key}
+}
+
+// setKeyOverride records an override, persisting it first when a KeyStore is set. An override that
+// changes nothing is dropped.
+func (pm *Manager) setKeyOverride(o store.KeyOverride) error {
+	empty := o.Action == "" && !o.Disabled
+	if pm.KeyStore != nil {
+		var err error
+		if empty {
+			err = pm.KeyStore.DeleteOverride(o.Provider, o.Key)
+		} else {
+			err = pm.KeyStore.SetOverride(o)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	i := slices.IndexFunc(pm.keyOverrides, func(existing store.KeyOverride) bool {
+		return existing.Provider == o.Provider && existing.Key == o.Key
+	})
+	switch {
+	case i >= 0 && empty:
+		pm.keyOverrides = slices.Delete(pm.keyOverrides, i, i+1)
+	case i >= 0:
+		pm.keyOverrides[i] = o
+	case !empty:
+		pm.keyOverrides = append(pm.keyOverrides, o)
+	}
+	return nil
+}
+
+// applyKeyOverrides sets a provider's pool to its configured keys with the runtime changes applied,
+// keeping the health of keys that were already in the pool. It returns the number of keys added and removed.
+func (pm *Manager) applyKeyOverrides(p *Provider) (added, removed int) {
+	keys := make([]string, 0, len(p.configKeys))
+	var disabled []string
+	for _, key := range p.configKeys {
+		if pm.keyOverride(p.Name, key).Action != store.KeyRemoved {
+			keys = append(keys, key)
+		}
+	}
+	for _, o := range pm.keyOverrides {
+		if o.Provider != p.Name {
+			continue
+		}
+		if o.Action == store.KeyAdded && !slices.Contains(keys, o.Key) {
+			keys = append(keys, o.Key)
+		}
+		if o.Disabled {
+			disabled = append(disabled, o.Key)
+		}
+	}
+
+	added, removed = p.KeyManager.SetKeys(keys)
+	for _, key := range disabled {
+		p.KeyManager.SetDisabled(key, true)
+	}
+	return added, removed
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"vertigo/internal/config"
+)
+
+// Default thresholds for the heuristic router, used when the configuration leaves them unset.
+const (
+	defaultMediumPromptTokens = 2000
+	defaultLongPromptTokens   = 8000
+	defaultManyCodeBlocks     = 3
+	defaultDeepConversation   = 10
+)
+
+// defaultAutoTiers maps complexity scores to Gemini tiers when no tiers are configured.
+var defaultAutoTiers = []config.AutoTier{
+	{MinScore: 0, Model: ModelGemini25FlashLite},
+	{MinScore: 2, Model: ModelGemini25Flash},
+	{MinScore: 4, Model: ModelGemini25Pro},
+}
+
+// AutoRoute scores the request features against the heuristic router settings and returns
+// the chosen model together with a human-readable reason for the decision.
+func AutoRoute(auto config.AutoRouting, f RequestFeatures) (string, string) {
+	mediumPrompt := orDefault(auto.MediumPromptTokens, defaultMediumPromptTokens)
+	longPrompt := orDefault(auto.LongPromptTokens, defaultLongPromptTokens)
+	manyCodeBlocks := orDefault(auto.ManyCodeBlocks, defaultManyCodeBlocks)
+	deepConversation := orDefault(auto.DeepConversation, defaultDeepConversation)
+
+	score := 0
+	var reasons []string
+
+	switch {
+	case f.PromptTokens >= longPrompt:
+		score += 2
+		reasons = append(reasons, fmt.Sprintf("prompt_tokens=%d>=%d", f.PromptTokens, longPrompt))
+	case f.PromptTokens >= mediumPrompt:
+		score++
+		reasons = append(reasons, fmt.Sprintf("prompt_tokens=%d>=%d", f.PromptTokens, mediumPrompt))
+	}
+
+	switch {
+	case f.CodeBlocks >= manyCodeBlocks:
+		score += 2
+		reasons = append(reasons, fmt.Sprintf("code_blocks=%d>=%d", f.CodeBlocks, manyCodeBlocks))
+	case f.CodeBlocks > 0:
+		score++
+		reasons = append(reasons, fmt.Sprintf("code_blocks=%d", f.CodeBlocks))
+	}
+
+	if f.HasTools {
+		score++
+		reasons = append(reasons, "tools")
+	}
+
+	if f.Depth >= deepConversation {
+		score++
+		reasons = append(reasons, fmt.Sprintf("depth=%d>=%d", f.Depth, deepConversation))
+	}
+
+	for _, keyword := range auto.Keywords {
+		if keyword != "" && strings.Contains(f.Text, strings.ToLower(keyword)) {
+			score += 2
+			reasons = append(reasons, fmt.Sprintf("keyword=%q", keyword))
+			break
+		}
+	}
+
+	tiers := auto.Tiers
+	if len(tiers) == 0 {
+		tiers = defaultAutoTiers
+	}
+	tiers = append([]config.AutoTier(nil), tiers...)
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].MinScore < tiers[j].MinScore })
+
+	model := tiers[0].Model
+	for _, tier := range tiers {
+		if score >= tier.MinScore {
+			model = tier.Model
+		}
+	}
+
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no complexity signals")
+	}
+	return model, fmt.Sprintf("auto score=%d (%s)", score, strings.Join(reasons, ", "))
+}
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"vertigo/internal/config"
+)
+
+func TestAutoRouteScore(t *testing.T) {
+	tests := []struct {
+		name      string
+		auto      config.AutoRouting
+		features  RequestFeatures
+		wantModel string
+		wantScore string
+	}{
+		{
+			name:      "no signals",
+			features:  RequestFeatures{PromptTokens: 10, Depth: 1},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=0 (no complexity signals)",
+		},
+		{
+			name:      "medium prompt",
+			features:  RequestFeatures{PromptTokens: defaultMediumPromptTokens},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=1 ",
+		},
+		{
+			name:      "long prompt",
+			features:  RequestFeatures{PromptTokens: defaultLongPromptTokens},
+			wantModel: ModelGemini25Flash,
+			wantScore: "auto score=2 ",
+		},
+		{
+			name:      "just below medium prompt",
+			features:  RequestFeatures{PromptTokens: defaultMediumPromptTokens - 1},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=0 ",
+		},
+		{
+			name:      "configured prompt thresholds",
+			auto:      config.AutoRouting{MediumPromptTokens: 10, LongPromptTokens: 20},
+			features:  RequestFeatures{PromptTokens: 20},
+			wantModel: ModelGemini25Flash,
+			wantScore: "auto score=2 (prompt_tokens=20>=20)",
+		},
+		{
+			name:      "one code block",
+			features:  RequestFeatures{CodeBlocks: 1},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=1 (code_blocks=1)",
+		},
+		{
+			name:      "many code blocks",
+			features:  RequestFeatures{CodeBlocks: defaultManyCodeBlocks},
+			wantModel: ModelGemini25Flash,
+			wantScore: "auto score=2 ",
+		},
+		{
+			name:      "tools",
+			features:  RequestFeatures{HasTools: true},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=1 (tools)",
+		},
+		{
+			name:      "deep conversation",
+			features:  RequestFeatures{Depth: defaultDeepConversation},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=1 ",
+		},
+		{
+			name:      "configured conversation depth",
+			auto:      config.AutoRouting{DeepConversation: 3},
+			features:  RequestFeatures{Depth: 3},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=1 (depth=3>=3)",
+		},
+		{
+			name:      "keyword is case-insensitive",
+			auto:      config.AutoRouting{Keywords: []string{"Prove"}},
+			features:  RequestFeatures{Text: "please prove this theorem"},
+			wantModel: ModelGemini25Flash,
+			wantScore: `auto score=2 (keyword="Prove")`,
+		},
+		{
+			name:      "keywords count once",
+			auto:      config.AutoRouting{Keywords: []string{"prove", "theorem"}},
+			features:  RequestFeatures{Text: "please prove this theorem"},
+			wantModel: ModelGemini25Flash,
+			wantScore: "auto score=2 ",
+		},
+		{
+			name:      "empty keyword is ignored",
+			auto:      config.AutoRouting{Keywords: []string{""}},
+			features:  RequestFeatures{Text: "anything"},
+			wantModel: ModelGemini25FlashLite,
+			wantScore: "auto score=0 ",
+		},
+		{
+			name:      "signals add up",
+			auto:      config.AutoRouting{Keywords: []string{"refactor"}},
+			features:  RequestFeatures{PromptTokens: defaultLongPromptTokens, CodeBlocks: 1, HasTools: true, Text: "refactor this"},
+			wantModel: ModelGemini25Pro,
+			wantScore: "auto score=6 ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model, reason := AutoRoute(tt.auto, tt.features)
+			if model != tt.wantModel {
+				t.Errorf("model = %q, want %q (reason %q)", model, tt.wantModel, reason)
+			}
+			if !strings.HasPrefix(reason, tt.wantScore) {
+				t.Errorf("reason = %q, want prefix %q", reason, tt.wantScore)
+			}
+		})
+	}
+}
+
+func TestAutoRouteTiers(t *testing.T) {
+	// Configured out of order to check that tiers are sorted by MinScore
+	tiers := []config.AutoTier{
+		{MinScore: 3, Model: "large"},
+		{MinScore: 1, Model: "small"},
+		{MinScore: 2, Model: "medium"},
+	}
+	tests := []struct {
+		name     string
+		features RequestFeatures
+		want     string
+	}{
+		{"below the lowest tier falls back to it", RequestFeatures{}, "small"},
+		{"exactly the lowest tier", RequestFeatures{HasTools: true}, "small"},
+		{"middle tier", RequestFeatures{CodeBlocks: defaultManyCodeBlocks}, "medium"},
+		{"highest tier", RequestFeatures{CodeBlocks: defaultManyCodeBlocks, HasTools: true}, "large"},
+		{"above the highest tier", RequestFeatures{PromptTokens: defaultLongPromptTokens, CodeBlocks: defaultManyCodeBlocks}, "large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model, reason := AutoRoute(config.AutoRouting{Tiers: tiers}, tt.features)
+			if model != tt.want {
+				t.Errorf("model = %q, want %q (reason %q)", model, tt.want, reason)
+			}
+		})
+	}
+	if tiers[0].Model != "large" {
+		t.Errorf("AutoRoute reordered the configured tiers")
+	}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// Defaults for the circuit breakers.
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitOpenDuration     = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+// CircuitOpenError is returned without contacting upstream while the circuit of a model is open.
+// It is retriable, so the model's fallbacks are tried next.
+type CircuitOpenError struct {
+	Provider   string
+	Model      string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for model %s on provider %s", e.Model, e.Provider)
+}
+
+// CircuitState describes the circuit breaker of a model on a provider, for the admin API.
+type CircuitState struct {
+	Provider            string     `json:"provider"`
+	Model               string     `json:"model"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// circuitBreaker stops sending requests for a model to a provider after repeated upstream failures.
+// Once the open period has passed, a limited number of trial requests are let through (half-open);
+// the first success closes the circuit again and a failure reopens it.
+type circuitBreaker struct {
+	provider, model string
+	log             *logrus.Logger
+	// refs counts the requests using the breaker. It is guarded by the mutex of circuitBreakers.
+	refs int
+
+	mutex    sync.Mutex
+	cfg      config.CircuitBreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	// period counts the state transitions, so that a trial is only given back to the half-open period it was taken in.
+	period    int
+	trials    int
+	lastError string
+}
+
+// circuitBreakers holds the circuit breakers of the models and providers in use or with failures to
+// remember. They live on the Manager rather than in its Settings, so a reload keeps their state. A breaker
+// that is closed with no failures counted is dropped once no request uses it, so clients cannot fill the
+// map by sending made-up model names.
+type circuitBreakers struct {
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{breakers: make(map[string]*circuitBreaker)}
+}
+
+// enterCircuit lets a request through the circuit breaker of a model on a provider, updated to the current
+// settings. It returns the breaker, or nil if circuit breaking is disabled (the methods of circuitBreaker do
+// nothing on nil), and the function the request must call when it is done, on every path: it gives back a
+// half-open trial the request took but did not settle, so a request that fails before reaching upstream
+// cannot leave the circuit half-open with no trials left. When the circuit refuses the request, the error
+// says how long it stays open.
+func (pm *Manager) enterCircuit(provider *Provider, model string) (*circuitBreaker, func(), error) {
+	cfg := pm.Settings().CircuitBreaker
+	if !cfg.Enabled {
+		return nil, func() {}, nil
+	}
+	cbs := pm.circuits
+	id := provider.Name + "/" + model
+	cbs.mutex.Lock()
+	cb, ok := cbs.breakers[id]
+	if !ok {
+		cb = &circuitBreaker{provider: provider.Name, model: model, log: pm.Log, state: CircuitClosed}
+		cbs.breakers[id] = cb
+	}
+	cb.refs++
+	cbs.mutex.Unlock()
+
+	trial, err := cb.allow(cfg)
+	if err != nil {
+		cbs.leave(id, cb)
+		return nil, nil, err
+	}
+	var once sync.Once
+	return cb, func() {
+		once.Do(func() {
+			cb.endTrial(trial)
+			cbs.leave(id, cb)
+		})
+	}, nil
+}
+
+// leave drops a request's reference to a breaker, removing the breaker once no request uses it and it
+// has nothing to remember.
+func (cbs *circuitBreakers) leave(id string, cb *circuitBreaker) {
+	cbs.mutex.Lock()
+	defer cbs.mutex.Unlock()
+	cb.refs--
+	if cb.refs > 0 {
+		return
+	}
+	cb.mutex.Lock()
+	idle := cb.state == CircuitClosed && cb.failures == 0
+	cb.mutex.Unlock()
+	if idle {
+		delete(cbs.breakers, id)
+	}
+}
+
+// CircuitStates returns the state of every circuit breaker, sorted by provider and model.
+func (pm *Manager) CircuitStates() []CircuitState {
+	cbs := pm.circuits
+	cbs.mutex.Lock()
+	breakers := make([]*circuitBreaker, 0, len(cbs.breakers))
+	for _, cb := range cbs.breakers {
+		breakers = append(breakers, cb)
+	}
+	cbs.mutex.Unlock()
+
+	states := make([]CircuitState, 0, len(breakers))
+	for _, cb := range breakers {
+		states = append(states, cb.snapshot())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Provider != states[j].Provider {
+			return states[i].Provider < states[j].Provider
+		}
+		return states[i].Model < states[j].Model
+	})
+	return states
+}
+
+// allow reports whether a request may be sent, moving an open circuit to half-open once its open
+// period has passed. When it is refused, the returned error says how long the circuit stays open. A
+// request let through a half-open circuit takes one of its trials: trial is the period it was taken in,
+// to be passed to endTrial, or 0 if none was taken.
+func (cb *circuitBreaker) allow(cfg config.CircuitBreakerConfig) (trial int, err error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.cfg = cfg
+	if cb.state == CircuitOpen {
+		remaining := time.Until(cb.openedAt.Add(orDefaultDuration(cfg.OpenDuration, defaultCircuitOpenDuration)))
+		if remaining > 0 {
+			return 0, &CircuitOpenError{Provider: cb.provider, Model: cb.model, RetryAfter: remaining}
+		}
+		cb.transition(CircuitHalfOpen)
+	}
+	if cb.state == CircuitHalfOpen {
+		if cb.trials >= orDefault(cfg.HalfOpenRequests, defaultCircuitHalfOpenRequests) {
+			return 0, &CircuitOpenError{Provider: cb.provider, Model: cb.model}
+		}
+		cb.trials++
+		return cb.period, nil
+	}
+	return 0, nil
+}
+
+// endTrial gives back a trial taken by allow, unless an outcome has moved the circuit out of the
+// half-open period the trial was taken in.
+func (cb *circuitBreaker) endTrial(trial int) {
+	if trial == 0 {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitHalfOpen && cb.period == trial && cb.trials > 0 {
+		cb.trials--
+	}
+}
+
+// record counts the outcome of a request, once it has been through every key it could use. Only failures
+// that point at upstream itself count against the circuit: server errors, timeouts and broken connections.
+// Any other answer shows upstream is up, while a request canceled by the client, or one no key was
+// available for, says nothing.
+func (cb *circuitBreaker) record(ctx context.Context, err error) {
+	if cb == nil {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	var noKeys *NoKeysError
+	switch {
+	case err != nil && (ctx.Err() != nil || errors.As(err, &noKeys)):
+		// A trial the attempt held is given back by endTrial
+	case err != nil && isUpstreamFailure(err):
+		cb.failures++
+		cb.lastError = truncateError(err.Error())
+		if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.failures >= orDefault(cb.cfg.FailureThreshold, defaultCircuitFailureThreshold)) {
+			cb.transition(CircuitOpen)
+		}
+	default:
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			cb.transition(CircuitClosed)
+		}
+	}
+}
+
+// isOpen reports whether the circuit is open, e.g. because a trial request just failed.
+func (cb *circuitBreaker) isOpen() bool {
+	if cb == nil {
+		return false
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state == CircuitOpen
+}
+
+// transition changes the state, logging it and counting it in metrics. The caller holds the mutex.
+func (cb *circuitBreaker) transition(state string) {
+	fields := logrus.Fields{"provider": cb.provider, "model": cb.model, "from": cb.state, "to": state}
+	cb.state = state
+	cb.period++
+	cb.trials = 0
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = time.Now()
+		cb.log.WithFields(fields).WithField("consecutive_failures", cb.failures).Warnf("Circuit opened: %s", cb.lastError)
+	case CircuitHalfOpen:
+		cb.log.WithFields(fields).Info("Circuit half-open, sending trial requests")
+	case CircuitClosed:
+		cb.failures = 0
+		cb.lastError = ""
+		cb.log.WithFields(fields).Info("Circuit closed")
+	}
+	metrics.CircuitTransitions.WithLabelValues(cb.provider, metrics.ModelLabel(cb.model), state).Inc()
+}
+
+// snapshot returns the current state, showing an open circuit whose open period has passed as half-open.
+func (cb *circuitBreaker) snapshot() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	state := CircuitState{
+		Provider:            cb.provider,
+		Model:               cb.model,
+		State:               cb.state,
+		ConsecutiveFailures: cb.failures,
+		LastError:           cb.lastError,
+	}
+	if cb.state == CircuitOpen {
+		openedAt := cb.openedAt
+		state.OpenedAt = &openedAt
+		if time.Since(openedAt) >= orDefaultDuration(cb.cfg.OpenDuration, defaultCircuitOpenDuration) {
+			state.State = CircuitHalfOpen
+		}
+	}
+	return state
+}
+
+// isUpstreamFailure reports whether an error means upstream itself is failing rather than the request or key.
+func isUpstreamFailure(err error) bool {
+	var apiErr *gemini.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+// orDefaultDuration returns d, or def if d is not positive.
+func orDefaultDuration(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
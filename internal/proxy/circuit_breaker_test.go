@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestCircuitManager(settings *Settings) (*Manager, *Provider) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	p := &Provider{Name: "test", Type: ProviderGemini, Models: []string{"*"}, KeyManager: NewKeyManager([]string{"k1"})}
+	pm := &Manager{Log: logger, circuits: newCircuitBreakers(), queues: newSlotQueues()}
+	settings.Providers = []*Provider{p}
+	pm.settings.Store(settings)
+	return pm, p
+}
+
+// openCircuit opens the circuit of a model with a failure and waits out its open period.
+func openCircuit(t *testing.T, pm *Manager, p *Provider, model string) {
+	t.Helper()
+	cb, done, err := pm.enterCircuit(p, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.record(context.Background(), &gemini.APIError{StatusCode: 503})
+	done()
+	if !cb.isOpen() {
+		t.Fatal("the circuit did not open")
+	}
+	time.Sleep(pm.Settings().CircuitBreaker.OpenDuration)
+}
+
+func TestCircuitTrialIsGivenBackOnEveryPath(t *testing.T) {
+	pm, p := newTestCircuitManager(&Settings{CircuitBreaker: config.CircuitBreakerConfig{
+		Enabled: true, FailureThreshold: 1, OpenDuration: 10 * time.Millisecond, HalfOpenRequests: 1,
+	}})
+	openCircuit(t, pm, p, "gemini-a")
+
+	// The trial request fails before it reaches upstream, as it cannot be encoded
+	_, err := pm.sendModelWithSlot(context.Background(), p, "gemini-a", map[string]interface{}{"bad": make(chan int)}, false, 0)
+	if err == nil || errors.As(err, new(*CircuitOpenError)) {
+		t.Fatalf("sendModelWithSlot() error = %v, want an encoding error", err)
+	}
+
+	cb, done, err := pm.enterCircuit(p, "gemini-a")
+	if err != nil {
+		t.Fatalf("enterCircuit() error = %v, want the trial that was not used given back", err)
+	}
+	// While this trial is out, the circuit lets no other request through
+	if _, _, err := pm.enterCircuit(p, "gemini-a"); !errors.As(err, new(*CircuitOpenError)) {
+		t.Errorf("enterCircuit() error = %v, want a CircuitOpenError while the trial is out", err)
+	}
+	cb.record(context.Background(), nil)
+	done()
+	if state := cb.snapshot().State; state != CircuitClosed {
+		t.Errorf("state = %s, want closed after the trial succeeded", state)
+	}
+}
+
+func TestIdleCircuitsAreDropped(t *testing.T) {
+	pm, p := newTestCircuitManager(&Settings{CircuitBreaker: config.CircuitBreakerConfig{Enabled: true, FailureThreshold: 5}})
+
+	for _, model := range []string{"made-up-1", "made-up-2"} {
+		cb, done, err := pm.enterCircuit(p, model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb.record(context.Background(), &gemini.APIError{StatusCode: 404})
+		done()
+	}
+	cb, done, _ := pm.enterCircuit(p, "gemini-a")
+	cb.record(context.Background(), &gemini.APIError{StatusCode: 500})
+	done()
+
+	states := pm.CircuitStates()
+	if len(states) != 1 || states[0].Model != "gemini-a" {
+		t.Errorf("circuits = %+v, want only the one with a failure counted", states)
+	}
+}
+
+func TestSlotQueuesAreDropped(t *testing.T) {
+	pm, p := newTestCircuitManager(&Settings{
+		Queue:  config.QueueConfig{Enabled: true},
+		Models: map[string]config.ModelConfig{"gemini-a": {MaxConcurrency: 1}},
+	})
+
+	release, _, err := pm.acquireSlot(context.Background(), p, "gemini-a", config.PriorityInteractive, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second request waits for the slot until it gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := pm.acquireSlot(ctx, p, "gemini-a", config.PriorityInteractive, time.Now().Add(time.Second)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquireSlot() error = %v, want context.DeadlineExceeded", err)
+	}
+	if n := len(pm.queues.queues); n != 1 {
+		t.Errorf("%d queues while a slot is held, want 1", n)
+	}
+	release()
+	release()
+	if n := len(pm.queues.queues); n != 0 {
+		t.Errorf("%d queues after the last request, want none", n)
+	}
+}
+
+func TestCircuitCountsRequestsNotKeyAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"message":"unavailable"}}`, http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	pm, p := newTestCircuitManager(&Settings{CircuitBreaker: config.CircuitBreakerConfig{Enabled: true, FailureThreshold: 2}})
+	p.Client = gemini.NewClient(server.URL, 0, pm.Log)
+	p.KeyManager = NewKeyManager([]string{"k1", "k2", "k3", "k4", "k5"})
+	send := func() error {
+		_, err := pm.sendModelWithSlot(context.Background(), p, "gemini-a", map[string]interface{}{"model": "gemini-a"}, false, 0)
+		return err
+	}
+
+	// Five keys fail on one request, which counts once
+	if err := send(); err == nil {
+		t.Fatal("sendModelWithSlot() succeeded against a failing upstream")
+	}
+	if state := pm.CircuitStates()[0]; state.State != CircuitClosed || state.ConsecutiveFailures != 1 {
+		t.Fatalf("circuit = %+v, want closed with one failure", state)
+	}
+
+	// Once the keys are usable again, a second failing request opens the circuit
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		p.KeyManager.RecordSuccess(key)
+	}
+	send()
+	if state := pm.CircuitStates()[0]; state.State != CircuitOpen {
+		t.Fatalf("circuit = %+v, want open after two failed requests", state)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ClientHeader lets callers identify themselves explicitly.
+const ClientHeader = "X-Vertigo-Client"
+
+// ClientIdentity returns a stable identifier for the caller of a request. It prefers the ClientHeader,
+// then a short hash of the bearer token the client sent, and falls back to "anonymous". The short hash
+// is fit for logs and reports, but not for deciding who owns something.
+func ClientIdentity(header http.Header) string {
+	if client := header.Get(ClientHeader); client != "" {
+		return client
+	}
+	if token := bearerToken(header); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "key-" + hex.EncodeToString(sum[:4])
+	}
+	return "anonymous"
+}
+
+// CredentialIdentity identifies the caller by the full hash of the bearer token it sent alone, or
+// "anonymous" without one. Unlike ClientIdentity it can neither be chosen by the caller nor matched by
+// searching for a token with the same short hash, so it is what owns stored objects such as files and
+// batches. It is not logged.
+func CredentialIdentity(header http.Header) string {
+	if token := bearerToken(header); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "key-" + hex.EncodeToString(sum[:])
+	}
+	return "anonymous"
+}
+
+// CredentialFingerprint shortens a CredentialIdentity to the ClientIdentity the same credential has
+// without the ClientHeader, for logs, usage records and per-client settings.
+func CredentialFingerprint(owner string) string {
+	if hash, ok := strings.CutPrefix(owner, "key-"); ok && len(hash) > 8 {
+		return "key-" + hash[:8]
+	}
+	return owner
+}
+
+func bearerToken(header http.Header) string {
+	return strings.TrimPrefix(header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for Gemini context caching, used when the configuration leaves them unset.
+const (
+	defaultContextCacheMinTokens  = 4096
+	defaultContextCacheMinRepeats = 2
+	defaultContextCacheTTL        = time.Hour
+)
+
+const (
+	// contextCacheSightingTTL is how long a prefix is remembered after it was last seen. A prefix that
+	// does not repeat within it starts counting again.
+	contextCacheSightingTTL = time.Hour
+	// maxContextCacheSightings bounds the number of prefixes remembered; the least recently seen is
+	// forgotten first.
+	maxContextCacheSightings = 10000
+)
+
+// contextCacheSighting counts the sightings of a system prompt prefix.
+type contextCacheSighting struct {
+	count    int
+	lastSeen time.Time
+}
+
+// contextCacheTracker counts how often each system prompt prefix is seen, so that only
+// prefixes that actually repeat are uploaded to Gemini.
+type contextCacheTracker struct {
+	seen     map[string]*contextCacheSighting
+	creating map[string]bool
+	mutex    sync.Mutex
+}
+
+func newContextCacheTracker() *contextCacheTracker {
+	return &contextCacheTracker{
+		seen:     make(map[string]*contextCacheSighting),
+		creating: make(map[string]bool),
+	}
+}
+
+// observe records a sighting of a prefix and reports whether the caller should create a context cache for it.
+func (t *contextCacheTracker) observe(id string, minRepeats int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	sighting, ok := t.seen[id]
+	if ok && now.Sub(sighting.lastSeen) > contextCacheSightingTTL {
+		sighting.count = 0
+	}
+	if !ok {
+		if len(t.seen) >= maxContextCacheSightings {
+			t.evict(now)
+		}
+		sighting = &contextCacheSighting{}
+		t.seen[id] = sighting
+	}
+	sighting.count++
+	sighting.lastSeen = now
+
+	if sighting.count < minRepeats || t.creating[id] {
+		return false
+	}
+	t.creating[id] = true
+	return true
+}
+
+// evict forgets the prefixes not seen within contextCacheSightingTTL, or the least recently seen
+// prefix if all were.
+func (t *contextCacheTracker) evict(now time.Time) {
+	var oldestID string
+	var oldest time.Time
+	for id, sighting := range t.seen {
+		if now.Sub(sighting.lastSeen) > contextCacheSightingTTL {
+			delete(t.seen, id)
+			continue
+		}
+		if oldestID == "" || sighting.lastSeen.Before(oldest) {
+			oldestID, oldest = id, sighting.lastSeen
+		}
+	}
+	if len(t.seen) >= maxContextCacheSightings {
+		delete(t.seen, oldestID)
+	}
+}
+
+// done clears the creation marker for a prefix.
+func (t *contextCacheTracker) done(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.creating, id)
+	delete(t.seen, id)
+}
+
+// contextCacheRequest returns the context cache to use for a request together with the request body that
+// references it, creating the cache if the system prompt has repeated often enough. It returns nil when the
+// request should be sent without a context cache.
+func (pm *Manager) contextCacheRequest(ctx context.Context, provider *Provider, model string, reqBodyMap map[string]interface{}) (string, *ContextCache, []byte) {
+	cfg := pm.Settings().ContextCacheConfig
+	if !cfg.Enabled || provider.Type != ProviderGemini || usesTools(reqBodyMap) {
+		return "", nil, nil
+	}
+
+	prefix, n := systemPrefix(reqBodyMap)
+	if n == 0 || estimateTokens(len(prefix)) < orDefault(cfg.MinTokens, defaultContextCacheMinTokens) {
+		return "", nil, nil
+	}
+	sum := sha256.Sum256([]byte(model + "\x00" + prefix))
+	id := hex.EncodeToString(sum[:])
+
+	cc, ok := provider.KeyManager.GetContextCache(id, model)
+	if !ok {
+		if !pm.contextCaches.observe(id, orDefault(cfg.MinRepeats, defaultContextCacheMinRepeats)) {
+			return "", nil, nil
+		}
+		// The cache outlives this request, so a client disconnect must not abort its creation
+		cc = pm.createContextCache(context.WithoutCancel(ctx), provider, id, model, prefix)
+		if cc == nil {
+			return "", nil, nil
+		}
+	}
+
+	body, err := withCachedContent(reqBodyMap, n, cc.Name)
+	if err != nil {
+		pm.Log.Errorf("Failed to build context cache request: %v", err)
+		return "", nil, nil
+	}
+	return id, cc, body
+}
+
+// createContextCache uploads a system prompt to Gemini with the key that will serve the request.
+func (pm *Manager) createContextCache(ctx context.Context, provider *Provider, id, model, prefix string) *ContextCache {
+	defer pm.contextCaches.done(id)
+
+	apiKey := provider.KeyManager.GetNextAvailableKeyForModel(model, nil)
+	if apiKey == "" {
+		return nil
+	}
+
+	ttl := pm.Settings().ContextCacheConfig.TTL
+	if ttl <= 0 {
+		ttl = defaultContextCacheTTL
+	}
+	created, err := provider.Client.CreateCachedContent(ctx, apiKey, model, prefix, ttl)
+	if err != nil {
+		pm.Log.Errorf("Failed to create context cache for model %s: %v", model, err)
+		return nil
+	}
+
+	cc := &ContextCache{
+		Name:       created.Name,
+		Key:        apiKey,
+		ExpireTime: created.ExpireTime,
+		Tokens:     created.UsageMetadata.TotalTokenCount,
+	}
+	if cc.ExpireTime.IsZero() {
+		cc.ExpireTime = time.Now().Add(ttl)
+	}
+	provider.KeyManager.SetContextCache(id, cc)
+
+	pm.Log.WithFields(logrus.Fields{
+		"model":       model,
+		"cache":       cc.Name,
+		"tokens":      cc.Tokens,
+		"expire_time": cc.ExpireTime,
+	}).Info("Created Gemini context cache")
+	return cc
+}
+
+// usesTools reports whether a request declares tools or a tool choice. Gemini rejects requests that
+// combine them with cached content, so such requests are never sent with a context cache.
+func usesTools(reqBodyMap map[string]interface{}) bool {
+	for _, field := range []string{"tools", "tool_choice", "functions", "function_call"} {
+		switch v := reqBodyMap[field].(type) {
+		case nil:
+		case []interface{}:
+			if len(v) > 0 {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	if extraBody, ok := reqBodyMap["extra_body"].(map[string]interface{}); ok {
+		if google, ok := extraBody["google"].(map[string]interface{}); ok && google["tool_config"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// systemPrefix returns the text of the leading system messages and the number of messages it spans.
+func systemPrefix(reqBodyMap map[string]interface{}) (string, int) {
+	messages, _ := reqBodyMap["messages"].([]interface{})
+	var parts []string
+	n := 0
+	for _, m := range messages {
+		msg, ok := m.(map[string]interface{})
+		if !ok || (msg["role"] != "system" && msg["role"] != "developer") {
+			break
+		}
+		text, _ := messageText(msg["content"])
+		parts = append(parts, text)
+		n++
+	}
+	return strings.Join(parts, "\n"), n
+}
+
+// withCachedContent returns the request body with its first n system messages replaced by a reference
+// to a Gemini context cache. reqBodyMap itself is left untouched.
+func withCachedContent(reqBodyMap map[string]interface{}, n int, name string) ([]byte, error) {
+	bodyMap := make(map[string]interface{}, len(reqBodyMap))
+	for k, v := range reqBodyMap {
+		bodyMap[k] = v
+	}
+	messages, _ := reqBodyMap["messages"].([]interface{})
+	bodyMap["messages"] = messages[n:]
+
+	// Copy the nested extra_body objects so the shared request map is not modified
+	extraBody := make(map[string]interface{})
+	if existing, ok := reqBodyMap["extra_body"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			extraBody[k] = v
+		}
+	}
+	google := make(map[string]interface{})
+	if existing, ok := extraBody["google"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			google[k] = v
+		}
+	}
+	google["cached_content"] = name
+	extraBody["google"] = google
+	bodyMap["extra_body"] = extraBody
+
+	return json.Marshal(bodyMap)
+}
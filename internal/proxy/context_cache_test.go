@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestContextCacheTrackerObserve(t *testing.T) {
+	tracker := newContextCacheTracker()
+	if tracker.observe("a", 2) {
+		t.Error("observe() asked to create a cache on the first sighting")
+	}
+	if !tracker.observe("a", 2) {
+		t.Error("observe() did not ask to create a cache on the second sighting")
+	}
+	if tracker.observe("a", 2) {
+		t.Error("observe() asked to create a cache that is being created")
+	}
+	tracker.done("a")
+	if _, ok := tracker.seen["a"]; ok {
+		t.Error("done() kept the sightings")
+	}
+}
+
+func TestContextCacheTrackerForgetsOldSightings(t *testing.T) {
+	tracker := newContextCacheTracker()
+	tracker.observe("a", 2)
+	tracker.seen["a"].lastSeen = time.Now().Add(-contextCacheSightingTTL - time.Minute)
+	if tracker.observe("a", 2) {
+		t.Error("observe() counted a sighting older than the sighting TTL")
+	}
+}
+
+func TestContextCacheTrackerBoundsSightings(t *testing.T) {
+	tracker := newContextCacheTracker()
+	for i := 0; i < maxContextCacheSightings; i++ {
+		tracker.observe(fmt.Sprint(i), 2)
+	}
+	tracker.seen["0"].lastSeen = time.Now().Add(-time.Minute)
+	tracker.seen["1"].lastSeen = time.Now().Add(-contextCacheSightingTTL - time.Minute)
+
+	tracker.observe("new", 2)
+	if len(tracker.seen) > maxContextCacheSightings {
+		t.Errorf("tracker remembers %d prefixes, want at most %d", len(tracker.seen), maxContextCacheSightings)
+	}
+	if _, ok := tracker.seen["1"]; ok {
+		t.Error("an expired sighting was kept")
+	}
+	if _, ok := tracker.seen["new"]; !ok {
+		t.Error("the new sighting was not recorded")
+	}
+
+	// With no expired sightings left, the least recently seen one goes
+	tracker.observe("newer", 2)
+	if _, ok := tracker.seen["0"]; ok {
+		t.Error("the least recently seen prefix was kept")
+	}
+}
+
+func TestUsesTools(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]interface{}
+		want bool
+	}{
+		{"no tools", map[string]interface{}{"messages": []interface{}{}}, false},
+		{"empty tools", map[string]interface{}{"tools": []interface{}{}}, false},
+		{"tools", map[string]interface{}{"tools": []interface{}{map[string]interface{}{"type": "function"}}}, true},
+		{"tool choice", map[string]interface{}{"tool_choice": "none"}, true},
+		{"tool config", map[string]interface{}{"extra_body": map[string]interface{}{"google": map[string]interface{}{"tool_config": map[string]interface{}{}}}}, true},
+	}
+	for _, tt := range tests {
+		if got := usesTools(tt.body); got != tt.want {
+			t.Errorf("%s: usesTools() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"vertigo/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultConversationID is used for requests without an X-Conversation-ID header. Its history is never
+// saved, since it would be shared by every such client.
+const DefaultConversationID = "default-conversation"
+
+// injectHistory adds the saved history of a conversation to a request, after its leading system messages.
+// Requests that already carry earlier turns, as OpenAI clients send them, are left alone so that no turn
+// is sent twice.
+func (pm *Manager) injectHistory(ctx context.Context, reqBodyMap map[string]interface{}, conversationID string) {
+	if conversationID == "" || conversationID == DefaultConversationID {
+		return
+	}
+	messages, ok := reqBodyMap["messages"].([]interface{})
+	if !ok || hasEarlierTurns(messages) {
+		return
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "store.load_history", trace.WithAttributes(tracing.AttrConversationID.String(conversationID)))
+	defer span.End()
+	conv, err := pm.ConversationStore.GetConversation(conversationID)
+	if err != nil {
+		span.RecordError(err)
+		// Continue without conversation history if there's an error
+		pm.Log.Errorf("Error getting conversation: %v", err)
+		return
+	}
+	if conv == nil || len(conv.Messages) == 0 {
+		return
+	}
+
+	_, n := systemPrefix(reqBodyMap)
+	merged := make([]interface{}, 0, len(conv.Messages)+len(messages))
+	merged = append(merged, messages[:n]...)
+	for _, msg := range conv.Messages {
+		merged = append(merged, map[string]interface{}{"role": msg.Role, "content": msg.Content})
+	}
+	reqBodyMap["messages"] = append(merged, messages[n:]...)
+}
+
+// hasEarlierTurns reports whether a request's messages include a reply, meaning the client sends the
+// conversation's history itself.
+func hasEarlierTurns(messages []interface{}) bool {
+	for _, m := range messages {
+		if msg, ok := m.(map[string]interface{}); ok && (msg["role"] == "assistant" || msg["role"] == "tool") {
+			return true
+		}
+	}
+	return false
+}
+
+// saveExchange appends the user's message and the assistant's reply to the conversation history.
+// A reply cut short by a client disconnect or an upstream failure is saved as far as it got.
+func (pm *Manager) saveExchange(conversationID, userMessage string, body []byte, stream bool) {
+	if conversationID == "" || conversationID == DefaultConversationID || userMessage == "" {
+		return
+	}
+	reply := replyText(body, stream)
+	if reply == "" {
+		return
+	}
+
+	if err := pm.ConversationStore.AddMessage(conversationID, "user", userMessage); err != nil {
+		pm.Log.Errorf("Failed to save user message: %v", err)
+		return
+	}
+	if err := pm.ConversationStore.AddMessage(conversationID, "assistant", reply); err != nil {
+		pm.Log.Errorf("Failed to save assistant reply: %v", err)
+	}
+}
+
+// replyText returns the assistant's text from a chat completion, or from as much of a stream as was read.
+func replyText(body []byte, stream bool) string {
+	if !stream {
+		var resp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal(body, &resp) != nil || len(resp.Choices) == 0 {
+			return ""
+		}
+		return resp.Choices[0].Message.Content
+	}
+
+	var reply strings.Builder
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data: "))
+		if !ok {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		// The last line of an interrupted stream may be incomplete
+		if json.Unmarshal(data, &chunk) != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		reply.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	return reply.String()
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vertigo/internal/db"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestConversationManager(t *testing.T) *Manager {
+	t.Helper()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &Manager{ConversationStore: store.NewConversationStore(database), Log: logger}
+}
+
+func message(role, content string) map[string]interface{} {
+	return map[string]interface{}{"role": role, "content": content}
+}
+
+func roles(reqBodyMap map[string]interface{}) []string {
+	var roles []string
+	for _, m := range reqBodyMap["messages"].([]interface{}) {
+		roles = append(roles, m.(map[string]interface{})["role"].(string))
+	}
+	return roles
+}
+
+func TestInjectHistory(t *testing.T) {
+	pm := newTestConversationManager(t)
+	pm.ConversationStore.AddMessage("c1", "user", "hi")
+	pm.ConversationStore.AddMessage("c1", "assistant", "hello")
+
+	reqBodyMap := map[string]interface{}{"messages": []interface{}{message("system", "Be brief."), message("user", "and then?")}}
+	pm.injectHistory(context.Background(), reqBodyMap, "c1")
+	if got, want := roles(reqBodyMap), []string{"system", "user", "assistant", "user"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages have roles %v, want %v", got, want)
+	}
+
+	// A client that resends the conversation gets no second copy of it
+	reqBodyMap = map[string]interface{}{"messages": []interface{}{message("user", "hi"), message("assistant", "hello"), message("user", "and then?")}}
+	pm.injectHistory(context.Background(), reqBodyMap, "c1")
+	if got := len(reqBodyMap["messages"].([]interface{})); got != 3 {
+		t.Errorf("request has %d messages, want the 3 it was sent with", got)
+	}
+
+	reqBodyMap = map[string]interface{}{"messages": []interface{}{message("user", "and then?")}}
+	pm.injectHistory(context.Background(), reqBodyMap, DefaultConversationID)
+	if got := len(reqBodyMap["messages"].([]interface{})); got != 1 {
+		t.Errorf("history was added to the default conversation")
+	}
+}
+
+func TestSaveExchangeKeepsPartialReplies(t *testing.T) {
+	pm := newTestConversationManager(t)
+	// A stream cut off in the middle of its second chunk
+	body := []byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\ndata: {\"choi")
+	pm.saveExchange("c1", "hi", body, true)
+
+	conv, err := pm.ConversationStore.GetConversation("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []store.Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "Hello"}}
+	if len(conv.Messages) != len(want) {
+		t.Fatalf("saved %d messages, want %d", len(conv.Messages), len(want))
+	}
+	for i, msg := range conv.Messages {
+		if msg.Role != want[i].Role || msg.Content != want[i].Content {
+			t.Errorf("message %d = %s %q, want %s %q", i, msg.Role, msg.Content, want[i].Role, want[i].Content)
+		}
+	}
+}
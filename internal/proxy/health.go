@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for the background key prober.
+const (
+	defaultHealthCheckInterval  = time.Minute
+	defaultHealthCheckIdleAfter = 10 * time.Minute
+)
+
+// RunHealthChecks probes keys in the background until ctx is done, so that recovered keys are restored
+// before their quarantine runs out and revoked keys are found before a request is sent with them. The
+// settings are read again for every round, so a reload can change the interval or turn the checks on and off.
+func (pm *Manager) RunHealthChecks(ctx context.Context) {
+	for {
+		hc := pm.Settings().HealthCheck
+		if hc.Enabled {
+			pm.checkKeys(ctx)
+		}
+
+		interval := hc.Interval
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkKeys runs one round of probes over the keys that are due: quarantined keys, and suspect keys, which
+// have not been shown to work since they joined the pool or last failed, once they have been neither used
+// nor probed for the idle period. Keys that are known to work are not probed, since a probe with a model is
+// a paid completion. Disabled keys are left alone. A key quarantined for a single model, such as one whose
+// quota for that model ran out, is probed with that model, since listing models or completing with another
+// model says nothing about that quota.
+func (pm *Manager) checkKeys(ctx context.Context) {
+	idleAfter := pm.Settings().HealthCheck.IdleAfter
+	if idleAfter <= 0 {
+		idleAfter = defaultHealthCheckIdleAfter
+	}
+
+	for _, p := range pm.Settings().Providers {
+		model := pm.probeModel(p)
+		keys, statuses := p.KeyManager.snapshot()
+		for i, key := range keys {
+			status := statuses[i]
+			if status.Disabled {
+				continue
+			}
+			now := time.Now()
+			quarantined := (status.IsBad && now.Before(status.BadUntil)) || now.Before(status.ModelBadUntil[model])
+			if quarantined || (status.suspect() && !now.Before(probeDue(status, i, len(keys), idleAfter))) {
+				result := pm.probe(ctx, p, key, model)
+				if ctx.Err() != nil {
+					return
+				}
+				pm.logProbe(p, i, result, quarantined)
+				if !result.OK {
+					continue
+				}
+			}
+
+			for _, m := range slices.Sorted(maps.Keys(status.ModelBadUntil)) {
+				if m == model || !now.Before(status.ModelBadUntil[m]) {
+					continue
+				}
+				result := pm.probe(ctx, p, key, m)
+				if ctx.Err() != nil {
+					return
+				}
+				pm.logProbe(p, i, result, true)
+			}
+		}
+	}
+}
+
+// probeDue returns when a key that is not quarantined is due for a probe: idleAfter after it was last used
+// or probed. The first probes of keys that have never been used are spread over idleAfter by their position
+// in the pool, so that a new pool, e.g. at startup, is not probed all at once.
+func probeDue(status KeyStatus, index, n int, idleAfter time.Duration) time.Time {
+	lastSeen := status.LastUsed
+	if status.LastProbe.After(lastSeen) {
+		lastSeen = status.LastProbe
+	}
+	if lastSeen.IsZero() {
+		return status.Added.Add(idleAfter * time.Duration(index) / time.Duration(n))
+	}
+	return lastSeen.Add(idleAfter)
+}
+
+// logProbe logs the outcome of a key probe.
+func (pm *Manager) logProbe(p *Provider, index int, result ProbeResult, quarantined bool) {
+	log := pm.Log.WithFields(logrus.Fields{"provider": p.Name, "key_index": index, "model": result.Model})
+	switch {
+	case result.OK && quarantined:
+		log.Info("Key recovered, lifted its quarantine")
+	case result.Status == http.StatusUnauthorized || result.Status == http.StatusForbidden:
+		log.Warnf("Key rejected by upstream and quarantined, it may have been revoked: %s", result.Error)
+	case !result.OK:
+		log.Infof("Key probe failed: %s", result.Error)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+)
+
+// probeUpstream is a fake upstream that records the probes it receives, as "GET /models" or
+// "POST <model>", and rejects completions for the models in limited with a rate limit.
+type probeUpstream struct {
+	mu      sync.Mutex
+	probes  []string
+	limited map[string]bool
+}
+
+func (u *probeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	probe := r.Method + " " + r.URL.Path
+	var model string
+	if r.Method == http.MethodPost {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		model = body.Model
+		probe = "POST " + model
+	}
+	u.mu.Lock()
+	u.probes = append(u.probes, probe)
+	limited := u.limited[model]
+	u.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if limited {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"quota exceeded"}}`)
+		return
+	}
+	fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"pong"}}]}`)
+}
+
+func newTestHealthManager(t *testing.T, upstream http.Handler, keys []string) (*Manager, *Provider) {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := gemini.NewClient(server.URL, 0, logger)
+	p := &Provider{Name: "test", Models: []string{"*"}, Client: client, KeyManager: NewKeyManager(keys)}
+	pm := &Manager{Log: logger}
+	pm.settings.Store(&Settings{Providers: []*Provider{p}})
+	return pm, p
+}
+
+func TestCheckKeysProbesModelQuarantinesWithTheirModel(t *testing.T) {
+	upstream := &probeUpstream{limited: map[string]bool{"gemini-b": true}}
+	pm, p := newTestHealthManager(t, upstream, []string{"k1", "k2"})
+	for _, key := range []string{"k1", "k2"} {
+		p.KeyManager.RecordSuccess(key)
+	}
+	// k1 ran out of quota for gemini-a, which has since recovered, and for gemini-b, which has not
+	p.KeyManager.MarkKeyAsBadForModel("k1", "gemini-a", time.Hour)
+	p.KeyManager.MarkKeyAsBadForModel("k1", "gemini-b", time.Hour)
+
+	pm.checkKeys(context.Background())
+
+	// No model is configured for probes, yet listing models says nothing about a model's quota
+	if got, want := strings.Join(upstream.probes, ", "), "POST gemini-a, POST gemini-b"; got != want {
+		t.Errorf("probes = %s, want %s", got, want)
+	}
+	_, statuses := p.KeyManager.snapshot()
+	if until, ok := statuses[0].ModelBadUntil["gemini-a"]; ok && time.Now().Before(until) {
+		t.Error("the recovered gemini-a quarantine was not lifted")
+	}
+	if !time.Now().Before(statuses[0].ModelBadUntil["gemini-b"]) {
+		t.Error("the gemini-b quarantine was lifted though its probe was rate limited")
+	}
+}
+
+func TestCheckKeysListsModelsForKeyQuarantines(t *testing.T) {
+	upstream := &probeUpstream{}
+	pm, p := newTestHealthManager(t, upstream, []string{"k1"})
+	p.KeyManager.RecordSuccess("k1")
+	p.KeyManager.MarkKeyAsBad("k1", time.Hour)
+	p.KeyManager.MarkKeyAsBadForModel("k1", "gemini-a", time.Hour)
+
+	pm.checkKeys(context.Background())
+
+	// The key as a whole is restored by listing models, and its model quarantine by a completion
+	if got, want := strings.Join(upstream.probes, ", "), "GET /models, POST gemini-a"; got != want {
+		t.Errorf("probes = %s, want %s", got, want)
+	}
+	_, statuses := p.KeyManager.snapshot()
+	if statuses[0].IsBad || len(statuses[0].ModelBadUntil) != 0 {
+		t.Errorf("status = %+v, want every quarantine lifted", statuses[0])
+	}
+}
+
+func TestCheckKeysSpreadsFirstProbes(t *testing.T) {
+	upstream := &probeUpstream{}
+	keys := []string{"k1", "k2", "k3", "k4"}
+	pm, p := newTestHealthManager(t, upstream, keys)
+	pm.settings.Store(&Settings{Providers: []*Provider{p}, HealthCheck: config.HealthCheckConfig{IdleAfter: time.Hour}})
+
+	// Only the first key of a new pool is due at once, the others over the next hour
+	pm.checkKeys(context.Background())
+	if len(upstream.probes) != 1 {
+		t.Errorf("%d probes of a new pool, want 1", len(upstream.probes))
+	}
+}
+
+func TestCheckKeysProbesOnlySuspectKeys(t *testing.T) {
+	upstream := &probeUpstream{}
+	pm, p := newTestHealthManager(t, upstream, []string{"works", "failed", "new"})
+	pm.settings.Store(&Settings{Providers: []*Provider{p}, HealthCheck: config.HealthCheckConfig{IdleAfter: time.Nanosecond}})
+	p.KeyManager.RecordSuccess("works")
+	p.KeyManager.RecordError("failed", errors.New("upstream error"))
+	time.Sleep(time.Millisecond)
+
+	pm.checkKeys(context.Background())
+
+	_, statuses := p.KeyManager.snapshot()
+	for i, wantProbe := range []bool{false, true, true} {
+		if probed := !statuses[i].LastProbe.IsZero(); probed != wantProbe {
+			t.Errorf("key %d probed = %v, want %v", i, probed, wantProbe)
+		}
+	}
+
+	// Having passed their probes, the keys are no longer suspect
+	upstream.probes = nil
+	time.Sleep(time.Millisecond)
+	pm.checkKeys(context.Background())
+	if len(upstream.probes) != 0 {
+		t.Errorf("probes = %v of keys known to work, want none", upstream.probes)
+	}
+}
+
+func TestRunHealthChecksStopsWithContext(t *testing.T) {
+	pm, _ := newTestHealthManager(t, &probeUpstream{}, []string{"k1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pm.RunHealthChecks(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunHealthChecks() kept running after its context was cancelled")
+	}
+}
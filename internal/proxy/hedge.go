@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vertigo/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HedgeHeader turns request hedging on ("true") or off ("false") for a single request, overriding the
+// virtual model and model settings.
+const HedgeHeader = "X-Vertigo-Hedge"
+
+// defaultHedgeDelay is how long the first attempt may take to start responding before a hedge is sent.
+const defaultHedgeDelay = 2 * time.Second
+
+// Which attempt of a hedged request answered.
+const (
+	hedgePrimary = "primary"
+	hedgeSecond  = "hedge"
+)
+
+// hedgeOutcome describes a hedged upstream call.
+type hedgeOutcome struct {
+	// winner is hedgePrimary or hedgeSecond.
+	winner string
+	// lostKey is the key of the attempt that was canceled while still in flight, if any.
+	lostKey string
+	// lostPromptTokens estimates the prompt tokens of the canceled attempt, which upstream may bill.
+	lostPromptTokens int
+}
+
+// hedgeAttempt is the outcome of one of the concurrent attempts of a hedged call.
+type hedgeAttempt struct {
+	apiKey string
+	hedge  bool
+	body   io.ReadCloser
+	err    error
+	ctx    context.Context
+	// cancel cancels the attempt and frees the queue slot taken for it, if any.
+	cancel context.CancelFunc
+}
+
+// hedgeDelay returns how long to wait before hedging a request for model, or 0 if the request is not
+// hedged. The X-Vertigo-Hedge header takes precedence over the virtual model and the model settings.
+func (pm *Manager) hedgeDelay(model string, selection Selection, header http.Header) time.Duration {
+	settings := pm.Settings()
+	hedge := selection.Hedge || settings.Models[model].Hedge
+	if v := header.Get(HedgeHeader); v != "" {
+		if on, err := strconv.ParseBool(v); err == nil {
+			hedge = on
+		}
+	}
+	if !hedge {
+		return 0
+	}
+	return orDefaultDuration(settings.Hedging.Delay, defaultHedgeDelay)
+}
+
+// sendHedged makes the first attempt of a hedged request with apiKey. If it has not started responding
+// after delay, a second attempt is sent with another available key and a queue slot of its own, and
+// whichever starts responding first wins while the other is canceled. The hedge is skipped if there is no
+// key or slot for it. A failed attempt is handled like in sendWithKeyFailover; retry
+// reports whether the caller may go on with the remaining keys.
+func (pm *Manager) sendHedged(ctx context.Context, provider *Provider, circuit *circuitBreaker, model, apiKey string, requestBody []byte, stream bool, delay time.Duration, tried map[string]bool) (result *upstreamResult, retry bool, err error) {
+	results := make(chan hedgeAttempt, 2)
+	var attempts []hedgeAttempt
+	start := func(key string, hedge bool, release func()) {
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		cancel := func() {
+			cancelAttempt()
+			release()
+		}
+		attempts = append(attempts, hedgeAttempt{apiKey: key, hedge: hedge, ctx: attemptCtx, cancel: cancel})
+		go func() {
+			body, err := pm.callUpstream(attemptCtx, provider, key, model, requestBody, stream)
+			results <- hedgeAttempt{apiKey: key, hedge: hedge, body: body, err: err, ctx: attemptCtx, cancel: cancel}
+		}()
+	}
+	// discard cancels the attempts other than keep that are still in flight, and closes any response they
+	// return anyway.
+	discard := func(pending int, keep string) {
+		for _, a := range attempts {
+			if a.apiKey != keep {
+				a.cancel()
+			}
+		}
+		go func() {
+			for ; pending > 0; pending-- {
+				if a := <-results; a.err == nil {
+					a.body.Close()
+				}
+			}
+		}()
+	}
+
+	// The first attempt uses the slot of the request
+	start(apiKey, false, func() {})
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedged := false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			log := pm.Log.WithFields(logrus.Fields{"provider": provider.Name, "model": model, "delay": delay})
+			key := provider.KeyManager.GetNextAvailableKeyForModel(model, tried)
+			if key == "" {
+				log.Debug("First attempt is slow, but no other key is available for a hedged request")
+				metrics.SkippedHedges.WithLabelValues(metrics.ModelLabel(model), "no_key").Inc()
+				continue
+			}
+			release, ok := pm.tryAcquireSlot(provider, model)
+			if !ok {
+				log.Debug("First attempt is slow, but no slot is free for a hedged request")
+				metrics.SkippedHedges.WithLabelValues(metrics.ModelLabel(model), "no_slot").Inc()
+				continue
+			}
+			tried[key] = true
+			hedged = true
+			log.WithField("key_index", provider.KeyManager.KeyIndex(key)).Debug("First attempt is slow, sending a hedged request")
+			start(key, true, release)
+			pending++
+
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				provider.KeyManager.RecordSuccess(a.apiKey)
+				result = &upstreamResult{
+					body:     &closeHook{ReadCloser: a.body, onClose: a.cancel},
+					provider: provider,
+					apiKey:   a.apiKey,
+				}
+				if hedged {
+					outcome := &hedgeOutcome{winner: hedgePrimary}
+					if a.hedge {
+						outcome.winner = hedgeSecond
+					}
+					if pending > 0 {
+						for _, other := range attempts {
+							if other.apiKey != a.apiKey {
+								outcome.lostKey = other.apiKey
+							}
+						}
+						outcome.lostPromptTokens = promptTokens(requestBody)
+						discard(pending, a.apiKey)
+					}
+					result.hedge = outcome
+					metrics.HedgedRequests.WithLabelValues(metrics.ModelLabel(model), outcome.winner).Inc()
+				}
+				return result, false, nil
+			}
+			a.cancel()
+			err = a.err
+			if ctx.Err() != nil {
+				discard(pending, "")
+				return nil, false, err
+			}
+			if !pm.handleKeyError(provider, a.apiKey, model, a.err) || circuit.isOpen() {
+				discard(pending, "")
+				return nil, false, err
+			}
+			if !hedged {
+				// The first attempt failed before the delay; the caller fails over as usual
+				return nil, true, err
+			}
+		}
+	}
+	if hedged {
+		metrics.HedgedRequests.WithLabelValues(metrics.ModelLabel(model), "none").Inc()
+	}
+	return nil, true, err
+}
+
+// promptTokens estimates the prompt tokens of an encoded request from its message text, like the router.
+func promptTokens(requestBody []byte) int {
+	var reqBody RequestBody
+	if err := json.Unmarshal(requestBody, &reqBody); err != nil {
+		return 0
+	}
+	return extractFeatures(&reqBody).PromptTokens
+}
+
+// closeHook runs onClose once the response body has been closed, e.g. to cancel the context of the
+// upstream attempt or to free its queue slot.
+type closeHook struct {
+	io.ReadCloser
+	onClose func()
+}
+
+func (c *closeHook) Close() error {
+	err := c.ReadCloser.Close()
+	c.onClose()
+	return err
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+)
+
+// slowKeyUpstream answers completions at once, except those sent with the slow key, which it holds
+// until the request is canceled or 100ms have passed. It counts the requests it receives.
+type slowKeyUpstream struct {
+	slow     string
+	requests atomic.Int32
+}
+
+func (u *slowKeyUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.requests.Add(1)
+	if r.Header.Get("Authorization") == "Bearer "+u.slow {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"pong"}}]}`)
+}
+
+func newTestHedgeManager(t *testing.T, upstream http.Handler, keys []string, settings *Settings) *Manager {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	p := &Provider{Name: "test", Models: []string{"*"}, Client: gemini.NewClient(server.URL, 0, logger), KeyManager: NewKeyManager(keys)}
+	pm := &Manager{Log: logger, circuits: newCircuitBreakers(), queues: newSlotQueues()}
+	settings.Providers = []*Provider{p}
+	pm.settings.Store(settings)
+	return pm
+}
+
+func hedgeRequest() map[string]interface{} {
+	return map[string]interface{}{
+		"model":    "gemini-a",
+		"messages": []interface{}{message("system", strings.Repeat("s", 400)), message("user", strings.Repeat("u", 400))},
+	}
+}
+
+func TestHedgeWinsOverSlowAttempt(t *testing.T) {
+	upstream := &slowKeyUpstream{slow: "k1"}
+	pm := newTestHedgeManager(t, upstream, []string{"k1", "k2"}, &Settings{})
+
+	result, err := pm.sendModel(context.Background(), "gemini-a", hedgeRequest(), false, sendOptions{hedgeDelay: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.body.Close()
+
+	if result.apiKey != "k2" || result.hedge == nil || result.hedge.winner != hedgeSecond || result.hedge.lostKey != "k1" {
+		t.Fatalf("result key %s, hedge %+v; want k2 to win over k1", result.apiKey, result.hedge)
+	}
+	// The message text, not the encoded body, is what the lost attempt is billed for
+	if want := estimateTokens(802); result.hedge.lostPromptTokens != want {
+		t.Errorf("lostPromptTokens = %d, want %d", result.hedge.lostPromptTokens, want)
+	}
+}
+
+func TestHedgeIsSkippedWithoutKeyOrSlot(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		settings *Settings
+	}{
+		{"no other key", []string{"k1"}, &Settings{}},
+		{"no free slot", []string{"k1", "k2"}, &Settings{Models: map[string]config.ModelConfig{"gemini-a": {MaxConcurrency: 1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &slowKeyUpstream{slow: "k1"}
+			pm := newTestHedgeManager(t, upstream, tt.keys, tt.settings)
+
+			result, err := pm.sendModel(context.Background(), "gemini-a", hedgeRequest(), false, sendOptions{
+				hedgeDelay: 20 * time.Millisecond, queueDeadline: time.Now().Add(time.Second),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result.body.Close()
+
+			if result.apiKey != "k1" || result.hedge != nil {
+				t.Errorf("result key %s, hedge %+v; want the first attempt to answer alone", result.apiKey, result.hedge)
+			}
+			if n := upstream.requests.Load(); n != 1 {
+				t.Errorf("upstream received %d requests, want 1", n)
+			}
+			if n := len(pm.queues.queues); n != 0 {
+				t.Errorf("%d queues left after the request, want none", n)
+			}
+		})
+	}
+}
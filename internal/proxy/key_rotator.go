@@ -3,29 +3,98 @@ package proxy
 import (
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"vertigo/internal/metrics"
 )
 
 // KeyStatus represents the status of an API key.
 type KeyStatus struct {
-	IsBad     bool
-	BadUntil  time.Time
+	IsBad    bool
+	BadUntil time.Time
+	// ModelBadUntil holds per-model quarantines, e.g. when a key has exhausted its quota for one model only.
+	ModelBadUntil map[string]time.Time
+	// Disabled keys are skipped until they are enabled again through the admin API.
+	Disabled bool
+
+	// Usage counters since the key was added to the pool.
+	Requests         int64
+	Errors           int64
+	PromptTokens     int64
+	CompletionTokens int64
+	LastUsed         time.Time
+	LastError        string
+	LastErrorAt      time.Time
+
+	// LastProbe is when the key was last probed, and LastProbeOK whether that probe succeeded.
+	LastProbe   time.Time
+	LastProbeOK bool
+	// Added is when the key joined the pool.
+	Added time.Time
+}
+
+func newKeyStatus() *KeyStatus {
+	return &KeyStatus{ModelBadUntil: make(map[string]time.Time), Added: time.Now()}
+}
+
+// suspect reports whether nothing shows that the key works: it has neither served a request nor passed a
+// probe since it joined the pool or last failed.
+func (s *KeyStatus) suspect() bool {
+	// A failed request sets LastErrorAt and LastUsed alike, so only a later LastUsed is a success
+	okAt, failedAt := time.Time{}, s.LastErrorAt
+	if s.LastUsed.After(s.LastErrorAt) {
+		okAt = s.LastUsed
+	}
+	if s.LastProbeOK && s.LastProbe.After(okAt) {
+		okAt = s.LastProbe
+	}
+	if !s.LastProbeOK && s.LastProbe.After(failedAt) {
+		failedAt = s.LastProbe
+	}
+	return okAt.IsZero() || failedAt.After(okAt)
+}
+
+// maxLastErrorLength bounds the upstream error message kept for a key.
+const maxLastErrorLength = 300
+
+// truncateError shortens an error message to at most maxLastErrorLength bytes and marks the cut. The cut
+// is made at a rune boundary so the message stays valid UTF-8.
+func truncateError(msg string) string {
+	if len(msg) <= maxLastErrorLength {
+		return msg
+	}
+	n := maxLastErrorLength
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n] + "..."
+}
+
+// ContextCache is a Gemini context cache. It belongs to the key that created it and can only be used with that key.
+type ContextCache struct {
+	Name       string
+	Key        string
+	ExpireTime time.Time
+	Tokens     int
 }
 
 // KeyManager manages a list of API keys and their statuses.
 type KeyManager struct {
-	keys      []string
-	keyStatus map[string]*KeyStatus // Map key to its status
-	mutex     sync.Mutex
+	keys          []string
+	keyStatus     map[string]*KeyStatus    // Map key to its status
+	contextCaches map[string]*ContextCache // Map prefix ID to the context cache created for it
+	mutex         sync.Mutex
 }
 
 // NewKeyManager creates a new KeyManager with the given API keys.
 func NewKeyManager(keys []string) *KeyManager {
 	km := &KeyManager{
-		keys:      keys,
-		keyStatus: make(map[string]*KeyStatus),
+		keys:          keys,
+		keyStatus:     make(map[string]*KeyStatus),
+		contextCaches: make(map[string]*ContextCache),
 	}
 	for _, key := range keys {
-		km.keyStatus[key] = &KeyStatus{IsBad: false}
+		km.keyStatus[key] = newKeyStatus()
 	}
 	return km
 }
@@ -33,20 +102,102 @@ func NewKeyManager(keys []string) *KeyManager {
 // GetNextAvailableKey returns the next available API key. It prioritizes keys that are not marked as bad.
 // If all keys are bad, it will return an empty string.
 func (km *KeyManager) GetNextAvailableKey() string {
+	return km.GetNextAvailableKeyForModel("", nil)
+}
+
+// GetNextAvailableKeyForModel returns the next available API key for the given model, skipping keys in exclude
+// and keys quarantined for that model. If no key is available, it will return an empty string.
+func (km *KeyManager) GetNextAvailableKeyForModel(model string, exclude map[string]bool) string {
 	km.mutex.Lock()
 	defer km.mutex.Unlock()
 
+	now := time.Now()
 	for _, key := range km.keys {
+		if exclude[key] {
+			continue
+		}
 		status := km.keyStatus[key]
-		if !status.IsBad || time.Now().After(status.BadUntil) {
-			// If the key is not bad, or if it was bad but the badUntil time has passed, mark it as good and return it.
-			status.IsBad = false
-			return key
+		if status.Disabled || (status.IsBad && now.Before(status.BadUntil)) {
+			continue
+		}
+		// If the key was bad but the badUntil time has passed, mark it as good.
+		status.IsBad = false
+		if until, ok := status.ModelBadUntil[model]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(status.ModelBadUntil, model)
 		}
+		return key
 	}
 	return "" // No available key
 }
 
+// RetryAfter returns how long until some key becomes usable for the model again,
+// or zero if one is usable now.
+func (km *KeyManager) RetryAfter(model string) time.Duration {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range km.keys {
+		status := km.keyStatus[key]
+		if status.Disabled {
+			continue
+		}
+		until := now
+		if status.IsBad && status.BadUntil.After(until) {
+			until = status.BadUntil
+		}
+		if modelUntil, ok := status.ModelBadUntil[model]; ok && modelUntil.After(until) {
+			until = modelUntil
+		}
+		d := until.Sub(now)
+		if d <= 0 {
+			return 0
+		}
+		if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// KeyIndex returns the position of a key in the pool, or -1 if it is not part of it.
+// The index identifies a key in logs and reports without revealing it.
+func (km *KeyManager) KeyIndex(key string) int {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	for i, k := range km.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// KeyStates reports the current health of every key, for metrics.
+func (km *KeyManager) KeyStates() []metrics.KeyState {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	now := time.Now()
+	states := make([]metrics.KeyState, 0, len(km.keys))
+	for i, key := range km.keys {
+		status := km.keyStatus[key]
+		state := metrics.KeyState{Index: i, Healthy: !status.Disabled && (!status.IsBad || now.After(status.BadUntil))}
+		for _, until := range status.ModelBadUntil {
+			if now.Before(until) {
+				state.QuarantinedModels++
+			}
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
 // MarkKeyAsBad marks a key as bad for a certain duration.
 func (km *KeyManager) MarkKeyAsBad(key string, duration time.Duration) {
 	km.mutex.Lock()
@@ -57,3 +208,232 @@ func (km *KeyManager) MarkKeyAsBad(key string, duration time.Duration) {
 		status.BadUntil = time.Now().Add(duration)
 	}
 }
+
+// MarkKeyAsBadForModel marks a key as bad for a single model for a certain duration.
+func (km *KeyManager) MarkKeyAsBadForModel(key, model string, duration time.Duration) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if status, ok := km.keyStatus[key]; ok {
+		status.ModelBadUntil[model] = time.Now().Add(duration)
+	}
+}
+
+// GetContextCache returns the context cache stored for a prefix ID if it has not expired
+// and the key that owns it is currently usable for the model.
+func (km *KeyManager) GetContextCache(id, model string) (*ContextCache, bool) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	cc, ok := km.contextCaches[id]
+	if !ok {
+		return nil, false
+	}
+	// Leave a margin so the cache does not expire while the request is in flight
+	if time.Now().Add(30 * time.Second).After(cc.ExpireTime) {
+		delete(km.contextCaches, id)
+		return nil, false
+	}
+
+	status, ok := km.keyStatus[cc.Key]
+	if !ok || status.Disabled {
+		return nil, false
+	}
+	now := time.Now()
+	if status.IsBad && now.Before(status.BadUntil) {
+		return nil, false
+	}
+	if until, ok := status.ModelBadUntil[model]; ok && now.Before(until) {
+		return nil, false
+	}
+	return cc, true
+}
+
+// SetContextCache records a context cache for a prefix ID, pinning later requests for that prefix to its key.
+func (km *KeyManager) SetContextCache(id string, cc *ContextCache) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	km.contextCaches[id] = cc
+}
+
+// RemoveContextCache forgets the context cache for a prefix ID, e.g. after Gemini rejected it.
+func (km *KeyManager) RemoveContextCache(id string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	delete(km.contextCaches, id)
+}
+
+// Keys returns the keys of the pool in order.
+func (km *KeyManager) Keys() []string {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	return append([]string(nil), km.keys...)
+}
+
+// SetKeys replaces the keys of the pool. Keys that stay in the pool keep their quarantines, new keys
+// start out healthy, and the context caches owned by removed keys are forgotten. It returns the number
+// of keys added and removed.
+func (km *KeyManager) SetKeys(keys []string) (added, removed int) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	keyStatus := make(map[string]*KeyStatus, len(keys))
+	for _, key := range keys {
+		if _, ok := keyStatus[key]; ok {
+			continue
+		}
+		if status, ok := km.keyStatus[key]; ok {
+			keyStatus[key] = status
+			continue
+		}
+		keyStatus[key] = newKeyStatus()
+		added++
+	}
+	for key := range km.keyStatus {
+		if _, ok := keyStatus[key]; !ok {
+			removed++
+		}
+	}
+	for id, cc := range km.contextCaches {
+		if _, ok := keyStatus[cc.Key]; !ok {
+			delete(km.contextCaches, id)
+		}
+	}
+
+	km.keys = append([]string(nil), keys...)
+	km.keyStatus = keyStatus
+	return added, removed
+}
+
+// AddKey adds a healthy key to the end of the pool. It reports false if the key is already in the pool.
+func (km *KeyManager) AddKey(key string) bool {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if _, ok := km.keyStatus[key]; ok {
+		return false
+	}
+	km.keys = append(km.keys, key)
+	km.keyStatus[key] = newKeyStatus()
+	return true
+}
+
+// RemoveKey removes a key and its context caches from the pool. It reports false if the key is not in the pool.
+func (km *KeyManager) RemoveKey(key string) bool {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if _, ok := km.keyStatus[key]; !ok {
+		return false
+	}
+	keys := make([]string, 0, len(km.keys)-1)
+	for _, k := range km.keys {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	km.keys = keys
+	delete(km.keyStatus, key)
+	for id, cc := range km.contextCaches {
+		if cc.Key == key {
+			delete(km.contextCaches, id)
+		}
+	}
+	return true
+}
+
+// SetDisabled disables or re-enables a key. It reports false if the key is not in the pool.
+func (km *KeyManager) SetDisabled(key string, disabled bool) bool {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	status, ok := km.keyStatus[key]
+	if !ok {
+		return false
+	}
+	status.Disabled = disabled
+	return true
+}
+
+// MarkKeyAsGood lifts the quarantine of a key for all models and, if model is set, its quarantine for
+// that model, e.g. after a probe found it working again. Other per-model quarantines stay in place,
+// since they are usually quota limits the probe did not test.
+func (km *KeyManager) MarkKeyAsGood(key, model string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if status, ok := km.keyStatus[key]; ok {
+		status.IsBad = false
+		status.BadUntil = time.Time{}
+		if model != "" {
+			delete(status.ModelBadUntil, model)
+		}
+	}
+}
+
+// RecordProbe records the outcome of a health probe of a key.
+func (km *KeyManager) RecordProbe(key string, ok bool) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if status, found := km.keyStatus[key]; found {
+		status.LastProbe = time.Now()
+		status.LastProbeOK = ok
+	}
+}
+
+// RecordSuccess counts a successful upstream call made with a key.
+func (km *KeyManager) RecordSuccess(key string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if status, ok := km.keyStatus[key]; ok {
+		status.Requests++
+		status.LastUsed = time.Now()
+	}
+}
+
+// RecordError counts a failed upstream call made with a key and keeps its error message.
+func (km *KeyManager) RecordError(key string, err error) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if status, ok := km.keyStatus[key]; ok {
+		status.Requests++
+		status.Errors++
+		status.LastUsed = time.Now()
+		status.LastError = truncateError(err.Error())
+		status.LastErrorAt = status.LastUsed
+	}
+}
+
+// RecordTokens adds the token usage of a response to the counters of the key that served it.
+func (km *KeyManager) RecordTokens(key string, usage Usage) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if status, ok := km.keyStatus[key]; ok {
+		status.PromptTokens += int64(usage.PromptTokens)
+		status.CompletionTokens += int64(usage.CompletionTokens)
+	}
+}
+
+// snapshot returns the keys of the pool in order together with copies of their statuses.
+func (km *KeyManager) snapshot() ([]string, []KeyStatus) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	statuses := make([]KeyStatus, 0, len(km.keys))
+	for _, key := range km.keys {
+		status := *km.keyStatus[key]
+		status.ModelBadUntil = make(map[string]time.Time, len(km.keyStatus[key].ModelBadUntil))
+		for model, until := range km.keyStatus[key].ModelBadUntil {
+			status.ModelBadUntil[model] = until
+		}
+		statuses = append(statuses, status)
+	}
+	return append([]string(nil), km.keys...), statuses
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRecordErrorKeepsValidUTF8(t *testing.T) {
+	km := NewKeyManager([]string{"key-1"})
+	// A multi-byte rune straddles the length limit
+	km.RecordError("key-1", errors.New(strings.Repeat("a", maxLastErrorLength-1)+"é and more"))
+
+	_, statuses := km.snapshot()
+	got := statuses[0].LastError
+	if !utf8.ValidString(got) {
+		t.Errorf("last error %q is not valid UTF-8", got)
+	}
+	if want := strings.Repeat("a", maxLastErrorLength-1) + "..."; got != want {
+		t.Errorf("last error = %q, want %q", got, want)
+	}
+}
@@ -1,63 +1,386 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"vertigo/internal/cache"
+	"vertigo/internal/config"
 	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
 	"vertigo/internal/store"
-	"time"
+	"vertigo/internal/tracing"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Manager handles API key rotation, model selection, and request forwarding.
 type Manager struct {
-	KeyManager      *KeyManager
 	ConversationStore *store.ConversationStore
-	GeminiClient    *gemini.Client
-	Log             *logrus.Logger
+	ResponseCache     cache.Cache          // Nil when caching is disabled
+	SemanticCache     *cache.SemanticCache // Nil when semantic caching is disabled
+	contextCaches     *contextCacheTracker
+	circuits          *circuitBreakers
+	queues            *slotQueues
+	UsageStore        *store.UsageStore // Nil when usage accounting is disabled
+	KeyStore          *store.KeyStore   // Nil when runtime key changes are not persisted
+	FileStore         *store.FileStore  // Nil when the batch API is disabled
+	BatchStore        *store.BatchStore // Nil when the batch API is disabled
+	Log               *logrus.Logger
+
+	settings atomic.Pointer[Settings]
+	// reloadMu serializes reloads and runtime key changes, and guards keyOverrides.
+	reloadMu     sync.Mutex
+	keyOverrides []store.KeyOverride
+}
+
+// Settings are the parts of the configuration that Reload replaces while the server is running.
+// They are never modified once in use; a reload swaps in a new Settings instead.
+type Settings struct {
+	// Providers are the upstream APIs, each with its own key pool, in routing order.
+	Providers          []*Provider
+	Routing            config.RoutingConfig
+	Models             map[string]config.ModelConfig
+	Timeouts           config.TimeoutsConfig
+	CacheConfig        config.CacheConfig
+	ContextCacheConfig config.ContextCacheConfig
+	HealthCheck        config.HealthCheckConfig
+	CircuitBreaker     config.CircuitBreakerConfig
+	Hedging            config.HedgingConfig
+	Queue              config.QueueConfig
+}
+
+// ErrNoKeysAvailable is returned when every API key is quarantined.
+var ErrNoKeysAvailable = errors.New("no API keys available")
+
+// NoKeysError reports that no key can currently serve a model. It matches ErrNoKeysAvailable
+// with errors.Is, and RetryAfter is the time until the first quarantine ends.
+type NoKeysError struct {
+	Model      string
+	RetryAfter time.Duration
+}
+
+func (e *NoKeysError) Error() string {
+	return fmt.Sprintf("%v for model %s", ErrNoKeysAvailable, e.Model)
+}
+
+func (e *NoKeysError) Unwrap() error {
+	return ErrNoKeysAvailable
+}
+
+// Response is the upstream reply to a processed request.
+type Response struct {
+	Body io.ReadCloser
+	// Model is the upstream model that actually answered, which differs from the
+	// selected model when a fallback was used.
+	Model string
+	// IncludeThoughts reports whether thought summaries were requested and should be
+	// exposed to the client as reasoning_content.
+	IncludeThoughts bool
+	// CacheStatus is CacheHit or CacheMiss when the response cache applies to the request, empty otherwise.
+	CacheStatus string
+	// CachedTokens is the number of prompt tokens served from a Gemini context cache.
+	CachedTokens int
+	// Provider is the name of the upstream provider that served the request, if any.
+	Provider string
+	// KeyIndex is the position of the upstream key in the provider's key pool, or -1 if no key was used.
+	KeyIndex int
+	// IncludeUsage reports whether the client asked for a usage chunk at the end of a stream.
+	IncludeUsage bool
+	// UpstreamLatency is the time it took upstream to start responding, including failovers.
+	UpstreamLatency time.Duration
+	// Usage is filled in when Body is closed.
+	Usage Usage
+	// Queue describes the request's wait for an upstream slot, or is nil if it did not go through the queue.
+	Queue *QueueStats
+
+	// keyManager and apiKey identify the key that served the response, so its usage can be counted against it.
+	keyManager *KeyManager
+	apiKey     string
+}
+
+// Usage holds the token counts of a response.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
 }
 
 // NewManager creates a new proxy Manager.
-func NewManager(keyManager *KeyManager, convStore *store.ConversationStore, logger *logrus.Logger) *Manager {
-	return &Manager{
-		KeyManager:      keyManager,
+func NewManager(cfg *config.Config, convStore *store.ConversationStore, logger *logrus.Logger) (*Manager, error) {
+	settings, err := newSettings(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &Manager{
 		ConversationStore: convStore,
-		GeminiClient:    gemini.NewClient(logger),
-		Log:             logger,
+		contextCaches:     newContextCacheTracker(),
+		circuits:          newCircuitBreakers(),
+		queues:            newSlotQueues(),
+		Log:               logger,
+	}
+	pm.settings.Store(settings)
+	metrics.SetKnownModels(knownModels(cfg, settings))
+	return pm, nil
+}
+
+// newSettings builds the reloadable settings from a configuration, creating its providers.
+func newSettings(cfg *config.Config, logger *logrus.Logger) (*Settings, error) {
+	routing := cfg.Routing
+	if len(routing.VirtualModels) == 0 {
+		routing.VirtualModels = DefaultVirtualModels
+	}
+
+	var providers []*Provider
+	for _, providerCfg := range cfg.UpstreamProviders() {
+		provider, err := NewProvider(providerCfg, cfg.Timeouts.Connect, logger)
+		if err != nil {
+			return nil, err
+		}
+		provider.setModelTimeouts(cfg.Models)
+		providers = append(providers, provider)
+	}
+
+	return &Settings{
+		Providers:          providers,
+		Routing:            routing,
+		Models:             cfg.Models,
+		Timeouts:           cfg.Timeouts,
+		CacheConfig:        cfg.Cache,
+		ContextCacheConfig: cfg.ContextCache,
+		HealthCheck:        cfg.HealthCheck,
+		CircuitBreaker:     cfg.CircuitBreaker,
+		Hedging:            cfg.Hedging,
+		Queue:              cfg.Queue,
+	}, nil
+}
+
+// knownModels returns the model names a configuration mentions: configured models and their fallbacks,
+// virtual models and the models they route to, models listed by providers without a pattern, probe
+// models and priced models. They are the only model names used as metric labels.
+func knownModels(cfg *config.Config, s *Settings) []string {
+	models := []string{defaultProbeModel, cfg.HealthCheck.Model}
+	for name, mc := range s.Models {
+		models = append(models, name)
+		models = append(models, mc.Fallbacks...)
+	}
+	for name, vm := range s.Routing.VirtualModels {
+		models = append(models, name, vm.Default)
+		for _, rule := range vm.Rules {
+			models = append(models, rule.Model)
+		}
+		for _, tier := range vm.Auto.Tiers {
+			models = append(models, tier.Model)
+		}
+	}
+	for _, p := range s.Providers {
+		models = append(models, p.ProbeModel)
+		for _, m := range p.Models {
+			if !strings.ContainsAny(m, "*?[") {
+				models = append(models, m)
+			}
+		}
+	}
+	for _, price := range cfg.Usage.Prices {
+		models = append(models, price.Model)
 	}
+	return models
+}
+
+// Settings returns the settings currently in effect.
+func (pm *Manager) Settings() *Settings {
+	return pm.settings.Load()
 }
 
 // ProcessRequest processes an incoming request, selects a model, rotates API keys, and forwards to Gemini.
-func (pm *Manager) ProcessRequest(requestBody []byte, conversationID string, stream bool) (io.ReadCloser, error) {
+// When every key fails for the selected model with a retriable error, the model's fallback chain is tried in order.
+func (pm *Manager) ProcessRequest(ctx context.Context, requestBody []byte, header http.Header, conversationID string, stream bool) (*Response, error) {
 	// Select the model and potentially modify the request body
-	_, modifiedBodyBytes, err := SelectModel(requestBody)
+	_, span := tracing.Tracer().Start(ctx, "proxy.select_model")
+	selection, modifiedBodyBytes, err := SelectModel(requestBody, header, pm.Settings().Routing)
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return nil, fmt.Errorf("failed to select model: %w", err)
 	}
+	span.SetAttributes(tracing.AttrModel.String(selection.Model), tracing.AttrRouteReason.String(selection.Reason))
+	span.End()
+	if selection.Virtual {
+		pm.Log.WithFields(logrus.Fields{
+			"model":  selection.Model,
+			"reason": selection.Reason,
+		}).Info("Routed virtual model")
+	}
+	selectedModel := selection.Model
 
 	var reqBodyMap map[string]interface{}
 	if err := json.Unmarshal(modifiedBodyBytes, &reqBodyMap); err != nil {
 		return nil, fmt.Errorf("failed to parse modified request body: %w", err)
 	}
 
-	// Get conversation history and add to request
-	conv, err := pm.ConversationStore.GetConversation(conversationID)
-	if err != nil {
-		pm.Log.Printf("Error getting conversation: %v", err)
-		// Continue without conversation history if there's an error
+	// Taken before any history is added, so it is the message this request adds to the conversation
+	userMessage := lastUserMessage(reqBodyMap)
+	pm.injectHistory(ctx, reqBodyMap, conversationID)
+
+	usageRecord := store.UsageRecord{
+		Timestamp:      time.Now(),
+		Model:          selectedModel,
+		Client:         ClientIdentity(header),
+		ConversationID: conversationID,
+		Stream:         stream,
+	}
+
+	// The client only gets a usage chunk if it asked for one itself
+	includeUsage := false
+	if options, ok := reqBodyMap["stream_options"].(map[string]interface{}); ok {
+		includeUsage, _ = options["include_usage"].(bool)
 	}
 
-	if conv != nil && len(conv.Messages) > 0 {
-		// Assuming the request body has a "messages" field
-		if messages, ok := reqBodyMap["messages"].([]interface{}); ok {
-			for _, msg := range conv.Messages {
-				messages = append([]interface{}{map[string]string{"role": msg.Role, "content": msg.Content}}, messages...)
+	cached, lookup := pm.checkCache(ctx, reqBodyMap, header, selection, stream)
+	if cached != nil {
+		cached.IncludeUsage = includeUsage
+		pm.recordUsage(cached, usageRecord, stream, userMessage)
+		return cached, nil
+	}
+
+	if stream {
+		// Ask upstream for a final usage chunk so streamed requests can be accounted for
+		reqBodyMap["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	upstreamStart := time.Now()
+	opts := sendOptions{
+		priority:      pm.requestPriority(header),
+		queueDeadline: upstreamStart.Add(orDefaultDuration(pm.Settings().Queue.Timeout, defaultQueueTimeout)),
+	}
+	var lastErr error
+	for i, model := range pm.modelChain(selectedModel) {
+		if i > 0 {
+			pm.Log.Warnf("Falling back from %s to %s: %v", selectedModel, model, lastErr)
+		}
+
+		reqBodyMap["model"] = model
+		if selection.ThinkingBudget != nil {
+			// Fallback models may accept a different range of budgets, or none
+			if budget, ok := setThinkingConfig(reqBodyMap, model, *selection.ThinkingBudget, selection.IncludeThoughts); ok {
+				pm.Log.Debugf("Using thinking budget %d for %s", budget, model)
 			}
-			reqBodyMap["messages"] = messages
 		}
+		opts.hedgeDelay = pm.hedgeDelay(model, selection, header)
+		result, err := pm.sendModel(ctx, model, reqBodyMap, stream, opts)
+		if err == nil {
+			response := &Response{
+				Body:            result.body,
+				Model:           model,
+				Provider:        result.provider.Name,
+				KeyIndex:        result.provider.KeyManager.KeyIndex(result.apiKey),
+				IncludeThoughts: selection.IncludeThoughts,
+				IncludeUsage:    includeUsage,
+				CachedTokens:    result.cachedTokens,
+				UpstreamLatency: time.Since(upstreamStart),
+				Queue:           result.queue,
+				keyManager:      result.provider.KeyManager,
+				apiKey:          result.apiKey,
+			}
+			if lookup.active() {
+				response.Body = &recordingReader{
+					ReadCloser: response.Body,
+					stream:     stream,
+					onComplete: func(completion []byte) { pm.storeCache(lookup, model, completion) },
+					log:        pm.Log,
+				}
+				response.CacheStatus = CacheMiss
+			}
+			if result.hedge != nil {
+				pm.recordHedge(usageRecord, model, result)
+				usageRecord.Hedge = store.HedgeWon
+			}
+			pm.recordUsage(response, usageRecord, stream, userMessage)
+			return response, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || !isRetriable(err) {
+			break
+		}
+	}
+
+	pm.recordFailure(usageRecord, lastErr)
+	return nil, fmt.Errorf("failed to get response from upstream: %w", lastErr)
+}
+
+// upstreamResult is a successful upstream call for a single model.
+type upstreamResult struct {
+	body         io.ReadCloser
+	provider     *Provider
+	apiKey       string
+	cachedTokens int
+	// hedge is set when a hedged second attempt was sent.
+	hedge *hedgeOutcome
+	queue *QueueStats
+}
+
+// sendOptions are the per-request settings of sendModel.
+type sendOptions struct {
+	// hedgeDelay hedges the first attempt when positive.
+	hedgeDelay time.Duration
+	// priority and queueDeadline place the request in the queue for an upstream slot.
+	priority      string
+	queueDeadline time.Time
+}
+
+// sendModel sends the request for a single model to the provider serving it, once it has a slot for the
+// model, using the model's context cache when there is one. The slot is held until the response is closed.
+func (pm *Manager) sendModel(ctx context.Context, model string, reqBodyMap map[string]interface{}, stream bool, opts sendOptions) (*upstreamResult, error) {
+	provider := pm.providerFor(model)
+	if provider == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, model)
+	}
+	release, queueStats, err := pm.acquireSlot(ctx, provider, model, opts.priority, opts.queueDeadline)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pm.sendModelWithSlot(ctx, provider, model, reqBodyMap, stream, opts.hedgeDelay)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	result.body = &closeHook{ReadCloser: result.body, onClose: release}
+	result.queue = queueStats
+	return result, nil
+}
+
+// sendModelWithSlot is sendModel once the request has its slot.
+func (pm *Manager) sendModelWithSlot(ctx context.Context, provider *Provider, model string, reqBodyMap map[string]interface{}, stream bool, hedgeDelay time.Duration) (*upstreamResult, error) {
+	circuit, done, err := pm.enterCircuit(provider, model)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if provider.Type != ProviderGemini {
+		providerBody := make(map[string]interface{}, len(reqBodyMap))
+		for k, v := range reqBodyMap {
+			providerBody[k] = v
+		}
+		providerBody["model"] = provider.upstreamModel(model)
+		if provider.Type != ProviderVertex {
+			// Thinking budgets are a Google extension other servers may reject
+			delete(providerBody, "extra_body")
+		}
+		reqBodyMap = providerBody
 	}
 
 	finalRequestBody, err := json.Marshal(reqBodyMap)
@@ -65,21 +388,181 @@ func (pm *Manager) ProcessRequest(requestBody []byte, conversationID string, str
 		return nil, fmt.Errorf("failed to marshal final request body: %w", err)
 	}
 
-	pm.Log.Debugf("Sending request to Gemini API: %s", finalRequestBody)
+	pm.Log.Debugf("Sending request to provider %s: %s", provider.Name, finalRequestBody)
+
+	// The circuit counts one outcome per request, however many keys it went through, so a few keys
+	// failing on one bad request cannot open it
+	result, err := pm.sendUpstream(ctx, provider, circuit, model, reqBodyMap, finalRequestBody, stream, hedgeDelay)
+	circuit.record(ctx, err)
+	return result, err
+}
+
+// sendUpstream sends an encoded request for a model to the provider, first with the model's context cache
+// if there is one, then failing over across its keys.
+func (pm *Manager) sendUpstream(ctx context.Context, provider *Provider, circuit *circuitBreaker, model string, reqBodyMap map[string]interface{}, requestBody []byte, stream bool, hedgeDelay time.Duration) (*upstreamResult, error) {
+	// Requests with a repeated large system prompt go to the key holding its context cache
+	if cacheID, cc, cachedBody := pm.contextCacheRequest(ctx, provider, model, reqBodyMap); cc != nil {
+		body, err := pm.callUpstream(ctx, provider, cc.Key, model, cachedBody, stream)
+		if err == nil {
+			provider.KeyManager.RecordSuccess(cc.Key)
+			return &upstreamResult{body: body, provider: provider, apiKey: cc.Key, cachedTokens: cc.Tokens}, nil
+		}
+		if ctx.Err() != nil || circuit.isOpen() {
+			return nil, err
+		}
+		pm.handleKeyError(provider, cc.Key, model, err)
+		var apiErr *gemini.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode < 500 && apiErr.StatusCode != http.StatusTooManyRequests {
+			// The cache may have been evicted upstream; stop referencing it
+			provider.KeyManager.RemoveContextCache(cacheID)
+		}
+	}
+
+	return pm.sendWithKeyFailover(ctx, provider, circuit, model, requestBody, stream, hedgeDelay)
+}
+
+// sendWithKeyFailover sends the request for a single model, moving on to the provider's next available key
+// after each failure. It gives up early when failing requests open the model's circuit meanwhile. With a positive
+// hedgeDelay, the first attempt is hedged with a second key if it is slow to start responding.
+func (pm *Manager) sendWithKeyFailover(ctx context.Context, provider *Provider, circuit *circuitBreaker, model string, requestBody []byte, stream bool, hedgeDelay time.Duration) (*upstreamResult, error) {
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		// Get the next API key
+		apiKey := provider.KeyManager.GetNextAvailableKeyForModel(model, tried)
+		if apiKey == "" {
+			if lastErr == nil {
+				lastErr = &NoKeysError{Model: model, RetryAfter: provider.KeyManager.RetryAfter(model)}
+			}
+			return nil, lastErr
+		}
+		tried[apiKey] = true
+
+		if hedgeDelay > 0 {
+			result, retry, err := pm.sendHedged(ctx, provider, circuit, model, apiKey, requestBody, stream, hedgeDelay, tried)
+			if err == nil || !retry {
+				return result, err
+			}
+			lastErr = err
+			hedgeDelay = 0
+			continue
+		}
 
-	// Get the next API key
-	apiKey := pm.KeyManager.GetNextAvailableKey()
-	if apiKey == "" {
-		return nil, fmt.Errorf("no API keys available")
+		// Send request to the upstream API
+		body, err := pm.callUpstream(ctx, provider, apiKey, model, requestBody, stream)
+		if err == nil {
+			provider.KeyManager.RecordSuccess(apiKey)
+			return &upstreamResult{body: body, provider: provider, apiKey: apiKey}, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			// The client went away or the deadline passed; the key is not to blame
+			return nil, err
+		}
+		if !pm.handleKeyError(provider, apiKey, model, err) || circuit.isOpen() {
+			return nil, err
+		}
 	}
+}
 
-	// Send request to Gemini API
-	geminiResponseReader, err := pm.GeminiClient.ChatCompletions(apiKey, finalRequestBody, stream)
+// callUpstream makes a single upstream attempt with one key, traced as its own span.
+func (pm *Manager) callUpstream(ctx context.Context, provider *Provider, apiKey, model string, requestBody []byte, stream bool) (io.ReadCloser, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "upstream.chat_completions", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		tracing.AttrProvider.String(provider.Name),
+		tracing.AttrModel.String(model),
+		tracing.AttrKeyIndex.Int(provider.KeyManager.KeyIndex(apiKey)),
+		tracing.AttrStream.Bool(stream),
+	))
+	defer span.End()
+
+	body, err := provider.clientFor(model).ChatCompletions(ctx, apiKey, requestBody, stream, pm.timeoutsFor(model, stream))
+	if err == nil && stream {
+		body, err = primeStream(body)
+	}
 	if err != nil {
-		pm.Log.Errorf("Gemini API call failed for key %s: %v", apiKey, err)
-		pm.KeyManager.MarkKeyAsBad(apiKey, 5*time.Minute) // Mark key as bad for 5 minutes
-		return nil, fmt.Errorf("failed to get response from Gemini API: %w", err)
+		var apiErr *gemini.APIError
+		if errors.As(err, &apiErr) {
+			span.SetAttributes(tracing.AttrStatusCode.Int(apiErr.StatusCode))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upstream request failed")
+		return nil, err
+	}
+	span.SetAttributes(tracing.AttrStatusCode.Int(http.StatusOK))
+	return body, nil
+}
+
+// handleKeyError records a failed upstream call against the key that made it and reports whether
+// another key may still succeed.
+func (pm *Manager) handleKeyError(provider *Provider, apiKey, model string, err error) bool {
+	keyIndex := provider.KeyManager.KeyIndex(apiKey)
+	pm.Log.WithFields(logrus.Fields{"provider": provider.Name, "model": model, "key_index": keyIndex}).Errorf("Upstream API call failed: %v", err)
+	provider.KeyManager.RecordError(apiKey, err)
+
+	var apiErr *gemini.APIError
+	status := 0
+	if errors.As(err, &apiErr) {
+		status = apiErr.StatusCode
 	}
+	metrics.UpstreamErrors.WithLabelValues(provider.Name, strconv.Itoa(keyIndex), metrics.ModelLabel(model), strconv.Itoa(status)).Inc()
 
-	return geminiResponseReader, nil
+	if apiErr == nil {
+		var timeoutErr *gemini.TimeoutError
+		if errors.Is(err, ErrStreamInterrupted) || errors.As(err, &timeoutErr) {
+			// The key worked; the connection dropped or upstream was slow, so another attempt may get through
+			return true
+		}
+		provider.KeyManager.MarkKeyAsBad(apiKey, 5*time.Minute) // Mark key as bad for 5 minutes
+		return true
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		provider.KeyManager.MarkKeyAsBad(apiKey, 5*time.Minute)
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		// Quotas are tracked per model, so the key stays usable for other models
+		quarantine := time.Minute
+		if apiErr.RetryAfter > 0 {
+			quarantine = apiErr.RetryAfter
+		}
+		provider.KeyManager.MarkKeyAsBadForModel(apiKey, model, quarantine)
+	case apiErr.StatusCode >= 500:
+		// The model is overloaded or failing; another key may still get through
+	default:
+		// The request itself was rejected; no other key will do better
+		return false
+	}
+	return true
+}
+
+// modelChain returns the model followed by its configured fallbacks, without duplicates.
+func (pm *Manager) modelChain(model string) []string {
+	chain := []string{model}
+	seen := map[string]bool{model: true}
+	for _, fallback := range pm.Settings().Models[model].Fallbacks {
+		if !seen[fallback] {
+			seen[fallback] = true
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// isRetriable reports whether a failure for one model justifies trying a fallback model.
+func isRetriable(err error) bool {
+	var apiErr *gemini.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+// VirtualModelNames returns the names of the configured virtual models in sorted order.
+func (pm *Manager) VirtualModelNames() []string {
+	routing := pm.Settings().Routing
+	names := make([]string, 0, len(routing.VirtualModels))
+	for name := range routing.VirtualModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/db"
+	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
+	"vertigo/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// modelUpstream answers completions with the status set for their model, 200 by default, and records
+// the models it was asked for.
+type modelUpstream struct {
+	status map[string]int
+	mu     sync.Mutex
+	models []string
+}
+
+func (u *modelUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model string `json:"model"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	u.mu.Lock()
+	u.models = append(u.models, body.Model)
+	u.mu.Unlock()
+
+	if status, ok := u.status[body.Model]; ok {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":"failed"}}`, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"pong"}}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`)
+}
+
+func TestProcessRequestFallsBack(t *testing.T) {
+	fallbacks := map[string]config.ModelConfig{
+		"gemini-a": {Fallbacks: []string{"gemini-b", "gemini-a", "gemini-c", "gemini-d"}},
+	}
+	metrics.SetKnownModels([]string{"gemini-a", "gemini-b", "gemini-c", "gemini-d"})
+	tests := []struct {
+		name       string
+		status     map[string]int
+		wantModels []string
+		wantModel  string // Empty when the request fails
+	}{
+		{"first model answers", nil, []string{"gemini-a"}, "gemini-a"},
+		{"fallbacks in order", map[string]int{"gemini-a": 503, "gemini-b": 429}, []string{"gemini-a", "gemini-b", "gemini-c"}, "gemini-c"},
+		{"non-retriable error stops", map[string]int{"gemini-a": 503, "gemini-b": 400}, []string{"gemini-a", "gemini-b"}, ""},
+		{"all fail", map[string]int{"gemini-a": 500, "gemini-b": 500, "gemini-c": 500, "gemini-d": 500}, []string{"gemini-a", "gemini-b", "gemini-c", "gemini-d"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &modelUpstream{status: tt.status}
+			server := httptest.NewServer(upstream)
+			defer server.Close()
+			database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			pm := &Manager{ConversationStore: store.NewConversationStore(database), UsageStore: store.NewUsageStore(database), Log: logger}
+			pm.settings.Store(&Settings{
+				Providers: []*Provider{{Name: "test", Models: []string{"*"}, Client: gemini.NewClient(server.URL, 0, logger), KeyManager: NewKeyManager([]string{"k1"})}},
+				Models:    fallbacks,
+			})
+			tokens := testutil.ToFloat64(metrics.Tokens.WithLabelValues(tt.wantModel, "prompt"))
+
+			response, err := pm.ProcessRequest(context.Background(), []byte(`{"model":"gemini-a","messages":[{"role":"user","content":"ping"}]}`), http.Header{}, "", false)
+			if tt.wantModel == "" {
+				if err == nil {
+					response.Body.Close()
+					t.Fatalf("ProcessRequest() answered with %s, want an error", response.Model)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+				if response.Model != tt.wantModel {
+					t.Errorf("response model = %s, want %s", response.Model, tt.wantModel)
+				}
+				if got := testutil.ToFloat64(metrics.Tokens.WithLabelValues(tt.wantModel, "prompt")) - tokens; got != 3 {
+					t.Errorf("prompt tokens counted for %s = %v, want 3", tt.wantModel, got)
+				}
+			}
+
+			if !reflect.DeepEqual(upstream.models, tt.wantModels) {
+				t.Errorf("upstream was asked for %v, want %v", upstream.models, tt.wantModels)
+			}
+			// A failed request is recorded for the model the client asked for
+			wantRecord := tt.wantModel
+			if wantRecord == "" {
+				wantRecord = "gemini-a"
+			}
+			summaries, err := pm.UsageStore.Summary([]string{"model"}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(summaries) != 1 || summaries[0].Model != wantRecord || summaries[0].Requests != 1 {
+				t.Errorf("usage = %+v, want one request of %s", summaries, wantRecord)
+			}
+		})
+	}
+}
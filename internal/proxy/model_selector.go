@@ -2,59 +2,233 @@ package proxy
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"vertigo/internal/config"
 )
 
 const (
-	ModelVertigoBlast     = "vertigo-1.0-blast"
-	ModelGemini20Flash    = "gemini-2.0-flash"
+	ModelVertigoBlast      = "vertigo-1.0-blast"
+	ModelGemini20Flash     = "gemini-2.0-flash"
 	ModelGemini25FlashLite = "gemini-2.5-flash-lite"
-	ModelGemini25Flash    = "gemini-2.5-flash"
-	ModelGemini25Pro      = "gemini-2.5-pro"
+	ModelGemini25Flash     = "gemini-2.5-flash"
+	ModelGemini25Pro       = "gemini-2.5-pro"
 )
 
+// DefaultVirtualModels is the routing table used when the configuration does not define any virtual models.
+// It reproduces the original vertigo-1.0-blast behaviour of mapping reasoning_effort to a Gemini tier.
+var DefaultVirtualModels = map[string]config.VirtualModel{
+	ModelVertigoBlast: {
+		Default: ModelGemini25Flash,
+		Rules: []config.RoutingRule{
+			{Match: config.RuleMatch{ReasoningEffort: []string{"low"}}, Model: ModelGemini20Flash},
+			{Match: config.RuleMatch{ReasoningEffort: []string{"medium"}}, Model: ModelGemini25Flash},
+			{Match: config.RuleMatch{ReasoningEffort: []string{"high"}}, Model: ModelGemini25Pro},
+		},
+	},
+}
+
 // RequestBody represents the relevant fields from the incoming JSON request.
 type RequestBody struct {
-	Model            string `json:"model"`
-	ReasoningEffort  string `json:"reasoning_effort,omitempty"`
+	Model           string            `json:"model"`
+	ReasoningEffort string            `json:"reasoning_effort,omitempty"`
+	Messages        []json.RawMessage `json:"messages,omitempty"`
+	Tools           []json.RawMessage `json:"tools,omitempty"`
+}
+
+// RequestFeatures are the request properties routing rules and the heuristic router can match on.
+type RequestFeatures struct {
+	ReasoningEffort string
+	PromptTokens    int
+	HasTools        bool
+	HasImages       bool
+	CodeBlocks      int
+	Depth           int
+	// Text is the lower-cased prompt text, used for keyword matching.
+	Text string
 }
 
-// SelectModel determines the correct Gemini model to use based on the request body.
-// It returns the model name and the modified request body.
-func SelectModel(body []byte) (string, []byte, error) {
+// Selection describes a routing decision.
+type Selection struct {
+	Model string
+	// Virtual reports whether the requested model was a virtual model alias.
+	Virtual bool
+	Reason  string
+	// ThinkingBudget is the Gemini thinking budget derived from reasoning_effort, if any, before it is
+	// fitted to the model it is sent to.
+	ThinkingBudget  *int
+	IncludeThoughts bool
+	// Hedge reports whether the virtual model turns on request hedging.
+	Hedge bool
+}
+
+// SelectModel determines the correct Gemini model to use based on the request body, the request headers
+// and the routing configuration. It returns the routing decision and the modified request body.
+func SelectModel(body []byte, header http.Header, routing config.RoutingConfig) (Selection, []byte, error) {
 	var reqBody RequestBody
 	if err := json.Unmarshal(body, &reqBody); err != nil {
-		return "", nil, err
+		return Selection{}, nil, err
+	}
+
+	features := extractFeatures(&reqBody)
+
+	// In thinking mode reasoning_effort sets the thinking budget, so it must not also switch models.
+	var thinkingBudget *int
+	if routing.Thinking.Enabled && features.ReasoningEffort != "" {
+		if budget, ok := thinkingBudgetFor(routing.Thinking, features.ReasoningEffort); ok {
+			thinkingBudget = &budget
+			features.ReasoningEffort = ""
+		}
 	}
 
-	if reqBody.Model != ModelVertigoBlast {
-		// If the model is not vertigo-1.0-blast, we don't need to do anything.
-		return reqBody.Model, body, nil
+	vm, virtual := routing.VirtualModels[reqBody.Model]
+	if !virtual && thinkingBudget == nil {
+		// If the model is not a virtual model, we don't need to do anything.
+		return Selection{Model: reqBody.Model, Reason: "passthrough"}, body, nil
 	}
 
-	selectedModel := ModelGemini25Flash // Default model
-	switch reqBody.ReasoningEffort {
-	case "low":
-		selectedModel = ModelGemini20Flash
-	case "medium":
-		selectedModel = ModelGemini25Flash
-	case "high":
-		selectedModel = ModelGemini25Pro
+	selection := Selection{Model: reqBody.Model, Virtual: virtual, Reason: "passthrough"}
+	var params map[string]interface{}
+	if virtual {
+		selection.Model, selection.Reason = vm.Default, "default"
+		selection.Hedge = vm.Hedge
+		matched := false
+		for i, rule := range vm.Rules {
+			if ruleMatches(rule.Match, features, header) {
+				selection.Model = rule.Model
+				selection.Reason = fmt.Sprintf("rule %d", i)
+				params = rule.Params
+				matched = true
+				break
+			}
+		}
+		if !matched && vm.Auto.Enabled {
+			selection.Model, selection.Reason = AutoRoute(vm.Auto, features)
+		}
 	}
 
 	// Create a new map to represent the modified request body
 	var bodyMap map[string]interface{}
 	if err := json.Unmarshal(body, &bodyMap); err != nil {
-		return "", nil, err
+		return Selection{}, nil, err
 	}
 
-	// Set the new model and remove the reasoning_effort field
-	bodyMap["model"] = selectedModel
+	// Apply the rule's parameter overrides, then set the new model and remove the reasoning_effort field
+	for k, v := range params {
+		bodyMap[k] = v
+	}
+	bodyMap["model"] = selection.Model
 	delete(bodyMap, "reasoning_effort")
 
+	if thinkingBudget != nil {
+		selection.ThinkingBudget = thinkingBudget
+		selection.IncludeThoughts = routing.Thinking.IncludeThoughts
+		setThinkingConfig(bodyMap, selection.Model, *thinkingBudget, routing.Thinking.IncludeThoughts)
+	}
+
 	modifiedBody, err := json.Marshal(bodyMap)
 	if err != nil {
-		return "", nil, err
+		return Selection{}, nil, err
 	}
 
-	return selectedModel, modifiedBody, nil
+	return selection, modifiedBody, nil
+}
+
+// ruleMatches reports whether every condition set in m holds for the request.
+func ruleMatches(m config.RuleMatch, f RequestFeatures, header http.Header) bool {
+	if len(m.ReasoningEffort) > 0 && !containsString(m.ReasoningEffort, f.ReasoningEffort) {
+		return false
+	}
+	if m.MinPromptTokens > 0 && f.PromptTokens < m.MinPromptTokens {
+		return false
+	}
+	if m.MaxPromptTokens > 0 && f.PromptTokens > m.MaxPromptTokens {
+		return false
+	}
+	if m.HasTools != nil && *m.HasTools != f.HasTools {
+		return false
+	}
+	if m.HasImages != nil && *m.HasImages != f.HasImages {
+		return false
+	}
+	if m.Header != "" {
+		value := header.Get(m.Header)
+		if value == "" || (m.HeaderValue != "" && value != m.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// extractFeatures computes the routing features of a parsed request.
+func extractFeatures(reqBody *RequestBody) RequestFeatures {
+	f := RequestFeatures{
+		ReasoningEffort: reqBody.ReasoningEffort,
+		HasTools:        len(reqBody.Tools) > 0,
+		Depth:           len(reqBody.Messages),
+	}
+
+	var text strings.Builder
+	for _, raw := range reqBody.Messages {
+		var msg struct {
+			Content interface{} `json:"content"`
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			continue
+		}
+		content, hasImage := messageText(msg.Content)
+		text.WriteString(content)
+		text.WriteByte('\n')
+		f.CodeBlocks += strings.Count(content, "```") / 2
+		if hasImage {
+			f.HasImages = true
+		}
+	}
+	f.PromptTokens = estimateTokens(text.Len())
+	f.Text = strings.ToLower(text.String())
+
+	return f
+}
+
+// messageText flattens an OpenAI message content value, which is either a string or a list of parts.
+func messageText(content interface{}) (string, bool) {
+	switch c := content.(type) {
+	case string:
+		return c, false
+	case []interface{}:
+		text := ""
+		hasImage := false
+		for _, p := range c {
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "text":
+				if t, ok := part["text"].(string); ok {
+					text += t
+				}
+			case "image_url", "input_image":
+				hasImage = true
+			}
+		}
+		return text, hasImage
+	}
+	return "", false
+}
+
+// estimateTokens approximates a token count from a character count (roughly four characters per token).
+func estimateTokens(chars int) int {
+	return (chars + 3) / 4
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"vertigo/internal/config"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestExtractFeatures(t *testing.T) {
+	body := `{
+		"model": "m",
+		"reasoning_effort": "high",
+		"tools": [{"type": "function"}],
+		"messages": [
+			{"role": "system", "content": "You are helpful."},
+			{"role": "user", "content": "Fix this:\n` + "```go\\nx := 1\\n```" + ` and ` + "```go\\ny := 2\\n```" + `"},
+			{"role": "user", "content": [{"type": "text", "text": "What is in this IMAGE?"}, {"type": "image_url", "image_url": {"url": "data:"}}]}
+		]
+	}`
+	var reqBody RequestBody
+	if err := json.Unmarshal([]byte(body), &reqBody); err != nil {
+		t.Fatal(err)
+	}
+
+	f := extractFeatures(&reqBody)
+	if f.ReasoningEffort != "high" {
+		t.Errorf("ReasoningEffort = %q, want high", f.ReasoningEffort)
+	}
+	if !f.HasTools {
+		t.Error("HasTools = false, want true")
+	}
+	if !f.HasImages {
+		t.Error("HasImages = false, want true")
+	}
+	if f.CodeBlocks != 2 {
+		t.Errorf("CodeBlocks = %d, want 2", f.CodeBlocks)
+	}
+	if f.Depth != 3 {
+		t.Errorf("Depth = %d, want 3", f.Depth)
+	}
+	if !strings.Contains(f.Text, "what is in this image?") {
+		t.Errorf("Text = %q, want the lower-cased text parts", f.Text)
+	}
+	if f.PromptTokens != estimateTokens(len(f.Text)) {
+		t.Errorf("PromptTokens = %d, want %d", f.PromptTokens, estimateTokens(len(f.Text)))
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Team", "research")
+
+	tests := []struct {
+		name     string
+		match    config.RuleMatch
+		features RequestFeatures
+		want     bool
+	}{
+		{"empty match applies", config.RuleMatch{}, RequestFeatures{}, true},
+		{"reasoning effort", config.RuleMatch{ReasoningEffort: []string{"low", "medium"}}, RequestFeatures{ReasoningEffort: "medium"}, true},
+		{"other reasoning effort", config.RuleMatch{ReasoningEffort: []string{"low"}}, RequestFeatures{ReasoningEffort: "high"}, false},
+		{"missing reasoning effort", config.RuleMatch{ReasoningEffort: []string{"low"}}, RequestFeatures{}, false},
+		{"min prompt tokens reached", config.RuleMatch{MinPromptTokens: 100}, RequestFeatures{PromptTokens: 100}, true},
+		{"min prompt tokens not reached", config.RuleMatch{MinPromptTokens: 100}, RequestFeatures{PromptTokens: 99}, false},
+		{"max prompt tokens reached", config.RuleMatch{MaxPromptTokens: 100}, RequestFeatures{PromptTokens: 100}, true},
+		{"max prompt tokens exceeded", config.RuleMatch{MaxPromptTokens: 100}, RequestFeatures{PromptTokens: 101}, false},
+		{"prompt token range", config.RuleMatch{MinPromptTokens: 10, MaxPromptTokens: 20}, RequestFeatures{PromptTokens: 15}, true},
+		{"has tools", config.RuleMatch{HasTools: boolPtr(true)}, RequestFeatures{HasTools: true}, true},
+		{"has no tools", config.RuleMatch{HasTools: boolPtr(true)}, RequestFeatures{}, false},
+		{"requires no tools", config.RuleMatch{HasTools: boolPtr(false)}, RequestFeatures{HasTools: true}, false},
+		{"has images", config.RuleMatch{HasImages: boolPtr(true)}, RequestFeatures{HasImages: true}, true},
+		{"has no images", config.RuleMatch{HasImages: boolPtr(true)}, RequestFeatures{}, false},
+		{"header present", config.RuleMatch{Header: "X-Team"}, RequestFeatures{}, true},
+		{"header missing", config.RuleMatch{Header: "X-Other"}, RequestFeatures{}, false},
+		{"header value", config.RuleMatch{Header: "x-team", HeaderValue: "research"}, RequestFeatures{}, true},
+		{"other header value", config.RuleMatch{Header: "X-Team", HeaderValue: "sales"}, RequestFeatures{}, false},
+		{"all conditions hold", config.RuleMatch{ReasoningEffort: []string{"high"}, HasTools: boolPtr(true), Header: "X-Team"}, RequestFeatures{ReasoningEffort: "high", HasTools: true}, true},
+		{"one condition fails", config.RuleMatch{ReasoningEffort: []string{"high"}, HasTools: boolPtr(true), Header: "X-Team"}, RequestFeatures{ReasoningEffort: "high"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ruleMatches(tt.match, tt.features, header); got != tt.want {
+				t.Errorf("ruleMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectModel(t *testing.T) {
+	routing := config.RoutingConfig{
+		VirtualModels: map[string]config.VirtualModel{
+			"smart": {
+				Default: "default-model",
+				Rules: []config.RoutingRule{
+					{Match: config.RuleMatch{Header: "X-Fast"}, Model: "fast-model", Params: map[string]interface{}{"temperature": 0.0}},
+					{Match: config.RuleMatch{HasTools: boolPtr(true)}, Model: "tools-model"},
+					{Match: config.RuleMatch{HasTools: boolPtr(true)}, Model: "shadowed-model"},
+				},
+				Auto: config.AutoRouting{Enabled: true, Keywords: []string{"prove"}},
+			},
+			"plain": {Default: "default-model"},
+		},
+	}
+	fast := http.Header{}
+	fast.Set("X-Fast", "1")
+
+	tests := []struct {
+		name       string
+		body       string
+		header     http.Header
+		wantModel  string
+		wantReason string
+	}{
+		{"passthrough", `{"model": "gemini-2.5-pro", "messages": []}`, nil, "gemini-2.5-pro", "passthrough"},
+		{"first rule wins", `{"model": "smart", "tools": [{}], "messages": []}`, fast, "fast-model", "rule 0"},
+		{"later rule", `{"model": "smart", "tools": [{}], "messages": []}`, nil, "tools-model", "rule 1"},
+		{"rule takes precedence over auto", `{"model": "smart", "tools": [{}], "messages": [{"role": "user", "content": "prove it"}]}`, nil, "tools-model", "rule 1"},
+		{"auto when no rule matches", `{"model": "smart", "messages": [{"role": "user", "content": "prove it"}]}`, nil, ModelGemini25Flash, "auto score=2"},
+		{"default without auto", `{"model": "plain", "messages": [{"role": "user", "content": "prove it"}]}`, nil, "default-model", "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			selection, body, err := SelectModel([]byte(tt.body), header, routing)
+			if err != nil {
+				t.Fatalf("SelectModel() error = %v", err)
+			}
+			if selection.Model != tt.wantModel {
+				t.Errorf("Model = %q, want %q", selection.Model, tt.wantModel)
+			}
+			if !strings.HasPrefix(selection.Reason, tt.wantReason) {
+				t.Errorf("Reason = %q, want prefix %q", selection.Reason, tt.wantReason)
+			}
+			var bodyMap map[string]interface{}
+			if err := json.Unmarshal(body, &bodyMap); err != nil {
+				t.Fatal(err)
+			}
+			if bodyMap["model"] != tt.wantModel {
+				t.Errorf("body model = %v, want %q", bodyMap["model"], tt.wantModel)
+			}
+		})
+	}
+}
+
+func TestSelectModelAppliesRuleParams(t *testing.T) {
+	routing := config.RoutingConfig{VirtualModels: DefaultVirtualModels}
+	body := `{"model": "` + ModelVertigoBlast + `", "reasoning_effort": "high", "messages": []}`
+
+	selection, modified, err := SelectModel([]byte(body), http.Header{}, routing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Model != ModelGemini25Pro || !selection.Virtual {
+		t.Errorf("selection = %+v, want virtual %s", selection, ModelGemini25Pro)
+	}
+	if strings.Contains(string(modified), "reasoning_effort") {
+		t.Errorf("body %s still contains reasoning_effort", modified)
+	}
+
+	routing.VirtualModels = map[string]config.VirtualModel{
+		"cold": {Rules: []config.RoutingRule{{Model: "m", Params: map[string]interface{}{"temperature": 0.5}}}},
+	}
+	_, modified, err = SelectModel([]byte(`{"model": "cold", "temperature": 1}`), http.Header{}, routing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodyMap map[string]interface{}
+	json.Unmarshal(modified, &bodyMap)
+	if bodyMap["temperature"] != 0.5 {
+		t.Errorf("temperature = %v, want the rule's 0.5", bodyMap["temperature"])
+	}
+}
+
+func TestSelectModelInvalidBody(t *testing.T) {
+	if _, _, err := SelectModel([]byte("{"), http.Header{}, config.RoutingConfig{}); err == nil {
+		t.Error("SelectModel() error = nil, want a JSON error")
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Provider types.
+const (
+	ProviderGemini = "gemini"
+	ProviderVertex = "vertex"
+	ProviderOpenAI = "openai"
+)
+
+// DefaultOpenAIBaseURL is used for providers of type "openai" without a base URL.
+const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// unauthenticatedKey stands in for an API key in the pool of a provider that needs none,
+// so that failover and health tracking work the same for every provider.
+const unauthenticatedKey = "unauthenticated"
+
+// ErrUnknownModel is returned when no provider serves the requested model.
+var ErrUnknownModel = errors.New("no provider serves this model")
+
+// Provider is an upstream API together with its own key pool.
+type Provider struct {
+	Name       string
+	Type       string
+	Models     []string
+	Client     *gemini.Client
+	KeyManager *KeyManager
+	// ProbeModel is the model health probes request a token from, or empty to probe by listing models.
+	ProbeModel string
+	// configKeys are the keys listed in the configuration, before runtime changes made through the admin API.
+	configKeys []string
+	// modelClients are copies of Client for the models with their own connect timeout.
+	modelClients map[string]*gemini.Client
+}
+
+// clientFor returns the client for requests to model.
+func (p *Provider) clientFor(model string) *gemini.Client {
+	if client, ok := p.modelClients[model]; ok {
+		return client
+	}
+	return p.Client
+}
+
+// setModelTimeouts gives the models with a connect timeout of their own a client that uses it.
+func (p *Provider) setModelTimeouts(models map[string]config.ModelConfig) {
+	for model, mc := range models {
+		if mc.Timeouts.Connect <= 0 {
+			continue
+		}
+		if p.modelClients == nil {
+			p.modelClients = make(map[string]*gemini.Client)
+		}
+		p.modelClients[model] = p.Client.WithConnectTimeout(mc.Timeouts.Connect)
+	}
+}
+
+// closeIdleConnections closes the idle connections of the provider's clients.
+func (p *Provider) closeIdleConnections() {
+	p.Client.CloseIdleConnections()
+	for _, client := range p.modelClients {
+		client.CloseIdleConnections()
+	}
+}
+
+// NewProvider creates a Provider from its configuration.
+func NewProvider(cfg config.ProviderConfig, connectTimeout time.Duration, logger *logrus.Logger) (*Provider, error) {
+	providerType := cfg.Type
+	if providerType == "" {
+		providerType = ProviderGemini
+	}
+	baseURL := cfg.BaseURL
+	switch providerType {
+	case ProviderGemini:
+		if baseURL == "" {
+			baseURL = gemini.DefaultBaseURL
+		}
+	case ProviderOpenAI:
+		if baseURL == "" {
+			baseURL = DefaultOpenAIBaseURL
+		}
+	case ProviderVertex:
+		if baseURL == "" {
+			if cfg.Project == "" || cfg.Region == "" {
+				return nil, fmt.Errorf("provider %q needs a project and region, or a base_url", cfg.Name)
+			}
+			baseURL = vertexBaseURL(cfg.Project, cfg.Region)
+		}
+	default:
+		return nil, fmt.Errorf("provider %q has unknown type %q", cfg.Name, cfg.Type)
+	}
+
+	client := gemini.NewClient(baseURL, connectTimeout, logger)
+	client.Auth, client.AuthHeader = cfg.Auth, cfg.AuthHeader
+	if providerType == ProviderVertex {
+		return newVertexProvider(cfg, client)
+	}
+	switch cfg.Auth {
+	case "", gemini.AuthBearer, gemini.AuthNone:
+	case gemini.AuthHeader:
+		if cfg.AuthHeader == "" {
+			return nil, fmt.Errorf("provider %q uses header auth but sets no auth_header", cfg.Name)
+		}
+	default:
+		return nil, fmt.Errorf("provider %q has unknown auth %q", cfg.Name, cfg.Auth)
+	}
+
+	keys := cfg.APIKeys
+	if cfg.Auth == gemini.AuthNone {
+		keys = []string{unauthenticatedKey}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("provider %q has no API keys", cfg.Name)
+	}
+
+	return &Provider{
+		Name:       cfg.Name,
+		Type:       providerType,
+		Models:     cfg.Models,
+		Client:     client,
+		KeyManager: NewKeyManager(keys),
+		ProbeModel: cfg.ProbeModel,
+		configKeys: keys,
+	}, nil
+}
+
+// vertexBaseURL returns the OpenAI-compatible endpoint of Vertex AI for a project and region.
+func vertexBaseURL(project, region string) string {
+	host := region + "-aiplatform.googleapis.com"
+	if region == "global" {
+		host = "aiplatform.googleapis.com"
+	}
+	return fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/endpoints/openapi", host, project, region)
+}
+
+// newVertexProvider creates a Vertex AI provider whose key pool is made of service accounts.
+// The credential file paths serve as keys; they never appear in logs, only their index does.
+func newVertexProvider(cfg config.ProviderConfig, client *gemini.Client) (*Provider, error) {
+	if len(cfg.CredentialsFiles) == 0 {
+		return nil, fmt.Errorf("provider %q has no credentials_files", cfg.Name)
+	}
+	client.Auth = gemini.AuthServiceAccount
+	client.TokenSources = make(map[string]*gemini.TokenSource)
+	for _, path := range cfg.CredentialsFiles {
+		ts, err := gemini.NewTokenSource(path, cfg.TokenURL, client.HTTPClient)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+		}
+		client.TokenSources[path] = ts
+	}
+
+	return &Provider{
+		Name:       cfg.Name,
+		Type:       ProviderVertex,
+		Models:     cfg.Models,
+		Client:     client,
+		KeyManager: NewKeyManager(cfg.CredentialsFiles),
+		ProbeModel: cfg.ProbeModel,
+		configKeys: cfg.CredentialsFiles,
+	}, nil
+}
+
+// upstreamModel returns the model name the provider expects. Vertex AI names Google's models "google/<model>".
+func (p *Provider) upstreamModel(model string) string {
+	if p.Type == ProviderVertex && !strings.Contains(model, "/") {
+		return "google/" + model
+	}
+	return model
+}
+
+// Serves reports whether one of the provider's model patterns matches model.
+func (p *Provider) Serves(model string) bool {
+	for _, pattern := range p.Models {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// providerFor returns the provider that serves model: the first one with a matching pattern,
+// or else the first one without any patterns. It returns nil if there is none.
+func (pm *Manager) providerFor(model string) *Provider {
+	var fallback *Provider
+	for _, p := range pm.Settings().Providers {
+		if p.Serves(model) {
+			return p
+		}
+		if len(p.Models) == 0 && fallback == nil {
+			fallback = p
+		}
+	}
+	return fallback
+}
+
+// ProviderModel is a model listed by a provider.
+type ProviderModel struct {
+	ID       string
+	Provider string
+}
+
+// ProviderModels returns the literal model names listed by providers in routing order, skipping glob patterns.
+func (pm *Manager) ProviderModels() []ProviderModel {
+	var models []ProviderModel
+	seen := make(map[string]bool)
+	for _, p := range pm.Settings().Providers {
+		for _, m := range p.Models {
+			if strings.ContainsAny(m, "*?[") || seen[m] {
+				continue
+			}
+			seen[m] = true
+			models = append(models, ProviderModel{ID: m, Provider: p.Name})
+		}
+	}
+	return models
+}
+
+// KeyStates reports the health of every key of every provider, for metrics.
+func (pm *Manager) KeyStates() []metrics.KeyState {
+	var states []metrics.KeyState
+	for _, p := range pm.Settings().Providers {
+		for _, state := range p.KeyManager.KeyStates() {
+			state.Provider = p.Name
+			states = append(states, state)
+		}
+	}
+	return states
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProviderServes(t *testing.T) {
+	tests := []struct {
+		models []string
+		model  string
+		want   bool
+	}{
+		{[]string{"gemini-2.5-pro", "gemini-2.5-flash"}, "gemini-2.5-flash", true},
+		{[]string{"gemini-2.5-pro", "gemini-2.5-flash"}, "gemini-2.5-flash-lite", false},
+		{[]string{"gemini-*"}, "gemini-2.5-pro", true},
+		{[]string{"gemini-*"}, "gpt-4o", false},
+		{[]string{"*"}, "anything", true},
+		{nil, "gemini-2.5-pro", false},
+	}
+	for _, tt := range tests {
+		p := &Provider{Models: tt.models}
+		if got := p.Serves(tt.model); got != tt.want {
+			t.Errorf("Provider{Models: %v}.Serves(%s) = %v, want %v", tt.models, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestProviderFor(t *testing.T) {
+	local := &Provider{Name: "local", Models: []string{"llama-3", "gemini-2.5-pro"}}
+	catchAll := &Provider{Name: "catch-all"}
+	google := &Provider{Name: "google", Models: []string{"gemini-*", "gemini-2.5-pro"}}
+	pm := &Manager{}
+	pm.settings.Store(&Settings{Providers: []*Provider{local, catchAll, google}})
+
+	tests := []struct {
+		model string
+		want  *Provider
+	}{
+		{"llama-3", local},
+		{"gemini-2.5-pro", local}, // The first matching provider wins
+		{"gemini-2.5-flash", google},
+		{"gpt-4o", catchAll}, // A provider without models serves what no pattern matches
+	}
+	for _, tt := range tests {
+		if got := pm.providerFor(tt.model); got != tt.want {
+			t.Errorf("providerFor(%s) = %v, want %s", tt.model, got, tt.want.Name)
+		}
+	}
+
+	pm.settings.Store(&Settings{Providers: []*Provider{local, google}})
+	if got := pm.providerFor("gpt-4o"); got != nil {
+		t.Errorf("providerFor(gpt-4o) = %s, want none", got.Name)
+	}
+
+	// Patterns are not listed, and a model only once
+	want := []ProviderModel{{"llama-3", "local"}, {"gemini-2.5-pro", "local"}}
+	if got := pm.ProviderModels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProviderModels() = %v, want %v", got, want)
+	}
+}
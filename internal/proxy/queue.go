@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/metrics"
+)
+
+// PriorityHeader sets the priority of a request, interactive or batch, overriding the client's priority.
+const PriorityHeader = "X-Vertigo-Priority"
+
+// Defaults for the request queue.
+const (
+	defaultQueueMaxSize = 100
+	defaultQueueTimeout = 30 * time.Second
+	// queuePollInterval bounds how long a waiting request sleeps before checking the keys again, since
+	// a key can come back early, e.g. after a successful probe.
+	queuePollInterval = time.Second
+)
+
+// QueueError is returned when a request could not get a slot for a model: the queue was full, or the
+// request waited for the whole queue timeout. It is retriable, so the model's fallbacks are tried next.
+type QueueError struct {
+	Model string
+	// Full reports that the queue was full; otherwise the wait timed out.
+	Full       bool
+	Waited     time.Duration
+	RetryAfter time.Duration
+}
+
+func (e *QueueError) Error() string {
+	if e.Full {
+		return fmt.Sprintf("queue full for model %s", e.Model)
+	}
+	return fmt.Sprintf("timed out after %v waiting for a slot for model %s", e.Waited.Round(time.Millisecond), e.Model)
+}
+
+// QueueStats describes how a request went through the queue.
+type QueueStats struct {
+	// Wait is the time the request waited for its slot.
+	Wait time.Duration
+	// Depth is the number of requests that were already waiting when it arrived.
+	Depth int
+}
+
+// slotQueue guards the upstream slots of a model on a provider. A request takes a slot when the model is
+// below its concurrency limit and, with queueing enabled, one of its keys is usable. Requests that cannot
+// take one wait in priority order, and only the first waiter may take the next free slot.
+type slotQueue struct {
+	id, model string
+	// label is the model label of the queue depth, fixed so that a reload cannot change it between
+	// counting a waiter in and out.
+	label string
+	// refs counts the requests holding or waiting for a slot. It is guarded by the mutex of slotQueues.
+	refs    int
+	mutex   sync.Mutex
+	active  int
+	waiters []*queueWaiter
+}
+
+type queueWaiter struct {
+	priority string
+	wake     chan struct{}
+}
+
+// slotQueues holds the queue of every model and provider with requests holding or waiting for a slot.
+// Like the circuit breakers, they live on the Manager so a reload keeps requests in flight and waiting.
+// A queue is dropped once its last request is done, so clients cannot fill the map by sending made-up
+// model names.
+type slotQueues struct {
+	mutex  sync.Mutex
+	queues map[string]*slotQueue
+}
+
+func newSlotQueues() *slotQueues {
+	return &slotQueues{queues: make(map[string]*slotQueue)}
+}
+
+// get returns the queue of a model on a provider, to be handed back with put once the request is done with it.
+func (sq *slotQueues) get(provider *Provider, model string) *slotQueue {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	id := provider.Name + "/" + model
+	q, ok := sq.queues[id]
+	if !ok {
+		q = &slotQueue{id: id, model: model, label: metrics.ModelLabel(model)}
+		sq.queues[id] = q
+	}
+	q.refs++
+	return q
+}
+
+// put hands back a queue taken with get, removing it once no request uses it.
+func (sq *slotQueues) put(q *slotQueue) {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	q.refs--
+	if q.refs == 0 {
+		delete(sq.queues, q.id)
+	}
+}
+
+// requestPriority returns the priority of a request: the PriorityHeader if it holds a known priority,
+// then the priority configured for the client, then the default priority.
+func (pm *Manager) requestPriority(header http.Header) string {
+	qc := pm.Settings().Queue
+	switch p := strings.ToLower(header.Get(PriorityHeader)); p {
+	case config.PriorityInteractive, config.PriorityBatch:
+		return p
+	}
+	if p, ok := qc.Clients[ClientIdentity(header)]; ok {
+		return p
+	}
+	if qc.DefaultPriority != "" {
+		return qc.DefaultPriority
+	}
+	return config.PriorityInteractive
+}
+
+// acquireSlot waits until a request for model may be sent to provider, and returns the function that frees
+// its slot once the response is done. Without queueing or a concurrency limit for the model it returns at
+// once with nil stats. A request that is over the concurrency limit while queueing is disabled, or finds
+// the queue full, fails straight away; a waiting request gives up at deadline, or earlier with a
+// NoKeysError once no key can become usable before then.
+func (pm *Manager) acquireSlot(ctx context.Context, provider *Provider, model, priority string, deadline time.Time) (func(), *QueueStats, error) {
+	settings := pm.Settings()
+	qc := settings.Queue
+	limit := settings.Models[model].MaxConcurrency
+	if !qc.Enabled && limit <= 0 {
+		return func() {}, nil, nil
+	}
+
+	q := pm.queues.get(provider, model)
+	acquired := false
+	defer func() {
+		if !acquired {
+			pm.queues.put(q)
+		}
+	}()
+	w := &queueWaiter{priority: priority, wake: make(chan struct{}, 1)}
+	stats := &QueueStats{}
+	start := time.Now()
+	queued := false
+	for {
+		q.mutex.Lock()
+		var retryAfter time.Duration
+		if qc.Enabled {
+			retryAfter = provider.KeyManager.RetryAfter(model)
+		}
+		if (limit <= 0 || q.active < limit) && retryAfter == 0 && (len(q.waiters) == 0 || q.waiters[0] == w) {
+			q.active++
+			if queued {
+				q.remove(w)
+			}
+			q.mutex.Unlock()
+			stats.Wait = time.Since(start)
+			if queued {
+				metrics.QueueWait.WithLabelValues(metrics.ModelLabel(model), priority).Observe(stats.Wait.Seconds())
+			}
+			acquired = true
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					q.release()
+					pm.queues.put(q)
+				})
+			}, stats, nil
+		}
+
+		remaining := time.Until(deadline)
+		var err error
+		switch {
+		case !qc.Enabled:
+			err = &QueueError{Model: model, Full: true}
+		case !queued && len(q.waiters) >= orDefault(qc.MaxSize, defaultQueueMaxSize):
+			err = &QueueError{Model: model, Full: true, RetryAfter: retryAfter}
+		case remaining <= 0:
+			err = &QueueError{Model: model, Waited: time.Since(start), RetryAfter: retryAfter}
+		case retryAfter > remaining:
+			err = &NoKeysError{Model: model, RetryAfter: retryAfter}
+		}
+		if err != nil {
+			if queued {
+				q.remove(w)
+			}
+			q.mutex.Unlock()
+			if qe, ok := err.(*QueueError); ok {
+				reason := "timeout"
+				if qe.Full {
+					reason = "full"
+				}
+				metrics.QueueRejections.WithLabelValues(metrics.ModelLabel(model), reason).Inc()
+			}
+			return nil, stats, err
+		}
+		if !queued {
+			// Check again right away, the request may have been queued first
+			stats.Depth = len(q.waiters)
+			q.insert(w)
+			queued = true
+			q.mutex.Unlock()
+			continue
+		}
+		q.mutex.Unlock()
+
+		wait := min(remaining, queuePollInterval)
+		if retryAfter > 0 && retryAfter < wait {
+			wait = retryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-w.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			q.mutex.Lock()
+			q.remove(w)
+			q.mutex.Unlock()
+			return nil, stats, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// tryAcquireSlot takes a slot for model on provider if one is free and no request is waiting for it,
+// without waiting. It is used for hedged attempts, which are only worth sending when they make no other
+// request wait. It returns false if no slot was taken.
+func (pm *Manager) tryAcquireSlot(provider *Provider, model string) (func(), bool) {
+	settings := pm.Settings()
+	limit := settings.Models[model].MaxConcurrency
+	if !settings.Queue.Enabled && limit <= 0 {
+		return func() {}, true
+	}
+
+	q := pm.queues.get(provider, model)
+	q.mutex.Lock()
+	if (limit > 0 && q.active >= limit) || len(q.waiters) > 0 {
+		q.mutex.Unlock()
+		pm.queues.put(q)
+		return nil, false
+	}
+	q.active++
+	q.mutex.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.release()
+			pm.queues.put(q)
+		})
+	}, true
+}
+
+// insert adds a waiter behind those of the same or a higher priority. The caller holds the mutex.
+func (q *slotQueue) insert(w *queueWaiter) {
+	i := len(q.waiters)
+	if w.priority == config.PriorityInteractive {
+		for i > 0 && q.waiters[i-1].priority != config.PriorityInteractive {
+			i--
+		}
+	}
+	q.waiters = append(q.waiters, nil)
+	copy(q.waiters[i+1:], q.waiters[i:])
+	q.waiters[i] = w
+	metrics.QueueDepth.WithLabelValues(q.label, w.priority).Inc()
+}
+
+// remove takes a waiter out of the queue and wakes the new first waiter. The caller holds the mutex.
+func (q *slotQueue) remove(w *queueWaiter) {
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			metrics.QueueDepth.WithLabelValues(q.label, w.priority).Dec()
+			break
+		}
+	}
+	q.wakeFirst()
+}
+
+// release frees a slot and wakes the first waiter.
+func (q *slotQueue) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.active--
+	q.wakeFirst()
+}
+
+// wakeFirst tells the first waiter to check for a slot again. The caller holds the mutex.
+func (q *slotQueue) wakeFirst() {
+	if len(q.waiters) == 0 {
+		return
+	}
+	select {
+	case q.waiters[0].wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+)
+
+// newQueueTest returns a manager that queues requests for gemini-a, one at a time, and its provider.
+func newQueueTest(maxSize int) (*Manager, *Provider) {
+	p := &Provider{Name: "test", Models: []string{"*"}, KeyManager: NewKeyManager([]string{"k1"})}
+	pm := &Manager{queues: newSlotQueues()}
+	pm.settings.Store(&Settings{
+		Providers: []*Provider{p},
+		Models:    map[string]config.ModelConfig{"gemini-a": {MaxConcurrency: 1}},
+		Queue:     config.QueueConfig{Enabled: true, MaxSize: maxSize},
+	})
+	return pm, p
+}
+
+// waitForWaiters waits until n requests are queued for gemini-a.
+func waitForWaiters(t *testing.T, pm *Manager, p *Provider, n int) {
+	t.Helper()
+	q := pm.queues.get(p, "gemini-a")
+	defer pm.queues.put(q)
+	deadline := time.Now().Add(time.Second)
+	for {
+		q.mutex.Lock()
+		waiting := len(q.waiters)
+		q.mutex.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests are waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueServesInteractiveFirst(t *testing.T) {
+	pm, p := newQueueTest(0)
+	release, _, err := pm.acquireSlot(context.Background(), p, "gemini-a", config.PriorityInteractive, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan string, 3)
+	var wg sync.WaitGroup
+	wait := func(name, priority string) {
+		defer wg.Done()
+		release, _, err := pm.acquireSlot(context.Background(), p, "gemini-a", priority, time.Now().Add(time.Second))
+		if err != nil {
+			served <- err.Error()
+			return
+		}
+		served <- name
+		release()
+	}
+	wg.Add(3)
+	go wait("batch", config.PriorityBatch)
+	waitForWaiters(t, pm, p, 1)
+	go wait("interactive 1", config.PriorityInteractive)
+	waitForWaiters(t, pm, p, 2)
+	go wait("interactive 2", config.PriorityInteractive)
+	waitForWaiters(t, pm, p, 3)
+
+	release()
+	for _, want := range []string{"interactive 1", "interactive 2", "batch"} {
+		if got := <-served; got != want {
+			t.Errorf("served %s, want %s", got, want)
+		}
+	}
+	wg.Wait()
+	if n := len(pm.queues.queues); n != 0 {
+		t.Errorf("%d queues left, want none", n)
+	}
+}
+
+func TestQueueDropsExpiredWaiters(t *testing.T) {
+	pm, p := newQueueTest(1)
+	release, _, err := pm.acquireSlot(context.Background(), p, "gemini-a", config.PriorityInteractive, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pm.acquireSlot(context.Background(), p, "gemini-a", config.PriorityInteractive, time.Now().Add(50*time.Millisecond))
+		done <- err
+	}()
+	waitForWaiters(t, pm, p, 1)
+
+	// The queue holds one waiter, so another request is turned away at once
+	_, _, err = pm.acquireSlot(context.Background(), p, "gemini-a", config.PriorityInteractive, time.Now().Add(time.Second))
+	var queueErr *QueueError
+	if !errors.As(err, &queueErr) || !queueErr.Full {
+		t.Errorf("error = %v, want a full queue", err)
+	}
+
+	err = <-done
+	if !errors.As(err, &queueErr) || queueErr.Full || queueErr.Waited < 50*time.Millisecond {
+		t.Fatalf("error = %v, want a timeout after 50ms", err)
+	}
+	q := pm.queues.queues[p.Name+"/gemini-a"]
+	if len(q.waiters) != 0 || q.active != 1 {
+		t.Errorf("%d waiters and %d active after the timeout, want none waiting and the first request active", len(q.waiters), q.active)
+	}
+
+	// A canceled request leaves the queue as well
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _, err := pm.acquireSlot(ctx, p, "gemini-a", config.PriorityInteractive, time.Now().Add(time.Second))
+		done <- err
+	}()
+	waitForWaiters(t, pm, p, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	waitForWaiters(t, pm, p, 0)
+
+	release()
+	if n := len(pm.queues.queues); n != 0 {
+		t.Errorf("%d queues left, want none", n)
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"vertigo/internal/config"
+	"vertigo/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reload applies a new configuration to the running manager: providers and their key pools, routing,
+// per-model settings, timeouts and the cache options that need no new backend. The new configuration is
+// validated by building it in full before anything is swapped, so a failed reload leaves the current
+// settings in place. Providers are matched by name; a provider that is kept reuses its key pool, so keys
+// present before and after the reload keep their quarantines and context caches. Key changes made through
+// the admin API are applied on top of the new configuration. Every provider gets a new client, so the idle
+// connections of the replaced clients are closed once they are swapped out.
+func (pm *Manager) Reload(cfg *config.Config) error {
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+
+	next, err := newSettings(cfg, pm.Log)
+	if err != nil {
+		return err
+	}
+
+	current := pm.Settings()
+	previous := make(map[string]*Provider, len(current.Providers))
+	for _, p := range current.Providers {
+		previous[p.Name] = p
+	}
+	for _, p := range next.Providers {
+		old, ok := previous[p.Name]
+		if !ok {
+			pm.applyKeyOverrides(p)
+			pm.Log.WithFields(logrus.Fields{"provider": p.Name, "keys": len(p.KeyManager.Keys())}).Info("Added provider")
+			continue
+		}
+		delete(previous, p.Name)
+
+		p.KeyManager = old.KeyManager
+		added, removed := pm.applyKeyOverrides(p)
+		pm.Log.WithFields(logrus.Fields{
+			"provider":     p.Name,
+			"keys":         len(p.KeyManager.Keys()),
+			"keys_added":   added,
+			"keys_removed": removed,
+		}).Info("Reloaded provider")
+	}
+	for name := range previous {
+		pm.Log.WithField("provider", name).Info("Removed provider")
+	}
+
+	pm.settings.Store(next)
+	metrics.SetKnownModels(knownModels(cfg, next))
+	// Requests still in flight on the old clients keep their connections
+	for _, p := range current.Providers {
+		p.closeIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+func reloadConfig(baseURL string, keys ...string) *config.Config {
+	return &config.Config{Providers: []config.ProviderConfig{{Name: "test", Type: "openai", BaseURL: baseURL, APIKeys: keys}}}
+}
+
+func TestReloadKeepsKeyHealth(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	pm, err := NewManager(reloadConfig("http://upstream.invalid", "k1", "k2"), nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.Settings().Providers[0].KeyManager.MarkKeyAsBad("k1", time.Hour)
+
+	if err := pm.Reload(reloadConfig("http://upstream.invalid", "k1", "k3")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, statuses := pm.Settings().Providers[0].KeyManager.snapshot()
+	if want := []string{"k1", "k3"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys = %v, want %v", keys, want)
+	}
+	if !statuses[0].IsBad {
+		t.Error("k1 lost its quarantine in the reload")
+	}
+	if statuses[1].IsBad {
+		t.Error("the added k3 is quarantined")
+	}
+
+	// A configuration that fails to build leaves the current settings in place
+	bad := reloadConfig("", "k1")
+	bad.Providers[0].Type = "vertex"
+	if err := pm.Reload(bad); err == nil {
+		t.Fatal("Reload() succeeded with a vertex provider without credentials")
+	}
+	if keys, _ := pm.Settings().Providers[0].KeyManager.snapshot(); !reflect.DeepEqual(keys, []string{"k1", "k3"}) {
+		t.Errorf("keys = %v after a failed reload, want them unchanged", keys)
+	}
+}
+
+func TestReloadClosesIdleConnections(t *testing.T) {
+	var closed atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	pm, err := NewManager(reloadConfig(server.URL, "k1"), nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave an idle connection in the pool of the current client
+	if err := pm.Settings().Providers[0].Client.ListModels(context.Background(), "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pm.Reload(reloadConfig(server.URL, "k1")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for closed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if closed.Load() == 0 {
+		t.Error("the idle connection of the replaced client was not closed")
+	}
+}
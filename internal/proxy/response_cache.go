@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"vertigo/internal/cache"
+	"vertigo/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Cache statuses reported in Response.CacheStatus.
+const (
+	CacheHit         = "hit"
+	CacheSemanticHit = "semantic-hit"
+	CacheMiss        = "miss"
+)
+
+// defaultEmbeddingModel is used by the semantic cache when no embedding model is configured.
+const defaultEmbeddingModel = "gemini-embedding-001"
+
+// embeddingTimeout bounds embedding a prompt after its response was served.
+const embeddingTimeout = 30 * time.Second
+
+// cacheLookup records how a request was looked up so that its response can be stored after a miss.
+type cacheLookup struct {
+	key string // Exact cache key, empty when the exact cache does not apply
+
+	// Semantic cache scope and prompt; prompt is empty when the semantic cache does not apply. embedding
+	// is nil when the prompt was not embedded for the lookup, and is then embedded when it is stored.
+	scope     cache.SemanticScope
+	prompt    string
+	embedding []float32
+}
+
+func (cl *cacheLookup) active() bool {
+	return cl.key != "" || cl.prompt != ""
+}
+
+// checkCache looks the request up in the exact and semantic caches. It returns a Response on a hit,
+// and otherwise the lookup state needed to store the upstream response.
+func (pm *Manager) checkCache(ctx context.Context, reqBodyMap map[string]interface{}, header http.Header, selection Selection, stream bool) (*Response, *cacheLookup) {
+	lookup := &cacheLookup{}
+	if !pm.cacheable(reqBodyMap) {
+		return nil, lookup
+	}
+	bypass := noCache(header)
+
+	// Serve identical requests from the response cache
+	if pm.ResponseCache != nil {
+		key, err := cache.Key(reqBodyMap)
+		if err != nil {
+			pm.Log.Errorf("Failed to compute cache key: %v", err)
+		} else {
+			lookup.key = key
+			if !bypass {
+				if entry, ok := pm.ResponseCache.Get(key); ok {
+					metrics.CacheRequests.WithLabelValues("exact", "hit").Inc()
+					pm.Log.WithFields(logrus.Fields{"model": entry.Model, "cache_key": key}).Debug("Serving response from cache")
+					return pm.cachedResponse(entry, stream, selection.IncludeThoughts, CacheHit), lookup
+				}
+				metrics.CacheRequests.WithLabelValues("exact", "miss").Inc()
+			}
+		}
+	}
+
+	// Serve near-duplicate prompts from the semantic cache
+	if pm.SemanticCache != nil {
+		prompt := lastUserMessage(reqBodyMap)
+		if prompt == "" {
+			return nil, lookup
+		}
+		contextKey, err := cache.ContextKey(reqBodyMap)
+		if err != nil {
+			pm.Log.Errorf("Failed to compute semantic cache context: %v", err)
+			return nil, lookup
+		}
+		lookup.prompt, lookup.scope.Context = prompt, contextKey
+		if pm.Settings().CacheConfig.Semantic.PerClient {
+			lookup.scope.Client = ClientIdentity(header)
+		}
+		if pm.Settings().CacheConfig.Semantic.PerModel {
+			lookup.scope.Model = selection.Model
+		}
+		if bypass {
+			return nil, lookup
+		}
+
+		// A scope without entries cannot match, so the prompt is only embedded if the response is stored
+		if ok, err := pm.SemanticCache.HasEntries(lookup.scope); err != nil {
+			pm.Log.Errorf("Semantic cache lookup failed: %v", err)
+			return nil, lookup
+		} else if !ok {
+			metrics.CacheRequests.WithLabelValues("semantic", "miss").Inc()
+			return nil, lookup
+		}
+
+		embedding, err := pm.embed(ctx, prompt)
+		if err != nil {
+			pm.Log.Errorf("Failed to embed prompt for semantic cache: %v", err)
+			return nil, lookup
+		}
+		lookup.embedding = embedding
+
+		match, err := pm.SemanticCache.Lookup(lookup.scope, embedding)
+		if err != nil {
+			pm.Log.Errorf("Semantic cache lookup failed: %v", err)
+		} else if match == nil {
+			metrics.CacheRequests.WithLabelValues("semantic", "miss").Inc()
+		} else {
+			metrics.CacheRequests.WithLabelValues("semantic", "hit").Inc()
+			pm.Log.WithFields(logrus.Fields{
+				"similarity":     match.Similarity,
+				"entry_id":       match.ID,
+				"matched_prompt": match.Prompt,
+				"model":          match.Entry.Model,
+			}).Info("Serving response from semantic cache")
+			return pm.cachedResponse(match.Entry, stream, selection.IncludeThoughts, CacheSemanticHit), lookup
+		}
+	}
+
+	return nil, lookup
+}
+
+// cacheable reports whether a request may be served from or stored in the response caches.
+func (pm *Manager) cacheable(reqBodyMap map[string]interface{}) bool {
+	if pm.ResponseCache == nil && pm.SemanticCache == nil {
+		return false
+	}
+	if pm.Settings().CacheConfig.Deterministic() {
+		temperature, ok := reqBodyMap["temperature"].(float64)
+		return ok && temperature == 0
+	}
+	return true
+}
+
+// cachedResponse builds a Response from a cache entry, converting it to an SSE stream for streaming requests.
+func (pm *Manager) cachedResponse(entry *cache.Entry, stream bool, includeThoughts bool, status string) *Response {
+	body := entry.Body
+	if stream {
+		sse, err := cache.CompletionToSSE(entry.Body)
+		if err != nil {
+			pm.Log.Errorf("Failed to replay cached response: %v", err)
+			return nil
+		}
+		body = sse
+	}
+	return &Response{
+		Body:            io.NopCloser(bytes.NewReader(body)),
+		Model:           entry.Model,
+		IncludeThoughts: includeThoughts,
+		CacheStatus:     status,
+		KeyIndex:        -1,
+	}
+}
+
+// storeCache writes a completed upstream response to the caches the request was looked up in.
+func (pm *Manager) storeCache(lookup *cacheLookup, model string, completion []byte) {
+	entry := &cache.Entry{Model: model, Body: completion, CreatedAt: time.Now()}
+
+	if lookup.key != "" {
+		if err := pm.ResponseCache.Set(lookup.key, entry); err != nil {
+			pm.Log.Errorf("Failed to store cached response: %v", err)
+		} else {
+			pm.Log.WithFields(logrus.Fields{"model": model, "cache_key": lookup.key}).Debug("Stored response in cache")
+		}
+	}
+
+	if lookup.prompt != "" {
+		if lookup.embedding != nil {
+			pm.storeSemantic(lookup, lookup.embedding, entry)
+			return
+		}
+		// Embedding the prompt must not hold up the client closing the response
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), embeddingTimeout)
+			defer cancel()
+			embedding, err := pm.embed(ctx, lookup.prompt)
+			if err != nil {
+				pm.Log.Errorf("Failed to embed prompt for semantic cache: %v", err)
+				return
+			}
+			pm.storeSemantic(lookup, embedding, entry)
+		}()
+	}
+}
+
+func (pm *Manager) storeSemantic(lookup *cacheLookup, embedding []float32, entry *cache.Entry) {
+	if err := pm.SemanticCache.Store(lookup.scope, lookup.prompt, embedding, entry); err != nil {
+		pm.Log.Errorf("Failed to store semantic cache entry: %v", err)
+	}
+}
+
+// embed returns the embedding of text, failing over across API keys like chat requests do.
+func (pm *Manager) embed(ctx context.Context, text string) ([]float32, error) {
+	model := pm.Settings().CacheConfig.Semantic.EmbeddingModel
+	if model == "" {
+		model = defaultEmbeddingModel
+	}
+
+	provider := pm.providerFor(model)
+	if provider == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, model)
+	}
+
+	tried := make(map[string]bool)
+	lastErr := ErrNoKeysAvailable
+	for {
+		apiKey := provider.KeyManager.GetNextAvailableKeyForModel(model, tried)
+		if apiKey == "" {
+			return nil, lastErr
+		}
+		tried[apiKey] = true
+
+		embedding, err := provider.Client.Embeddings(ctx, apiKey, model, text)
+		if err == nil {
+			return embedding, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || !isRetriable(err) {
+			return nil, err
+		}
+	}
+}
+
+// lastUserMessage returns the text of the last user message in the request.
+func lastUserMessage(reqBodyMap map[string]interface{}) string {
+	messages, _ := reqBodyMap["messages"].([]interface{})
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg, ok := messages[i].(map[string]interface{})
+		if !ok || msg["role"] != "user" {
+			continue
+		}
+		text, _ := messageText(msg["content"])
+		return text
+	}
+	return ""
+}
+
+// noCache reports whether the client asked to bypass the cache.
+func noCache(header http.Header) bool {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		switch strings.TrimSpace(strings.ToLower(directive)) {
+		case "no-cache", "no-store":
+			return true
+		}
+	}
+	return false
+}
+
+// maxCachedResponseBytes caps the size of a response that is captured for the caches.
+const maxCachedResponseBytes = 4 << 20
+
+// recordingReader captures an upstream response as it is read and hands the completed
+// response, as a non-streaming chat completion, to onComplete when it is closed.
+type recordingReader struct {
+	io.ReadCloser
+	buf bytes.Buffer
+	eof bool
+	// tooLarge is set once the response outgrew maxCachedResponseBytes; it is then neither kept nor cached.
+	tooLarge   bool
+	stream     bool
+	onComplete func(completion []byte)
+	log        *logrus.Logger
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.ReadCloser.Read(p)
+	if !rr.tooLarge {
+		if rr.buf.Len()+n > maxCachedResponseBytes {
+			rr.tooLarge = true
+			rr.buf = bytes.Buffer{}
+		} else {
+			rr.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		rr.eof = true
+	}
+	return n, err
+}
+
+// Close records the captured response if it was read completely, then closes the upstream body.
+func (rr *recordingReader) Close() error {
+	rr.record()
+	return rr.ReadCloser.Close()
+}
+
+func (rr *recordingReader) record() {
+	if rr.tooLarge {
+		rr.log.Debugf("Not caching response larger than %d bytes", maxCachedResponseBytes)
+		return
+	}
+	body := rr.buf.Bytes()
+	if rr.stream {
+		// Streaming readers stop at [DONE] and rarely see EOF
+		if !bytes.Contains(body, []byte("data: [DONE]")) {
+			return
+		}
+		completion, err := cache.CompletionFromSSE(body)
+		if err != nil {
+			rr.log.Debugf("Not caching streamed response: %v", err)
+			return
+		}
+		body = completion
+	} else if !rr.eof || len(body) == 0 {
+		return
+	}
+
+	rr.onComplete(append([]byte(nil), body...))
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"vertigo/internal/cache"
+	"vertigo/internal/config"
+	"vertigo/internal/db"
+	"vertigo/internal/gemini"
+	"vertigo/internal/store"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestResponseCache(t *testing.T) {
+	upstream := &modelUpstream{}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	pm := &Manager{
+		ConversationStore: store.NewConversationStore(database),
+		ResponseCache:     cache.NewMemoryCache(10, time.Hour),
+		Log:               logger,
+	}
+	pm.settings.Store(&Settings{
+		Providers: []*Provider{{Name: "test", Models: []string{"*"}, Client: gemini.NewClient(server.URL, 0, logger), KeyManager: NewKeyManager([]string{"k1"})}},
+	})
+
+	request := func(body string, header http.Header, stream bool) (*Response, string) {
+		t.Helper()
+		response, err := pm.ProcessRequest(context.Background(), []byte(body), header, "", stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		return response, string(data)
+	}
+	deterministic := `{"model":"gemini-a","temperature":0,"messages":[{"role":"user","content":"ping"}]}`
+	noCache := http.Header{"Cache-Control": []string{"no-cache"}}
+
+	tests := []struct {
+		name          string
+		header        http.Header
+		stream        bool
+		wantStatus    string
+		wantUpstreams int
+	}{
+		{"first request", http.Header{}, false, CacheMiss, 1},
+		{"repeated request", http.Header{}, false, CacheHit, 1},
+		{"no-cache bypasses the cache", noCache, false, CacheMiss, 2},
+		{"streaming replay", http.Header{}, true, CacheHit, 2},
+	}
+	for _, tt := range tests {
+		response, body := request(deterministic, tt.header, tt.stream)
+		if response.CacheStatus != tt.wantStatus {
+			t.Errorf("%s: cache status = %q, want %q", tt.name, response.CacheStatus, tt.wantStatus)
+		}
+		if n := len(upstream.models); n != tt.wantUpstreams {
+			t.Errorf("%s: upstream received %d requests, want %d", tt.name, n, tt.wantUpstreams)
+		}
+		if tt.stream && (!strings.HasPrefix(body, "data: ") || !strings.HasSuffix(body, "data: [DONE]\n\n")) {
+			t.Errorf("%s: body = %q, want an SSE stream", tt.name, body)
+		}
+		if !tt.stream && !strings.Contains(body, `"pong"`) {
+			t.Errorf("%s: body = %q", tt.name, body)
+		}
+	}
+
+	// Requests without a temperature are sampled, so only caching every request stores them
+	sampled := `{"model":"gemini-a","messages":[{"role":"user","content":"pong"}]}`
+	for i := 0; i < 2; i++ {
+		if response, _ := request(sampled, http.Header{}, false); response.CacheStatus != "" {
+			t.Errorf("sampled request %d: cache status = %q, want none", i, response.CacheStatus)
+		}
+	}
+	deterministicOnly := false
+	pm.settings.Store(&Settings{Providers: pm.Settings().Providers, CacheConfig: config.CacheConfig{DeterministicOnly: &deterministicOnly}})
+	for _, want := range []string{CacheMiss, CacheHit} {
+		if response, _ := request(sampled, http.Header{}, false); response.CacheStatus != want {
+			t.Errorf("sampled request with deterministic_only off: cache status = %q, want %q", response.CacheStatus, want)
+		}
+	}
+}
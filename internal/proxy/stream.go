@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrStreamInterrupted is returned when an upstream stream fails before its first event,
+// so the request can still be retried with another key.
+var ErrStreamInterrupted = errors.New("upstream stream interrupted before the first event")
+
+// primedStream replays the events read while priming, then continues with the rest of the upstream stream.
+type primedStream struct {
+	io.Reader
+	body io.Closer
+}
+
+func (ps *primedStream) Close() error {
+	return ps.body.Close()
+}
+
+// primeStream reads an upstream SSE stream up to and including its first data event. Once that
+// event has arrived the stream has committed to a response; until then a failure is still safe
+// to retry, because nothing has been sent to the client.
+func primeStream(body io.ReadCloser) (io.ReadCloser, error) {
+	reader := bufio.NewReader(body)
+	var primed bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		primed.WriteString(line)
+		if strings.HasPrefix(line, "data: ") && strings.HasSuffix(line, "\n") {
+			return &primedStream{Reader: io.MultiReader(&primed, reader), body: body}, nil
+		}
+		if err != nil {
+			body.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%w: stream ended without data", ErrStreamInterrupted)
+			}
+			return nil, fmt.Errorf("%w: %w", ErrStreamInterrupted, err)
+		}
+	}
+}
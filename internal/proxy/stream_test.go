@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// trackedBody is an upstream body that reports whether it was closed.
+type trackedBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestPrimeStream(t *testing.T) {
+	stream := ": keepalive\n\ndata: {\"choices\":[]}\n\ndata: [DONE]\n\n"
+	body := &trackedBody{Reader: strings.NewReader(stream)}
+	primed, err := primeStream(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything read while priming is replayed
+	if data, _ := io.ReadAll(primed); string(data) != stream {
+		t.Errorf("stream = %q, want %q", data, stream)
+	}
+	primed.Close()
+	if !body.closed {
+		t.Error("closing the primed stream left the upstream body open")
+	}
+
+	for name, reader := range map[string]io.Reader{
+		"no data":      strings.NewReader(": keepalive\n\n"),
+		"partial line": strings.NewReader("data: {\"choi"),
+		"read error":   io.MultiReader(strings.NewReader(": keepalive\n"), failingReader{}),
+	} {
+		body := &trackedBody{Reader: reader}
+		if _, err := primeStream(body); !errors.Is(err, ErrStreamInterrupted) {
+			t.Errorf("%s: error = %v, want ErrStreamInterrupted", name, err)
+		}
+		if !body.closed {
+			t.Errorf("%s: the upstream body was left open", name)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
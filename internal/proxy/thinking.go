@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"strings"
+
+	"vertigo/internal/config"
+)
+
+// defaultThinkingBudgets maps reasoning_effort levels to Gemini thinking budgets when none are configured.
+// A budget of 0 disables thinking on models that allow it; budgets are fitted to each model's range by
+// fitThinkingBudget before they are sent.
+var defaultThinkingBudgets = map[string]int{
+	"none":    0,
+	"minimal": 512,
+	"low":     1024,
+	"medium":  8192,
+	"high":    24576,
+}
+
+// thinkingBudgetFor returns the thinking budget for a reasoning_effort level.
+func thinkingBudgetFor(thinking config.ThinkingConfig, effort string) (int, bool) {
+	if budget, ok := thinking.Budgets[effort]; ok {
+		return budget, true
+	}
+	budget, ok := defaultThinkingBudgets[effort]
+	return budget, ok
+}
+
+// thinkingRange is the range of thinking budgets a model accepts. Models that cannot turn thinking off
+// reject a budget of 0.
+type thinkingRange struct {
+	prefix     string
+	min, max   int
+	canDisable bool
+}
+
+// thinkingRanges lists the thinking budget ranges of the Gemini models by model name prefix. Longer
+// prefixes come first so gemini-2.5-flash-lite is not taken for gemini-2.5-flash.
+var thinkingRanges = []thinkingRange{
+	{prefix: ModelGemini25Pro, min: 128, max: 32768},
+	{prefix: ModelGemini25FlashLite, min: 512, max: 24576, canDisable: true},
+	{prefix: ModelGemini25Flash, min: 1, max: 24576, canDisable: true},
+}
+
+// nonThinkingModels are the model name prefixes of Gemini models without thinking support.
+var nonThinkingModels = []string{"gemini-1.5", "gemini-2.0"}
+
+// fitThinkingBudget fits a thinking budget into the range the model accepts. It returns false for models
+// without thinking support, which must not be sent a thinking configuration at all. Budgets for models
+// it does not know, and -1 (dynamic thinking), are returned unchanged.
+func fitThinkingBudget(model string, budget int) (int, bool) {
+	for _, prefix := range nonThinkingModels {
+		if strings.HasPrefix(model, prefix) {
+			return 0, false
+		}
+	}
+	if budget < 0 {
+		return budget, true
+	}
+	for _, r := range thinkingRanges {
+		if !strings.HasPrefix(model, r.prefix) {
+			continue
+		}
+		switch {
+		case budget == 0 && r.canDisable:
+			return 0, true
+		case budget < r.min:
+			return r.min, true
+		case budget > r.max:
+			return r.max, true
+		}
+		return budget, true
+	}
+	return budget, true
+}
+
+// setThinkingConfig adds the Gemini-specific thinking configuration for model to an OpenAI-compatible
+// request body, with the budget fitted to the model, or removes it if the model cannot think. It returns
+// the budget sent and whether one was.
+func setThinkingConfig(bodyMap map[string]interface{}, model string, budget int, includeThoughts bool) (int, bool) {
+	budget, ok := fitThinkingBudget(model, budget)
+	if !ok {
+		removeThinkingConfig(bodyMap)
+		return 0, false
+	}
+	googleExtraBody(bodyMap)["thinking_config"] = map[string]interface{}{
+		"thinking_budget":  budget,
+		"include_thoughts": includeThoughts,
+	}
+	return budget, true
+}
+
+// removeThinkingConfig removes the thinking configuration from a request body, along with the
+// extra_body objects it leaves empty.
+func removeThinkingConfig(bodyMap map[string]interface{}) {
+	extraBody, ok := bodyMap["extra_body"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	google, ok := extraBody["google"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	delete(google, "thinking_config")
+	if len(google) == 0 {
+		delete(extraBody, "google")
+	}
+	if len(extraBody) == 0 {
+		delete(bodyMap, "extra_body")
+	}
+}
+
+// googleExtraBody returns the extra_body.google object of a request body, creating it if needed.
+// Gemini's OpenAI endpoint reads its non-OpenAI options from there.
+func googleExtraBody(bodyMap map[string]interface{}) map[string]interface{} {
+	extraBody, ok := bodyMap["extra_body"].(map[string]interface{})
+	if !ok {
+		extraBody = make(map[string]interface{})
+		bodyMap["extra_body"] = extraBody
+	}
+	google, ok := extraBody["google"].(map[string]interface{})
+	if !ok {
+		google = make(map[string]interface{})
+		extraBody["google"] = google
+	}
+	return google
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"vertigo/internal/config"
+)
+
+func TestFitThinkingBudget(t *testing.T) {
+	tests := []struct {
+		model  string
+		budget int
+		want   int
+		wantOK bool
+	}{
+		{ModelGemini25Pro, 0, 128, true},
+		{ModelGemini25Pro, 64, 128, true},
+		{ModelGemini25Pro, 8192, 8192, true},
+		{ModelGemini25Pro, 50000, 32768, true},
+		{ModelGemini25Pro, -1, -1, true},
+		{"gemini-2.5-pro-preview-06-05", 0, 128, true},
+		{ModelGemini25Flash, 0, 0, true},
+		{ModelGemini25Flash, 32768, 24576, true},
+		{ModelGemini25FlashLite, 0, 0, true},
+		{ModelGemini25FlashLite, 100, 512, true},
+		{ModelGemini20Flash, 1024, 0, false},
+		{"gemini-1.5-pro", 1024, 0, false},
+		{"llama3.2", 1024, 1024, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := fitThinkingBudget(tt.model, tt.budget)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("fitThinkingBudget(%q, %d) = %d, %v, want %d, %v", tt.model, tt.budget, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestSetThinkingConfig(t *testing.T) {
+	bodyMap := map[string]interface{}{
+		"extra_body": map[string]interface{}{"google": map[string]interface{}{"cached_content": "c"}},
+	}
+	if budget, ok := setThinkingConfig(bodyMap, ModelGemini25Pro, 0, true); !ok || budget != 128 {
+		t.Fatalf("setThinkingConfig() = %d, %v, want 128, true", budget, ok)
+	}
+	google := bodyMap["extra_body"].(map[string]interface{})["google"].(map[string]interface{})
+	thinking := google["thinking_config"].(map[string]interface{})
+	if thinking["thinking_budget"] != 128 || thinking["include_thoughts"] != true {
+		t.Errorf("thinking_config = %v", thinking)
+	}
+
+	// A fallback to a model without thinking removes the configuration again
+	if _, ok := setThinkingConfig(bodyMap, ModelGemini20Flash, 0, true); ok {
+		t.Error("setThinkingConfig() sent a budget to a model without thinking")
+	}
+	if _, ok := google["thinking_config"]; ok {
+		t.Error("thinking_config was not removed")
+	}
+	if google["cached_content"] != "c" {
+		t.Error("other extra_body.google options were removed")
+	}
+
+	bodyMap = map[string]interface{}{}
+	setThinkingConfig(bodyMap, ModelGemini25Flash, 1024, false)
+	setThinkingConfig(bodyMap, ModelGemini20Flash, 1024, false)
+	if _, ok := bodyMap["extra_body"]; ok {
+		t.Errorf("empty extra_body left in %v", bodyMap)
+	}
+}
+
+func TestSelectModelThinking(t *testing.T) {
+	routing := config.RoutingConfig{Thinking: config.ThinkingConfig{Enabled: true}}
+	tests := []struct {
+		model      string
+		effort     string
+		wantBudget interface{}
+	}{
+		{ModelGemini25Pro, "none", float64(128)},
+		{ModelGemini25Flash, "none", float64(0)},
+		{ModelGemini25Flash, "high", float64(24576)},
+		{ModelGemini20Flash, "high", nil},
+	}
+
+	for _, tt := range tests {
+		body := `{"model": "` + tt.model + `", "reasoning_effort": "` + tt.effort + `"}`
+		_, modified, err := SelectModel([]byte(body), http.Header{}, routing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed struct {
+			ExtraBody struct {
+				Google struct {
+					ThinkingConfig map[string]interface{} `json:"thinking_config"`
+				} `json:"google"`
+			} `json:"extra_body"`
+		}
+		if err := json.Unmarshal(modified, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		got := parsed.ExtraBody.Google.ThinkingConfig["thinking_budget"]
+		if got != tt.wantBudget {
+			t.Errorf("%s with %s: thinking_budget = %v, want %v (body %s)", tt.model, tt.effort, got, tt.wantBudget, modified)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+)
+
+// timeoutsFor returns the upstream timeouts for a request to model. Each limit comes from the model's
+// override if set, then the global configuration, then the built-in default.
+func (pm *Manager) timeoutsFor(model string, stream bool) gemini.Timeouts {
+	settings := pm.Settings()
+	global, override, t := settings.Timeouts.NonStream, settings.Models[model].Timeouts.NonStream, gemini.DefaultTimeouts
+	if stream {
+		global, override, t = settings.Timeouts.Stream, settings.Models[model].Timeouts.Stream, gemini.DefaultStreamTimeouts
+	}
+	for _, cfg := range []config.RequestTimeouts{global, override} {
+		if cfg.FirstByte > 0 {
+			t.FirstByte = cfg.FirstByte
+		}
+		if cfg.Idle > 0 {
+			t.Idle = cfg.Idle
+		}
+		if cfg.Total > 0 {
+			t.Total = cfg.Total
+		}
+	}
+	return t
+}
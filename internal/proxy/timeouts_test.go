@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"vertigo/internal/config"
+	"vertigo/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestModelTimeouts(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg := reloadConfig("http://upstream.invalid", "k1")
+	cfg.Timeouts = config.TimeoutsConfig{Connect: 5 * time.Second, Stream: config.RequestTimeouts{Idle: 30 * time.Second}}
+	cfg.Models = map[string]config.ModelConfig{"gemini-pro": {Timeouts: config.ModelTimeouts{
+		Connect: 20 * time.Second,
+		Stream:  config.RequestTimeouts{Total: time.Hour},
+	}}}
+	pm, err := NewManager(cfg, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := gemini.DefaultStreamTimeouts
+	want.Idle, want.Total = 30*time.Second, time.Hour
+	if got := pm.timeoutsFor("gemini-pro", true); got != want {
+		t.Errorf("timeoutsFor(gemini-pro) = %+v, want %+v", got, want)
+	}
+	if got := pm.timeoutsFor("gemini-flash", false); got != gemini.DefaultTimeouts {
+		t.Errorf("timeoutsFor(gemini-flash) = %+v, want the defaults", got)
+	}
+
+	p := pm.Settings().Providers[0]
+	connect := func(model string) time.Duration {
+		return p.clientFor(model).HTTPClient.Transport.(*http.Transport).TLSHandshakeTimeout
+	}
+	if got := connect("gemini-pro"); got != 20*time.Second {
+		t.Errorf("connect timeout of gemini-pro = %v, want its own 20s", got)
+	}
+	if got := connect("gemini-flash"); got != 5*time.Second {
+		t.Errorf("connect timeout of gemini-flash = %v, want the global 5s", got)
+	}
+}
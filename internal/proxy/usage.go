@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"vertigo/internal/gemini"
+	"vertigo/internal/metrics"
+	"vertigo/internal/store"
+)
+
+// recordUsage wraps the response body so that its token usage is counted in metrics and written to the
+// usage store, and the exchange saved to the conversation history, once the client has finished reading it.
+// Only the reply of a conversation that is saved is kept, up to maxHistoryReplyBytes.
+func (pm *Manager) recordUsage(response *Response, record store.UsageRecord, stream bool, userMessage string) {
+	record.Model = response.Model
+	if response.apiKey != "" {
+		record.KeyID = KeyID(response.apiKey)
+	}
+	record.CacheStatus = response.CacheStatus
+	response.Body = &usageReader{
+		ReadCloser: response.Body,
+		usage:      usageScanner{stream: stream},
+		capture:    record.ConversationID != "" && record.ConversationID != DefaultConversationID && userMessage != "",
+		onClose: func(body []byte, usage usageCounts, complete bool) {
+			record.Latency = time.Since(record.Timestamp)
+			record.Status = http.StatusOK
+			if !complete {
+				record.Status = StatusClientClosedRequest
+			}
+			// Cache hits cost nothing upstream, so only upstream responses carry token counts
+			if response.CacheStatus != CacheHit && response.CacheStatus != CacheSemanticHit {
+				record.PromptTokens, record.CompletionTokens, record.CachedTokens = usage.PromptTokens, usage.CompletionTokens, usage.PromptTokensDetails.CachedTokens
+				if record.CachedTokens == 0 {
+					record.CachedTokens = response.CachedTokens
+				}
+				response.Usage = Usage{
+					PromptTokens:     record.PromptTokens,
+					CompletionTokens: record.CompletionTokens,
+					CachedTokens:     record.CachedTokens,
+				}
+				model := metrics.ModelLabel(record.Model)
+				metrics.Tokens.WithLabelValues(model, "prompt").Add(float64(record.PromptTokens))
+				metrics.Tokens.WithLabelValues(model, "completion").Add(float64(record.CompletionTokens))
+				metrics.Tokens.WithLabelValues(model, "cached").Add(float64(record.CachedTokens))
+				if response.keyManager != nil {
+					response.keyManager.RecordTokens(response.apiKey, response.Usage)
+				}
+			}
+			pm.writeUsage(record)
+			pm.saveExchange(record.ConversationID, userMessage, body, stream)
+		},
+	}
+}
+
+// recordFailure writes a usage record for a request that got no upstream response.
+func (pm *Manager) recordFailure(record store.UsageRecord, err error) {
+	if pm.UsageStore == nil {
+		return
+	}
+
+	record.Latency = time.Since(record.Timestamp)
+	record.Status = http.StatusInternalServerError
+	var apiErr *gemini.APIError
+	var timeoutErr *gemini.TimeoutError
+	var circuitErr *CircuitOpenError
+	var queueErr *QueueError
+	switch {
+	case errors.As(err, &apiErr):
+		record.Status = apiErr.StatusCode
+	case errors.As(err, &circuitErr), errors.As(err, &queueErr):
+		record.Status = http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		record.Status = StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &timeoutErr):
+		record.Status = http.StatusGatewayTimeout
+	}
+	pm.writeUsage(record)
+}
+
+// recordHedge writes a usage record for the attempt of a hedged request that was canceled in flight.
+// Upstream may bill its prompt, so the prompt tokens are estimated from the request size.
+func (pm *Manager) recordHedge(record store.UsageRecord, model string, result *upstreamResult) {
+	if result.hedge.lostKey == "" {
+		return
+	}
+	record.Model = model
+	record.KeyID = KeyID(result.hedge.lostKey)
+	record.PromptTokens = result.hedge.lostPromptTokens
+	record.Latency = time.Since(record.Timestamp)
+	record.Status = StatusClientClosedRequest
+	record.Hedge = store.HedgeLost
+	pm.writeUsage(record)
+}
+
+func (pm *Manager) writeUsage(record store.UsageRecord) {
+	if pm.UsageStore == nil {
+		return
+	}
+	if err := pm.UsageStore.Record(record); err != nil {
+		pm.Log.Errorf("Failed to record usage: %v", err)
+	}
+}
+
+// StatusClientClosedRequest is recorded when the client stopped reading before the response was complete.
+const StatusClientClosedRequest = 499
+
+// Limits on what is kept of a response while its usage is read.
+const (
+	// maxHistoryReplyBytes caps the reply kept for the conversation history. A longer stream is saved as
+	// far as it fits; a longer JSON response is not saved.
+	maxHistoryReplyBytes = 1 << 20
+	// maxUsageLineBytes caps a line of a stream held while looking for its usage chunk. Longer lines are
+	// skipped; usage chunks are small.
+	maxUsageLineBytes = 64 << 10
+	// usageTailBytes is how much of the end of a JSON response is kept to find its usage object, which
+	// follows the choices.
+	usageTailBytes = 4 << 10
+)
+
+// usageReader scans a response for its usage as it is read, keeping the reply only if capture is set,
+// and hands both to onClose when it is closed.
+type usageReader struct {
+	io.ReadCloser
+	usage   usageScanner
+	capture bool
+	body    bytes.Buffer
+	eof     bool
+	onClose func(body []byte, usage usageCounts, complete bool)
+}
+
+func (ur *usageReader) Read(p []byte) (int, error) {
+	n, err := ur.ReadCloser.Read(p)
+	ur.usage.Write(p[:n])
+	if ur.capture {
+		ur.body.Write(p[:min(n, maxHistoryReplyBytes-ur.body.Len())])
+	}
+	if err == io.EOF {
+		ur.eof = true
+	}
+	return n, err
+}
+
+// Close reports the response, then closes the underlying body.
+func (ur *usageReader) Close() error {
+	usage := ur.usage.Usage()
+	ur.onClose(ur.body.Bytes(), usage, ur.eof || ur.usage.done)
+	return ur.ReadCloser.Close()
+}
+
+// usageCounts is the OpenAI usage object.
+type usageCounts struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+// usageScanner finds the usage of a chat completion response written to it in pieces, holding no more
+// than the current line of a stream or the tail of a JSON response. For streams, the usage is taken from
+// the last chunk that carries one.
+type usageScanner struct {
+	stream bool
+	// done reports that the stream's [DONE] event was seen.
+	done  bool
+	usage usageCounts
+	// line is the incomplete last line of a stream; skip is set while a line too long to hold is passed over.
+	line []byte
+	skip bool
+	// tail is the end of a JSON response, and truncated reports that its start was dropped.
+	tail      []byte
+	truncated bool
+}
+
+func (s *usageScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	if !s.stream {
+		s.tail = append(s.tail, p...)
+		if len(s.tail) > usageTailBytes {
+			s.tail = append(s.tail[:0], s.tail[len(s.tail)-usageTailBytes:]...)
+			s.truncated = true
+		}
+		return n, nil
+	}
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if !s.skip {
+				s.line = append(s.line, p...)
+				if len(s.line) > maxUsageLineBytes {
+					s.line, s.skip = s.line[:0], true
+				}
+			}
+			break
+		}
+		if !s.skip {
+			s.line = append(s.line, p[:i]...)
+			s.scanLine(bytes.TrimRight(s.line, "\r"))
+		}
+		s.line, s.skip = s.line[:0], false
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (s *usageScanner) scanLine(line []byte) {
+	data, ok := bytes.CutPrefix(line, []byte("data: "))
+	if !ok {
+		return
+	}
+	if bytes.Equal(data, []byte("[DONE]")) {
+		s.done = true
+		return
+	}
+	if !bytes.Contains(data, []byte(`"usage"`)) {
+		return
+	}
+	var chunk struct {
+		Usage *usageCounts `json:"usage"`
+	}
+	if json.Unmarshal(data, &chunk) == nil && chunk.Usage != nil {
+		s.usage = *chunk.Usage
+	}
+}
+
+// Usage returns the usage found in what was written, or zero counts if there was none.
+func (s *usageScanner) Usage() usageCounts {
+	if s.stream {
+		if !s.skip && len(s.line) > 0 {
+			s.scanLine(bytes.TrimRight(s.line, "\r"))
+			s.line = s.line[:0]
+		}
+		return s.usage
+	}
+
+	var resp struct {
+		Usage *usageCounts `json:"usage"`
+	}
+	if !s.truncated {
+		if json.Unmarshal(s.tail, &resp) == nil && resp.Usage != nil {
+			return *resp.Usage
+		}
+		return usageCounts{}
+	}
+	// Only the end of a long response is held: decode the usage object that follows its last "usage" key
+	i := bytes.LastIndex(s.tail, []byte(`"usage"`))
+	if i < 0 {
+		return usageCounts{}
+	}
+	rest := bytes.TrimLeft(s.tail[i+len(`"usage"`):], " \t\r\n")
+	rest, ok := bytes.CutPrefix(rest, []byte(":"))
+	if !ok {
+		return usageCounts{}
+	}
+	var usage usageCounts
+	if json.NewDecoder(bytes.NewReader(rest)).Decode(&usage) != nil {
+		return usageCounts{}
+	}
+	return usage
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// scanInPieces writes body to a usage scanner n bytes at a time.
+func scanInPieces(body string, stream bool, n int) *usageScanner {
+	s := &usageScanner{stream: stream}
+	for len(body) > 0 {
+		piece := body[:min(n, len(body))]
+		s.Write([]byte(piece))
+		body = body[len(piece):]
+	}
+	return s
+}
+
+func TestUsageScannerStream(t *testing.T) {
+	stream := `data: {"choices":[{"delta":{"content":"Hel"}}]}` + "\n\n" +
+		`data: {"choices":[{"delta":{"content":"lo"}}],"usage":null}` + "\r\n\r\n" +
+		`data: {"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3,"prompt_tokens_details":{"cached_tokens":4}}}` + "\n\n" +
+		"data: [DONE]\n\n"
+
+	for _, n := range []int{1, 7, len(stream)} {
+		s := scanInPieces(stream, true, n)
+		usage := s.Usage()
+		if usage.PromptTokens != 12 || usage.CompletionTokens != 3 || usage.PromptTokensDetails.CachedTokens != 4 {
+			t.Errorf("pieces of %d: usage = %+v", n, usage)
+		}
+		if !s.done {
+			t.Errorf("pieces of %d: [DONE] was not seen", n)
+		}
+	}
+
+	// A stream cut short has no usage and is not done
+	s := scanInPieces(stream[:60], true, 7)
+	if usage := s.Usage(); usage != (usageCounts{}) || s.done {
+		t.Errorf("interrupted stream: usage = %+v, done = %v", usage, s.done)
+	}
+}
+
+func TestUsageScannerHoldsOnlyTheCurrentLine(t *testing.T) {
+	long := `data: {"choices":[{"delta":{"content":"` + strings.Repeat("x", 2*maxUsageLineBytes) + `"}}]}` + "\n\n"
+	stream := strings.Repeat(long, 4) +
+		`data: {"choices":[],"usage":{"prompt_tokens":5,"completion_tokens":7}}` + "\n\n"
+
+	s := &usageScanner{stream: true}
+	for len(stream) > 0 {
+		piece := stream[:min(4096, len(stream))]
+		s.Write([]byte(piece))
+		stream = stream[len(piece):]
+		if cap(s.line) > 2*maxUsageLineBytes {
+			t.Fatalf("scanner holds %d bytes", cap(s.line))
+		}
+	}
+	if usage := s.Usage(); usage.PromptTokens != 5 || usage.CompletionTokens != 7 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestUsageScannerJSON(t *testing.T) {
+	short := `{"choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":2,"completion_tokens":1}}`
+	long := `{"choices":[{"message":{"content":"` + strings.Repeat("y", 3*usageTailBytes) + `"}}],
+		"usage": {"prompt_tokens":9,"completion_tokens":800,"prompt_tokens_details":{"cached_tokens":1}}}`
+
+	tests := []struct {
+		body string
+		want usageCounts
+	}{
+		{short, usageCounts{PromptTokens: 2, CompletionTokens: 1}},
+		{long, usageCounts{PromptTokens: 9, CompletionTokens: 800, PromptTokensDetails: struct {
+			CachedTokens int `json:"cached_tokens"`
+		}{1}}},
+		{`{"choices":[]}`, usageCounts{}},
+	}
+	for _, tt := range tests {
+		s := scanInPieces(tt.body, false, 1000)
+		if len(s.tail) > usageTailBytes {
+			t.Errorf("scanner holds %d bytes", len(s.tail))
+		}
+		if got := s.Usage(); got != tt.want {
+			t.Errorf("usage of %.40q = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestUsageReaderCapturesOnlyWhatIsSaved(t *testing.T) {
+	body := strings.Repeat("z", maxHistoryReplyBytes+100)
+	for _, capture := range []bool{false, true} {
+		var got []byte
+		var complete bool
+		ur := &usageReader{
+			ReadCloser: io.NopCloser(strings.NewReader(body)),
+			usage:      usageScanner{stream: true},
+			capture:    capture,
+			onClose: func(b []byte, _ usageCounts, c bool) {
+				got, complete = b, c
+			},
+		}
+		io.Copy(io.Discard, ur)
+		ur.Close()
+
+		want := 0
+		if capture {
+			want = maxHistoryReplyBytes
+		}
+		if len(got) != want || !complete {
+			t.Errorf("capture %v: kept %d bytes, complete = %v; want %d bytes, complete", capture, len(got), complete, want)
+		}
+	}
+}
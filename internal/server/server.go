@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,6 +12,8 @@ import (
 
 	"vertigo/internal/api"
 	"vertigo/internal/config"
+	"vertigo/internal/metrics"
+	"vertigo/internal/middleware"
 	"vertigo/internal/proxy"
 
 	"github.com/sirupsen/logrus"
@@ -20,6 +23,8 @@ import (
 type Server struct {
 	httpServer *http.Server
 	log        *logrus.Logger
+	// cancel cancels the base context of every request, aborting upstream calls still running at shutdown.
+	cancel context.CancelFunc
 }
 
 // New creates a new Server instance.
@@ -28,17 +33,51 @@ func New(cfg *config.Config, proxyManager *proxy.Manager, log *logrus.Logger) *S
 
 	openAIAPI := api.NewOpenAIAPI(proxyManager, log)
 
-	// Register handlers
-	mux.HandleFunc("/openai/v1/chat/completions", openAIAPI.ChatCompletionsHandler)
-	mux.HandleFunc("/openai/v1/models", openAIAPI.ModelsHandler)
-	mux.HandleFunc("/openai/v1/models/", openAIAPI.ModelsHandler)
+	// Register handlers, instrumented and traced under their route pattern
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, middleware.TraceRoute(metrics.Instrument(pattern, handler)))
+	}
+	handle("/openai/v1/chat/completions", openAIAPI.ChatCompletionsHandler)
+	handle("/openai/v1/models", openAIAPI.ModelsHandler)
+	handle("/openai/v1/models/", openAIAPI.ModelsHandler)
+
+	if proxyManager.BatchStore != nil {
+		batchAPI := api.NewBatchAPI(proxyManager.FileStore, proxyManager.BatchStore, cfg.Batch, log)
+		handle("/openai/v1/files", batchAPI.FilesHandler)
+		handle("/openai/v1/files/{id}", batchAPI.FileHandler)
+		handle("/openai/v1/files/{id}/content", batchAPI.FileContentHandler)
+		handle("/openai/v1/batches", batchAPI.BatchesHandler)
+		handle("/openai/v1/batches/{id}", batchAPI.BatchHandler)
+		handle("/openai/v1/batches/{id}/cancel", batchAPI.BatchCancelHandler)
+	}
+
+	if cfg.Admin.Enabled {
+		adminAPI := api.NewAdminAPI(proxyManager, cfg.Admin.Tokens, log)
+		handle("/vertigo/v1/admin/keys", adminAPI.Authenticate(adminAPI.KeysHandler))
+		handle("/vertigo/v1/admin/keys/{provider}/{id}", adminAPI.Authenticate(adminAPI.KeyHandler))
+		handle("/vertigo/v1/admin/keys/{provider}/{id}/{action}", adminAPI.Authenticate(adminAPI.KeyActionHandler))
+		handle("/vertigo/v1/admin/circuits", adminAPI.Authenticate(adminAPI.CircuitsHandler))
+
+		// Usage reports cover every client and prices change their costs, so they are admin-only
+		if proxyManager.UsageStore != nil {
+			usageAPI := api.NewUsageAPI(proxyManager.UsageStore, log)
+			handle("/vertigo/v1/usage", adminAPI.Authenticate(usageAPI.UsageHandler))
+			handle("/vertigo/v1/prices", adminAPI.Authenticate(usageAPI.PricesHandler))
+		}
+	}
 
+	metrics.RegisterKeyStates(proxyManager.KeyStates)
+	mux.Handle("/metrics", middleware.TraceRoute(metrics.Handler()))
+
+	baseCtx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		httpServer: &http.Server{
-			Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
-			Handler: mux,
+			Addr:        fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+			Handler:     middleware.Chain(mux, middleware.RequestID, middleware.Trace, middleware.Logger(log), middleware.Recover(log)),
+			BaseContext: func(net.Listener) context.Context { return baseCtx },
 		},
-		log: log,
+		log:    log,
+		cancel: cancel,
 	}
 }
 
@@ -59,6 +98,12 @@ func (s *Server) Run() {
 	s.Shutdown()
 }
 
+// RegisterOnShutdown registers a function to call when shutdown starts, such as stopping background
+// work that should not run while the server drains.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.httpServer.RegisterOnShutdown(f)
+}
+
 // Shutdown gracefully shuts down the server.
 func (s *Server) Shutdown() {
 	s.log.Info("Server is shutting down...")
@@ -66,10 +111,13 @@ func (s *Server) Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// In-flight requests get until the timeout to finish, then their upstream calls are canceled
+	// so the server does not keep waiting on (and paying for) responses nobody will read
 	if err := s.httpServer.Shutdown(ctx); err != nil {
-		s.log.Fatalf("Server shutdown failed: %v", err)
+		s.log.Errorf("Server shutdown timed out, canceling in-flight requests: %v", err)
+		s.cancel()
+		s.httpServer.Close()
 	}
 
 	s.log.Info("Server gracefully stopped")
 }
-
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"io"
+	"testing"
+
+	"vertigo/internal/config"
+	"vertigo/internal/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewTwice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg := &config.Config{}
+	cfg.Gemini.APIKeys = []string{"test-key"}
+	manager, err := proxy.NewManager(cfg, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering the metrics again must not panic
+	New(cfg, manager, logger)
+	New(cfg, manager, logger)
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Batch statuses, as in the OpenAI Batch API.
+const (
+	BatchValidating = "validating"
+	BatchFailed     = "failed"
+	BatchInProgress = "in_progress"
+	BatchFinalizing = "finalizing"
+	BatchCompleted  = "completed"
+	BatchExpired    = "expired"
+	BatchCancelling = "cancelling"
+	BatchCancelled  = "cancelled"
+)
+
+// ErrBatchNotFound is returned when no batch has the requested ID.
+var ErrBatchNotFound = errors.New("batch not found")
+
+// ErrBatchNotCancellable is returned when cancelling a batch that has already ended.
+var ErrBatchNotCancellable = errors.New("batch has already ended")
+
+// Batch is a batch of requests, described like an OpenAI batch object. Timestamps that do not apply yet are zero.
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     string             `json:"output_file_id,omitempty"`
+	ErrorFileID      string             `json:"error_file_id,omitempty"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     int64              `json:"in_progress_at,omitempty"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     int64              `json:"finalizing_at,omitempty"`
+	CompletedAt      int64              `json:"completed_at,omitempty"`
+	FailedAt         int64              `json:"failed_at,omitempty"`
+	ExpiredAt        int64              `json:"expired_at,omitempty"`
+	CancellingAt     int64              `json:"cancelling_at,omitempty"`
+	CancelledAt      int64              `json:"cancelled_at,omitempty"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata,omitempty"`
+	// Client is the identity of the client that created the batch; its requests are made on its behalf.
+	Client string `json:"-"`
+}
+
+// BatchRequestCounts counts the requests of a batch by outcome.
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchErrors lists the problems that made a batch fail validation.
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+// BatchError is a single validation problem. Line is the 1-based line of the input file, if any.
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// BatchResult is the output line of one request of a batch. Failed results go to the error file.
+type BatchResult struct {
+	Line   int
+	Failed bool
+	Output []byte
+}
+
+// batchColumns are the columns scanned by scanBatch, in order.
+const batchColumns = `id, endpoint, errors, input_file_id, completion_window, status, output_file_id, error_file_id,
+	created_at, in_progress_at, expires_at, finalizing_at, completed_at, failed_at, expired_at, cancelling_at,
+	cancelled_at, total, completed, failed, metadata, client`
+
+// BatchStore keeps batches and the results of their requests in the SQLite database, so that batches
+// can be resumed after a restart.
+type BatchStore struct {
+	db *sql.DB
+}
+
+// NewBatchStore creates a new BatchStore with a database connection.
+func NewBatchStore(db *sql.DB) *BatchStore {
+	return &BatchStore{
+		db: db,
+	}
+}
+
+// CreateBatch stores a new batch in the validating status and returns it with its ID and timestamps.
+func (bs *BatchStore) CreateBatch(b Batch, window time.Duration) (Batch, error) {
+	now := time.Now()
+	b.ID = newID("batch_")
+	b.Object = "batch"
+	b.Status = BatchValidating
+	b.CreatedAt = now.Unix()
+	b.ExpiresAt = now.Add(window).Unix()
+	metadata, err := json.Marshal(b.Metadata)
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to encode batch metadata: %w", err)
+	}
+	_, err = bs.db.Exec(`INSERT INTO batches (id, endpoint, errors, input_file_id, completion_window, status, output_file_id,
+		error_file_id, created_at, in_progress_at, expires_at, finalizing_at, completed_at, failed_at, expired_at,
+		cancelling_at, cancelled_at, total, completed, failed, metadata, client)
+		VALUES (?, ?, '', ?, ?, ?, '', '', ?, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, 0, ?, ?)`,
+		b.ID, b.Endpoint, b.InputFileID, b.CompletionWindow, b.Status, b.CreatedAt, b.ExpiresAt, string(metadata), b.Client)
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to insert batch: %w", err)
+	}
+	return b, nil
+}
+
+// Batch returns a batch, or ErrBatchNotFound.
+func (bs *BatchStore) Batch(id string) (Batch, error) {
+	b, err := scanBatch(bs.db.QueryRow("SELECT "+batchColumns+" FROM batches WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return Batch{}, ErrBatchNotFound
+	}
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to query batch: %w", err)
+	}
+	return b, nil
+}
+
+// Batches returns up to limit batches created by client, newest first, starting after the batch with ID
+// after if it is set.
+func (bs *BatchStore) Batches(client string, limit int, after string) ([]Batch, error) {
+	query := "SELECT " + batchColumns + " FROM batches WHERE client = ?"
+	args := []interface{}{client}
+	if after != "" {
+		query += " AND rowid < (SELECT rowid FROM batches WHERE id = ?)"
+		args = append(args, after)
+	}
+	query += " ORDER BY rowid DESC LIMIT ?"
+	args = append(args, limit)
+	return bs.queryBatches(query, args...)
+}
+
+// PendingBatches returns the batches that have not ended yet, oldest first.
+func (bs *BatchStore) PendingBatches() ([]Batch, error) {
+	return bs.queryBatches("SELECT "+batchColumns+" FROM batches WHERE status IN (?, ?, ?, ?) ORDER BY rowid",
+		BatchValidating, BatchInProgress, BatchFinalizing, BatchCancelling)
+}
+
+func (bs *BatchStore) queryBatches(query string, args ...interface{}) ([]Batch, error) {
+	rows, err := bs.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query batches: %w", err)
+	}
+	defer rows.Close()
+
+	batches := []Batch{}
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan batch: %w", err)
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// StartBatch moves a validated batch to in_progress. It reports false if the batch was no longer validating,
+// e.g. because it was cancelled.
+func (bs *BatchStore) StartBatch(id string, total int) (bool, error) {
+	res, err := bs.db.Exec("UPDATE batches SET status = ?, in_progress_at = ?, total = ? WHERE id = ? AND status = ?",
+		BatchInProgress, time.Now().Unix(), total, id, BatchValidating)
+	if err != nil {
+		return false, fmt.Errorf("failed to start batch: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// UpdateCounts records the progress of a batch.
+func (bs *BatchStore) UpdateCounts(id string, counts BatchRequestCounts) error {
+	_, err := bs.db.Exec("UPDATE batches SET total = ?, completed = ?, failed = ? WHERE id = ?",
+		counts.Total, counts.Completed, counts.Failed, id)
+	if err != nil {
+		return fmt.Errorf("failed to update batch counts: %w", err)
+	}
+	return nil
+}
+
+// FinalizeBatch moves a batch whose requests are all done to finalizing. It reports false if the batch was
+// no longer in progress, e.g. because it was cancelled.
+func (bs *BatchStore) FinalizeBatch(id string) (bool, error) {
+	res, err := bs.db.Exec("UPDATE batches SET status = ?, finalizing_at = ? WHERE id = ? AND status = ?",
+		BatchFinalizing, time.Now().Unix(), id, BatchInProgress)
+	if err != nil {
+		return false, fmt.Errorf("failed to finalize batch: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// FinishBatch ends a batch with one of the statuses completed, failed, expired or cancelled, recording its
+// output and error files, its validation errors and its final counts.
+func (bs *BatchStore) FinishBatch(id, status, outputFileID, errorFileID string, errs *BatchErrors, counts BatchRequestCounts) error {
+	var column string
+	switch status {
+	case BatchCompleted:
+		column = "completed_at"
+	case BatchFailed:
+		column = "failed_at"
+	case BatchExpired:
+		column = "expired_at"
+	case BatchCancelled:
+		column = "cancelled_at"
+	default:
+		return fmt.Errorf("cannot finish batch with status %q", status)
+	}
+	encodedErrs := ""
+	if errs != nil {
+		b, err := json.Marshal(errs)
+		if err != nil {
+			return fmt.Errorf("failed to encode batch errors: %w", err)
+		}
+		encodedErrs = string(b)
+	}
+	_, err := bs.db.Exec(`UPDATE batches SET status = ?, `+column+` = ?, output_file_id = ?, error_file_id = ?, errors = ?,
+		total = ?, completed = ?, failed = ? WHERE id = ?`,
+		status, time.Now().Unix(), outputFileID, errorFileID, encodedErrs, counts.Total, counts.Completed, counts.Failed, id)
+	if err != nil {
+		return fmt.Errorf("failed to finish batch: %w", err)
+	}
+	return nil
+}
+
+// CancelBatch asks for a batch to be cancelled by moving it to cancelling; the runner then stops it. A batch
+// that is already cancelling or cancelled is returned as is, and one that has otherwise ended gives
+// ErrBatchNotCancellable.
+func (bs *BatchStore) CancelBatch(id string) (Batch, error) {
+	_, err := bs.db.Exec("UPDATE batches SET status = ?, cancelling_at = ? WHERE id = ? AND status IN (?, ?)",
+		BatchCancelling, time.Now().Unix(), id, BatchValidating, BatchInProgress)
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to cancel batch: %w", err)
+	}
+	b, err := bs.Batch(id)
+	if err != nil {
+		return Batch{}, err
+	}
+	if b.Status != BatchCancelling && b.Status != BatchCancelled {
+		return b, ErrBatchNotCancellable
+	}
+	return b, nil
+}
+
+// Status returns the current status of a batch.
+func (bs *BatchStore) Status(id string) (string, error) {
+	var status string
+	err := bs.db.QueryRow("SELECT status FROM batches WHERE id = ?", id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrBatchNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query batch status: %w", err)
+	}
+	return status, nil
+}
+
+// SaveResult records the output line of a request of a batch, replacing any earlier one.
+func (bs *BatchStore) SaveResult(batchID string, r BatchResult) error {
+	_, err := bs.db.Exec("INSERT OR REPLACE INTO batch_results (batch_id, line, failed, output) VALUES (?, ?, ?, ?)",
+		batchID, r.Line, r.Failed, r.Output)
+	if err != nil {
+		return fmt.Errorf("failed to save batch result: %w", err)
+	}
+	return nil
+}
+
+// Results returns the recorded results of a batch in input order.
+func (bs *BatchStore) Results(batchID string) ([]BatchResult, error) {
+	rows, err := bs.db.Query("SELECT line, failed, output FROM batch_results WHERE batch_id = ? ORDER BY line", batchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query batch results: %w", err)
+	}
+	defer rows.Close()
+
+	var results []BatchResult
+	for rows.Next() {
+		var r BatchResult
+		if err := rows.Scan(&r.Line, &r.Failed, &r.Output); err != nil {
+			return nil, fmt.Errorf("failed to scan batch result: %w", err)
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// DeleteResults removes the recorded results of a batch once they have been written to its files.
+func (bs *BatchStore) DeleteResults(batchID string) error {
+	if _, err := bs.db.Exec("DELETE FROM batch_results WHERE batch_id = ?", batchID); err != nil {
+		return fmt.Errorf("failed to delete batch results: %w", err)
+	}
+	return nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBatch(row rowScanner) (Batch, error) {
+	b := Batch{Object: "batch"}
+	var errs, metadata string
+	err := row.Scan(&b.ID, &b.Endpoint, &errs, &b.InputFileID, &b.CompletionWindow, &b.Status, &b.OutputFileID, &b.ErrorFileID,
+		&b.CreatedAt, &b.InProgressAt, &b.ExpiresAt, &b.FinalizingAt, &b.CompletedAt, &b.FailedAt, &b.ExpiredAt, &b.CancellingAt,
+		&b.CancelledAt, &b.RequestCounts.Total, &b.RequestCounts.Completed, &b.RequestCounts.Failed, &metadata, &b.Client)
+	if err != nil {
+		return Batch{}, err
+	}
+	if errs != "" {
+		b.Errors = &BatchErrors{}
+		if err := json.Unmarshal([]byte(errs), b.Errors); err != nil {
+			return Batch{}, fmt.Errorf("failed to decode batch errors: %w", err)
+		}
+	}
+	if metadata != "" && metadata != "null" {
+		if err := json.Unmarshal([]byte(metadata), &b.Metadata); err != nil {
+			return Batch{}, fmt.Errorf("failed to decode batch metadata: %w", err)
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// File purposes.
+const (
+	FilePurposeBatch       = "batch"
+	FilePurposeBatchOutput = "batch_output"
+)
+
+// ErrFileNotFound is returned when no file has the requested ID.
+var ErrFileNotFound = errors.New("file not found")
+
+// File is an uploaded or generated file, described like an OpenAI file object.
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	// Client is the credential identity of the client that uploaded the file, or whose batch produced it.
+	// Only that client can see the file.
+	Client string `json:"-"`
+}
+
+// FileStore keeps the files of the Files API in the SQLite database.
+type FileStore struct {
+	db *sql.DB
+}
+
+// NewFileStore creates a new FileStore with a database connection.
+func NewFileStore(db *sql.DB) *FileStore {
+	return &FileStore{
+		db: db,
+	}
+}
+
+// CreateFile stores a new file owned by client and returns its description.
+func (fs *FileStore) CreateFile(client, purpose, filename string, content []byte) (File, error) {
+	f := File{
+		ID:        newID("file-"),
+		Object:    "file",
+		Bytes:     len(content),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Client:    client,
+	}
+	_, err := fs.db.Exec("INSERT INTO files (id, purpose, filename, bytes, content, created_at, client) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		f.ID, f.Purpose, f.Filename, f.Bytes, content, f.CreatedAt, f.Client)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to insert file: %w", err)
+	}
+	return f, nil
+}
+
+// File returns the description of a file owned by client, or ErrFileNotFound.
+func (fs *FileStore) File(id, client string) (File, error) {
+	f := File{Object: "file"}
+	err := fs.db.QueryRow("SELECT id, purpose, filename, bytes, created_at, client FROM files WHERE id = ? AND client = ?", id, client).
+		Scan(&f.ID, &f.Purpose, &f.Filename, &f.Bytes, &f.CreatedAt, &f.Client)
+	if err == sql.ErrNoRows {
+		return File{}, ErrFileNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("failed to query file: %w", err)
+	}
+	return f, nil
+}
+
+// Files returns the files owned by client with the given purpose, or all of them if purpose is empty, newest first.
+func (fs *FileStore) Files(client, purpose string) ([]File, error) {
+	rows, err := fs.db.Query(`SELECT id, purpose, filename, bytes, created_at, client FROM files
+		WHERE client = ? AND (? = '' OR purpose = ?) ORDER BY created_at DESC, rowid DESC`, client, purpose, purpose)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		f := File{Object: "file"}
+		if err := rows.Scan(&f.ID, &f.Purpose, &f.Filename, &f.Bytes, &f.CreatedAt, &f.Client); err != nil {
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// Content returns the content of a file owned by client, or ErrFileNotFound.
+func (fs *FileStore) Content(id, client string) ([]byte, error) {
+	var content []byte
+	err := fs.db.QueryRow("SELECT content FROM files WHERE id = ? AND client = ?", id, client).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file content: %w", err)
+	}
+	return content, nil
+}
+
+// DeleteFile removes a file owned by client, or returns ErrFileNotFound.
+func (fs *FileStore) DeleteFile(id, client string) error {
+	res, err := fs.db.Exec("DELETE FROM files WHERE id = ? AND client = ?", id, client)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// newID returns a random identifier with the given prefix, in the style of OpenAI object IDs.
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
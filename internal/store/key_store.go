@@ -0,0 +1,72 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Key override actions.
+const (
+	KeyAdded   = "added"
+	KeyRemoved = "removed"
+)
+
+// KeyOverride is a change made to a provider's key pool at runtime, on top of the configured keys.
+// Action is KeyAdded, KeyRemoved or empty when only the disabled flag differs from the configuration.
+type KeyOverride struct {
+	Provider string
+	Key      string
+	Action   string
+	Disabled bool
+}
+
+// KeyStore persists runtime key pool changes in the SQLite database, so they survive restarts.
+type KeyStore struct {
+	db *sql.DB
+}
+
+// NewKeyStore creates a new KeyStore with a database connection.
+func NewKeyStore(db *sql.DB) *KeyStore {
+	return &KeyStore{
+		db: db,
+	}
+}
+
+// Overrides returns every stored override in the order they were first made.
+func (ks *KeyStore) Overrides() ([]KeyOverride, error) {
+	rows, err := ks.db.Query("SELECT provider, key, action, disabled FROM key_overrides ORDER BY rowid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key overrides: %w", err)
+	}
+	defer rows.Close()
+
+	var overrides []KeyOverride
+	for rows.Next() {
+		var o KeyOverride
+		if err := rows.Scan(&o.Provider, &o.Key, &o.Action, &o.Disabled); err != nil {
+			return nil, fmt.Errorf("failed to scan key override: %w", err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// SetOverride creates or replaces the override of a key.
+func (ks *KeyStore) SetOverride(o KeyOverride) error {
+	_, err := ks.db.Exec(`INSERT INTO key_overrides (provider, key, action, disabled, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (provider, key) DO UPDATE SET action = excluded.action, disabled = excluded.disabled, updated_at = excluded.updated_at`,
+		o.Provider, o.Key, o.Action, o.Disabled, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to save key override: %w", err)
+	}
+	return nil
+}
+
+// DeleteOverride removes the override of a key, so it is back to what the configuration says.
+func (ks *KeyStore) DeleteOverride(provider, key string) error {
+	if _, err := ks.db.Exec("DELETE FROM key_overrides WHERE provider = ? AND key = ?", provider, key); err != nil {
+		return fmt.Errorf("failed to delete key override: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UsageRecord is the accounting entry for a single chat completion.
+type UsageRecord struct {
+	Timestamp        time.Time
+	Model            string
+	KeyID            string // Stable ID of the upstream key, as shown by the admin API; empty if none was used
+	Client           string
+	ConversationID   string
+	Stream           bool
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+	Latency          time.Duration
+	Status           int
+	CacheStatus      string
+	// Hedge is HedgeWon for the answered attempt of a hedged request, HedgeLost for a hedged attempt
+	// that was canceled, and empty otherwise.
+	Hedge string
+}
+
+// Values of UsageRecord.Hedge.
+const (
+	HedgeWon  = "won"
+	HedgeLost = "lost"
+)
+
+// ModelPrice is the price of a model in US dollars per million tokens.
+type ModelPrice struct {
+	Model       string  `json:"model"`
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input"`
+	Output      float64 `json:"output"`
+}
+
+// UsageSummary aggregates usage over one group of a report. Grouping fields that were not
+// requested are left empty.
+type UsageSummary struct {
+	Day              string  `json:"day,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Client           string  `json:"client,omitempty"`
+	Hedge            string  `json:"hedge,omitempty"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// usageGroupColumns maps the supported report groupings to SQL expressions.
+var usageGroupColumns = map[string]string{
+	"day":    "date(u.timestamp, 'unixepoch')",
+	"model":  "u.model",
+	"client": "u.client",
+	"hedge":  "u.hedge",
+}
+
+// UsageStore records usage and prices in the SQLite database.
+type UsageStore struct {
+	db *sql.DB
+}
+
+// NewUsageStore creates a new UsageStore with a database connection.
+func NewUsageStore(db *sql.DB) *UsageStore {
+	return &UsageStore{
+		db: db,
+	}
+}
+
+// Record persists a usage record.
+func (us *UsageStore) Record(r UsageRecord) error {
+	_, err := us.db.Exec(`INSERT INTO usage (timestamp, model, key_id, client, conversation_id, stream,
+		prompt_tokens, completion_tokens, cached_tokens, latency_ms, status, cache_status, hedge)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Timestamp.Unix(), r.Model, r.KeyID, r.Client, r.ConversationID, r.Stream,
+		r.PromptTokens, r.CompletionTokens, r.CachedTokens, r.Latency.Milliseconds(), r.Status, r.CacheStatus, r.Hedge)
+	if err != nil {
+		return fmt.Errorf("failed to insert usage record: %w", err)
+	}
+	return nil
+}
+
+// Summary aggregates usage since the given time, grouped by any of "day", "model", "client" and "hedge".
+// Costs are computed from the current price table.
+func (us *UsageStore) Summary(groupBy []string, since time.Time) ([]UsageSummary, error) {
+	var columns []string
+	for _, g := range groupBy {
+		if g == "" {
+			continue
+		}
+		column, ok := usageGroupColumns[g]
+		if !ok {
+			return nil, fmt.Errorf("unknown usage grouping %q", g)
+		}
+		columns = append(columns, column)
+	}
+
+	selectColumns := make([]string, 0, 4)
+	for _, g := range []string{"day", "model", "client", "hedge"} {
+		if containsGroup(groupBy, g) {
+			selectColumns = append(selectColumns, usageGroupColumns[g])
+		} else {
+			selectColumns = append(selectColumns, "''")
+		}
+	}
+
+	query := `SELECT ` + strings.Join(selectColumns, ", ") + `,
+		COUNT(*),
+		SUM(CASE WHEN u.status >= 400 THEN 1 ELSE 0 END),
+		SUM(u.prompt_tokens), SUM(u.completion_tokens), SUM(u.cached_tokens),
+		SUM(((u.prompt_tokens - u.cached_tokens) * COALESCE(p.input, 0)
+			+ u.cached_tokens * COALESCE(p.cached_input, 0)
+			+ u.completion_tokens * COALESCE(p.output, 0)) / 1000000.0)
+		FROM usage u LEFT JOIN model_prices p ON p.model = u.model
+		WHERE u.timestamp >= ?`
+	if len(columns) > 0 {
+		query += " GROUP BY " + strings.Join(columns, ", ") + " ORDER BY " + strings.Join(columns, ", ")
+	}
+
+	rows, err := us.db.Query(query, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	var summaries []UsageSummary
+	for rows.Next() {
+		var s UsageSummary
+		var promptTokens, completionTokens, cachedTokens sql.NullInt64
+		var cost sql.NullFloat64
+		if err := rows.Scan(&s.Day, &s.Model, &s.Client, &s.Hedge, &s.Requests, &s.Errors, &promptTokens, &completionTokens, &cachedTokens, &cost); err != nil {
+			return nil, fmt.Errorf("failed to scan usage summary: %w", err)
+		}
+		if s.Requests == 0 {
+			continue
+		}
+		s.PromptTokens, s.CompletionTokens, s.CachedTokens = int(promptTokens.Int64), int(completionTokens.Int64), int(cachedTokens.Int64)
+		s.Cost = cost.Float64
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+// Prices returns the price table.
+func (us *UsageStore) Prices() ([]ModelPrice, error) {
+	rows, err := us.db.Query("SELECT model, input, cached_input, output FROM model_prices ORDER BY model")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prices: %w", err)
+	}
+	defer rows.Close()
+
+	prices := []ModelPrice{}
+	for rows.Next() {
+		var p ModelPrice
+		if err := rows.Scan(&p.Model, &p.Input, &p.CachedInput, &p.Output); err != nil {
+			return nil, fmt.Errorf("failed to scan price: %w", err)
+		}
+		prices = append(prices, p)
+	}
+	return prices, rows.Err()
+}
+
+// SetPrice creates or replaces the price of a model.
+func (us *UsageStore) SetPrice(p ModelPrice) error {
+	_, err := us.db.Exec("INSERT OR REPLACE INTO model_prices (model, input, cached_input, output) VALUES (?, ?, ?, ?)",
+		p.Model, p.Input, p.CachedInput, p.Output)
+	if err != nil {
+		return fmt.Errorf("failed to set price: %w", err)
+	}
+	return nil
+}
+
+// DeletePrice removes a model from the price table.
+func (us *UsageStore) DeletePrice(model string) error {
+	_, err := us.db.Exec("DELETE FROM model_prices WHERE model = ?", model)
+	if err != nil {
+		return fmt.Errorf("failed to delete price: %w", err)
+	}
+	return nil
+}
+
+func containsGroup(groupBy []string, g string) bool {
+	for _, v := range groupBy {
+		if v == g {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"vertigo/internal/db"
+)
+
+func newTestUsageStore(t *testing.T) *UsageStore {
+	t.Helper()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "vertigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return NewUsageStore(database)
+}
+
+func TestUsageSummary(t *testing.T) {
+	us := newTestUsageStore(t)
+	day := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []UsageRecord{
+		{Timestamp: day, Model: "gemini-a", KeyID: "aaaa", Client: "alice", PromptTokens: 1000, CompletionTokens: 100, CachedTokens: 200, Status: 200},
+		{Timestamp: day, Model: "gemini-a", KeyID: "bbbb", Client: "bob", PromptTokens: 500, CompletionTokens: 50, Status: 200},
+		{Timestamp: day.Add(24 * time.Hour), Model: "gemini-b", Client: "alice", Status: 503},
+		{Timestamp: day.Add(-48 * time.Hour), Model: "gemini-a", Client: "alice", PromptTokens: 1e6, Status: 200},
+	}
+	for _, r := range records {
+		if err := us.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.SetPrice(ModelPrice{Model: "gemini-a", Input: 1, CachedInput: 0.5, Output: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := us.Summary([]string{"model"}, day.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (1300 uncached * 1 + 200 cached * 0.5 + 150 output * 10) / 1e6
+	wantCost := (1300 + 100 + 1500) / 1e6
+	if len(got) != 2 || got[0].Model != "gemini-a" || got[1].Model != "gemini-b" {
+		t.Fatalf("summary = %+v, want gemini-a and gemini-b", got)
+	}
+	if a := got[0]; a.Requests != 2 || a.PromptTokens != 1500 || a.CompletionTokens != 150 || a.CachedTokens != 200 ||
+		math.Abs(a.Cost-wantCost) > 1e-12 {
+		t.Errorf("gemini-a = %+v, want cost %v", a, wantCost)
+	}
+	if b := got[1]; b.Requests != 1 || b.Errors != 1 || b.Cost != 0 {
+		t.Errorf("gemini-b = %+v, want one unpriced error", b)
+	}
+
+	got, err = us.Summary([]string{"day", "client"}, day.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups [][2]string
+	for _, s := range got {
+		groups = append(groups, [2]string{s.Day, s.Client})
+	}
+	if want := [][2]string{{"2026-05-01", "alice"}, {"2026-05-01", "bob"}, {"2026-05-02", "alice"}}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %v, want %v", groups, want)
+	}
+
+	if _, err := us.Summary([]string{"key"}, day); err == nil {
+		t.Error("Summary() accepted an unknown grouping")
+	}
+}
+
+func TestUsageRecordKeepsKeyID(t *testing.T) {
+	us := newTestUsageStore(t)
+	if err := us.Record(UsageRecord{Timestamp: time.Now(), Model: "gemini-a", KeyID: "0123456789ab", Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	var keyID string
+	if err := us.db.QueryRow("SELECT key_id FROM usage").Scan(&keyID); err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "0123456789ab" {
+		t.Errorf("key_id = %q", keyID)
+	}
+}
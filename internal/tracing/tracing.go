@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"vertigo/internal/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys used on vertigo spans.
+const (
+	AttrProvider       = attribute.Key("vertigo.provider")
+	AttrModel          = attribute.Key("vertigo.model")
+	AttrRouteReason    = attribute.Key("vertigo.route_reason")
+	AttrKeyIndex       = attribute.Key("vertigo.key_index")
+	AttrStatusCode     = attribute.Key("http.response.status_code")
+	AttrConversationID = attribute.Key("vertigo.conversation_id")
+	AttrStream         = attribute.Key("vertigo.stream")
+)
+
+// Tracer returns the tracer used for all vertigo spans. It is a no-op until Setup installs a provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer("vertigo")
+}
+
+// Setup installs the global tracer provider and W3C trace context propagator described in the
+// configuration. The returned function flushes and stops the exporter.
+func Setup(cfg config.TracingConfig) (func(context.Context) error, error) {
+	// Propagate incoming traceparent headers even when no spans are exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closer, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "vertigo"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	sampleRatio := cfg.SampleRatio
+	if sampleRatio <= 0 {
+		sampleRatio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// newExporter creates the span exporter for the configured exporter type.
+func newExporter(cfg config.TracingConfig) (sdktrace.SpanExporter, io.Closer, error) {
+	switch cfg.Exporter {
+	case "", "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		return exporter, nil, nil
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		return exporter, nil, nil
+	case "file":
+		if cfg.File == "" {
+			return nil, nil, fmt.Errorf("tracing exporter \"file\" requires tracing.file")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		return exporter, f, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+}